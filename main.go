@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"influxdb-relay/relay"
 )
@@ -28,19 +29,77 @@ func main() {
 		fmt.Fprintln(os.Stderr, "Problem loading config file:", err)
 	}
 
+	if flag.Arg(0) == "migrate" {
+		migrate(cfg)
+		return
+	}
+
 	r, err := relay.New(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	r.SetConfigFile(*configFile)
+
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
+	stopping := make(chan struct{})
+	shutdown := make(chan error, 1)
 	go func() {
-		<-sigChan
-		r.Stop()
+		sig := <-sigChan
+		log.Printf("%s received, shutting down...\n", sig)
+		close(stopping)
+
+		go func() {
+			<-sigChan
+			log.Println("forced shutdown")
+			os.Exit(1)
+		}()
+		shutdown <- r.Shutdown()
+	}()
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	go func() {
+		for range hupChan {
+			log.Println("reloading configuration...")
+			if err := r.ReloadFile(); err != nil {
+				log.Println("reload failed:", err)
+			}
+		}
 	}()
 
 	log.Println("starting relays...")
 	r.Run()
+
+	select {
+	case <-stopping:
+	default:
+		return
+	}
+	if err := <-shutdown; err != nil {
+		log.Println("shutdown:", err)
+		os.Exit(1)
+	}
+	log.Println("shutdown complete")
+}
+
+// migrate copies the data of the former ring to the current one and exits.
+func migrate(cfg relay.Config) {
+	stop := make(chan struct{})
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+
+	go func() {
+		<-sigChan
+		close(stop)
+	}()
+
+	log.Println("starting migration...")
+	if err := relay.Migrate(cfg, stop); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("migration done")
 }
@@ -0,0 +1,340 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrShardExists    = errors.New("shard already exists")
+	ErrShardNotFound  = errors.New("shard not found")
+	ErrBackendExists  = errors.New("backend already exists")
+	ErrBackendMissing = errors.New("backend not found")
+	ErrLastShard      = errors.New("can't remove the last shard of the ring")
+	ErrLastBackend    = errors.New("can't remove the last backend of a shard, remove the shard instead")
+	ErrAdminWAL       = errors.New("wal-dir can only be set in the configuration file")
+)
+
+// admin wraps a handler of the admin API, which needs the admin token.
+func (h *HTTP) admin(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token := h.adminToken()
+		if token == "" {
+			jsonError(w, http.StatusForbidden, "admin API disabled, admin-token not set")
+			return
+		}
+
+		got := req.Header.Get("X-Admin-Token")
+		if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			got = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			jsonError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+
+		fn(w, req)
+	}
+}
+
+// adminWrite wraps a handler whose GET only reports a state and is
+// public, the other methods change it and need the admin token.
+func (h *HTTP) adminWrite(fn http.HandlerFunc) http.HandlerFunc {
+	admin := h.admin(fn)
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" {
+			fn(w, req)
+			return
+		}
+		admin(w, req)
+	}
+}
+
+func (h *HTTP) adminToken() string {
+	h.ic.lock.RLock()
+	defer h.ic.lock.RUnlock()
+	return h.ic.cfg.AdminToken
+}
+
+type backendInfo struct {
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	Active   bool   `json:"active"`
+	State    string `json:"state"`
+}
+
+type shardInfo struct {
+	Name     string        `json:"name"`
+	Backends []backendInfo `json:"backends"`
+}
+
+func shardInfos(nodes map[string][]*HttpBackend) []shardInfo {
+	list := make([]shardInfo, 0, len(nodes))
+	for k, v := range nodes {
+		si := shardInfo{Name: k, Backends: make([]backendInfo, 0, len(v))}
+		for _, b := range v {
+			si.Backends = append(si.Backends, backendInfo{b.name, b.Location, b.IsActive(), b.State().String()})
+		}
+		list = append(list, si)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// HandlerRing lists the shards with their backends, or with ?key= the
+// shards a routing key maps to in the current and former ring.
+func (h *HTTP) HandlerRing(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid method")
+		return
+	}
+
+	if key := req.FormValue("key"); key != "" {
+		rt := h.ic.routing()
+		resp := struct {
+			Key     string `json:"key"`
+			Current string `json:"current"`
+			Former  string `json:"former,omitempty"`
+		}{Key: key, Current: rt.ring.Get(key)}
+		if rt.former != nil {
+			resp.Former = rt.former.Get(key)
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	h.ic.lock.RLock()
+	resp := struct {
+		Replicas  int         `json:"replicas"`
+		DualWrite bool        `json:"dual_write"`
+		Shards    []shardInfo `json:"shards"`
+		Former    []shardInfo `json:"former,omitempty"`
+	}{
+		Replicas:  h.ic.replicas,
+		DualWrite: h.ic.DualWriting(),
+		Shards:    shardInfos(h.ic.nodes),
+	}
+	if h.ic.formerNodes != nil {
+		resp.Former = shardInfos(h.ic.formerNodes)
+	}
+	h.ic.lock.RUnlock()
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// HandlerRingShard adds (POST) or removes (DELETE) a shard. A new shard is
+// sent as {"name": ..., "backends": [output, ...]} with outputs as in the
+// configuration file, former=true selects the former ring.
+func (h *HTTP) HandlerRingShard(w http.ResponseWriter, req *http.Request) {
+	former, err := formerParam(req)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch req.Method {
+	case "POST":
+		var shard struct {
+			Name     string             `json:"name"`
+			Backends []HTTPOutputConfig `json:"backends"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&shard); err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid shard: "+err.Error())
+			return
+		}
+		if shard.Name == "" || len(shard.Backends) == 0 {
+			jsonError(w, http.StatusBadRequest, "shard needs a name and backends")
+			return
+		}
+		for i := range shard.Backends {
+			if err := validateOutput(shard.Backends[:i], shard.Backends[i]); err != nil {
+				jsonError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		err = h.ic.updateConfig(func(cfg *HTTPConfig) error {
+			outputs := ringOutputs(cfg, former)
+			if _, ok := outputs[shard.Name]; ok {
+				return ErrShardExists
+			}
+			outputs[shard.Name] = shard.Backends
+			return nil
+		})
+
+	case "DELETE":
+		name := req.FormValue("name")
+		err = h.ic.updateConfig(func(cfg *HTTPConfig) error {
+			outputs := ringOutputs(cfg, former)
+			if _, ok := outputs[name]; !ok {
+				return ErrShardNotFound
+			}
+			if len(outputs) == 1 && !former {
+				return ErrLastShard
+			}
+			delete(outputs, name)
+			if former && len(outputs) == 0 {
+				cfg.Former = nil
+			}
+			return nil
+		})
+
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid method")
+		return
+	}
+
+	adminResult(w, err)
+}
+
+// HandlerRingBackend adds (POST) a backend to or removes (DELETE) a
+// backend from the shard given by ?shard=, former=true selects the former
+// ring. A new backend is sent as an output of the configuration file.
+func (h *HTTP) HandlerRingBackend(w http.ResponseWriter, req *http.Request) {
+	former, err := formerParam(req)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	shard := req.FormValue("shard")
+
+	switch req.Method {
+	case "POST":
+		var b HTTPOutputConfig
+		if err := json.NewDecoder(req.Body).Decode(&b); err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid backend: "+err.Error())
+			return
+		}
+
+		err = h.ic.updateConfig(func(cfg *HTTPConfig) error {
+			outputs := ringOutputs(cfg, former)
+			list, ok := outputs[shard]
+			if !ok {
+				return ErrShardNotFound
+			}
+			if err := validateOutput(list, b); err != nil {
+				return err
+			}
+			outputs[shard] = append(list, b)
+			return nil
+		})
+
+	case "DELETE":
+		name := req.FormValue("name")
+		err = h.ic.updateConfig(func(cfg *HTTPConfig) error {
+			outputs := ringOutputs(cfg, former)
+			list, ok := outputs[shard]
+			if !ok {
+				return ErrShardNotFound
+			}
+			for i, b := range list {
+				if b.Name != name {
+					continue
+				}
+				if len(list) == 1 {
+					return ErrLastBackend
+				}
+				outputs[shard] = append(list[:i:i], list[i+1:]...)
+				return nil
+			}
+			return ErrBackendMissing
+		})
+
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid method")
+		return
+	}
+
+	adminResult(w, err)
+}
+
+func formerParam(req *http.Request) (bool, error) {
+	v := req.FormValue("former")
+	if v == "" {
+		return false, nil
+	}
+	former, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.New("invalid parameter: former")
+	}
+	return former, nil
+}
+
+// ringOutputs returns the outputs of the current or the former ring.
+func ringOutputs(cfg *HTTPConfig, former bool) map[string][]HTTPOutputConfig {
+	if !former {
+		if cfg.Outputs == nil {
+			cfg.Outputs = make(map[string][]HTTPOutputConfig)
+		}
+		return cfg.Outputs
+	}
+	if cfg.Former == nil {
+		cfg.Former = make(map[string][]HTTPOutputConfig)
+	}
+	return cfg.Former
+}
+
+// validateOutput checks a backend that is added next to list.
+func validateOutput(list []HTTPOutputConfig, b HTTPOutputConfig) error {
+	if b.Name == "" {
+		return errors.New("backend needs a name")
+	}
+	u, err := url.Parse(b.Location)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp") || u.Host == "" {
+		return fmt.Errorf("invalid backend location %q", b.Location)
+	}
+	for _, o := range list {
+		if o.Name == b.Name {
+			return ErrBackendExists
+		}
+	}
+	// ring changes are lost on reload, which would orphan the WAL
+	if b.WALDir != "" {
+		return ErrAdminWAL
+	}
+
+	for _, d := range []string{b.Timeout, b.Interval, b.MaxDelayInterval} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return fmt.Errorf("error parsing duration '%v'", err)
+		}
+	}
+	return nil
+}
+
+func adminResult(w http.ResponseWriter, err error) {
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case ErrShardNotFound, ErrBackendMissing:
+		jsonError(w, http.StatusNotFound, err.Error())
+	case ErrShardExists, ErrBackendExists:
+		jsonError(w, http.StatusConflict, err.Error())
+	default:
+		jsonError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "json marshal failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
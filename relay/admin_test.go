@@ -0,0 +1,175 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminRing(t *testing.T) {
+	cfg := HTTPConfig{
+		Replicas:   10,
+		AdminToken: "secret",
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: "http://127.0.0.1:1"}},
+		},
+	}
+	ic, err := NewInfluxCluster(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	h := &HTTP{ic: ic, mux: http.NewServeMux()}
+	h.settings.Store(new(httpSettings))
+	h.Register()
+
+	do := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("GET", "/admin/ring", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("no token: got %d", w.Code)
+	}
+	if w := do("GET", "/admin/ring", "wrong", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: got %d", w.Code)
+	}
+
+	tests := []struct {
+		method, url, body string
+		code              int
+	}{
+		{"POST", "/admin/ring/shard", `{"name":"b","backends":[{"name":"b1","location":"http://127.0.0.1:2"}]}`, http.StatusNoContent},
+		{"POST", "/admin/ring/shard", `{"name":"b","backends":[{"name":"b1","location":"http://127.0.0.1:2"}]}`, http.StatusConflict},
+		{"POST", "/admin/ring/shard", `{"name":"c","backends":[{"name":"c1","location":"ftp://127.0.0.1:3"}]}`, http.StatusBadRequest},
+		{"POST", "/admin/ring/backend?shard=b", `{"name":"b2","location":"http://127.0.0.1:4"}`, http.StatusNoContent},
+		{"POST", "/admin/ring/backend?shard=b", `{"name":"b2","location":"http://127.0.0.1:5"}`, http.StatusConflict},
+		{"POST", "/admin/ring/backend?shard=x", `{"name":"x1","location":"http://127.0.0.1:5"}`, http.StatusNotFound},
+		{"POST", "/admin/ring/backend?shard=b", `{"name":"b3","location":"http://127.0.0.1:6","wal-dir":"/tmp/wal"}`, http.StatusBadRequest},
+		{"POST", "/admin/ring/shard", `{"name":"d","backends":[{"name":"d1","location":"http://127.0.0.1:7","wal-dir":"/tmp/wal"}]}`, http.StatusBadRequest},
+		{"DELETE", "/admin/ring/backend?shard=b&name=b1", "", http.StatusNoContent},
+		{"DELETE", "/admin/ring/backend?shard=b&name=b2", "", http.StatusBadRequest},
+		{"DELETE", "/admin/ring/shard?name=a", "", http.StatusNoContent},
+		{"DELETE", "/admin/ring/shard?name=b", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := do(tt.method, tt.url, "secret", tt.body); w.Code != tt.code {
+			t.Errorf("%s %s: got %d, want %d: %s", tt.method, tt.url, w.Code, tt.code, w.Body)
+		}
+	}
+
+	w := do("GET", "/admin/ring", "secret", "")
+	var ring struct {
+		Shards []shardInfo `json:"shards"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &ring); err != nil {
+		t.Fatal(err)
+	}
+	if len(ring.Shards) != 1 || ring.Shards[0].Name != "b" ||
+		len(ring.Shards[0].Backends) != 1 || ring.Shards[0].Backends[0].Name != "b2" {
+		t.Errorf("unexpected ring %s", w.Body)
+	}
+
+	w = do("GET", "/admin/ring?key=cpu", "secret", "")
+	if !strings.Contains(w.Body.String(), `"current":"b"`) {
+		t.Errorf("unexpected route %s", w.Body)
+	}
+
+	// a reload from the configuration file replaces the changes
+	ic.Reload(HTTPConfig{Outputs: cfg.Outputs})
+	if w := do("GET", "/admin/ring", "secret", ""); w.Code != http.StatusForbidden {
+		t.Errorf("admin API without token: got %d", w.Code)
+	}
+	if _, ok := ic.nodes["b"]; ok || ic.edited {
+		t.Errorf("admin changes survived the reload: %v", ic.nodes)
+	}
+}
+
+func TestAdminMigrate(t *testing.T) {
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas:   10,
+		AdminToken: "secret",
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: "http://127.0.0.1:1"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	h := &HTTP{ic: ic, mux: http.NewServeMux()}
+	h.settings.Store(new(httpSettings))
+	h.Register()
+
+	tests := []struct {
+		method, token string
+		code          int
+	}{
+		// the status is public, without a former ring there is none
+		{"GET", "", http.StatusNotFound},
+		{"POST", "", http.StatusUnauthorized},
+		{"POST", "wrong", http.StatusUnauthorized},
+		{"POST", "secret", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/migrate", nil)
+		if tt.token != "" {
+			req.Header.Set("X-Admin-Token", tt.token)
+		}
+		w := httptest.NewRecorder()
+		h.mux.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s /migrate with token %q: got %d, want %d", tt.method, tt.token, w.Code, tt.code)
+		}
+	}
+}
+
+func TestAdminDualWrite(t *testing.T) {
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas:   10,
+		AdminToken: "secret",
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: "http://127.0.0.1:1"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	h := &HTTP{ic: ic, mux: http.NewServeMux()}
+	h.settings.Store(new(httpSettings))
+	h.Register()
+
+	tests := []struct {
+		method, url, token string
+		code               int
+	}{
+		{"POST", "/dual-write?enabled=false", "secret", http.StatusNotFound},
+		{"GET", "/admin/dual-write", "", http.StatusUnauthorized},
+		{"POST", "/admin/dual-write?enabled=false", "", http.StatusUnauthorized},
+		{"GET", "/admin/dual-write", "secret", http.StatusOK},
+		// there is no former ring to write to
+		{"POST", "/admin/dual-write?enabled=true", "secret", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.url, nil)
+		if tt.token != "" {
+			req.Header.Set("X-Admin-Token", tt.token)
+		}
+		w := httptest.NewRecorder()
+		h.mux.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s %s with token %q: got %d, want %d", tt.method, tt.url, tt.token, w.Code, tt.code)
+		}
+	}
+}
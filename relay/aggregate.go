@@ -0,0 +1,480 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Aggregates computed on several shards can't be merged by filling nulls:
+// the mean of two means is not the mean of all points. An aggregation
+// rewrites a statement into partials every backend can compute (sum and
+// count for mean, min, max, count, sum, first, last) and combines the
+// partials of all shards into the answer the client asked for.
+type aggregation struct {
+	st   *Statement
+	push *Statement
+
+	fields []*partialField
+
+	// selector is set when the only field is a selector and there is no
+	// GROUP BY time, InfluxDB then returns the time of the selected point.
+	selector bool
+}
+
+// partialField is a field of the original statement and the columns of
+// the pushed statement it is computed from.
+type partialField struct {
+	name string
+	fn   string
+	cols []string
+}
+
+// newAggregation returns nil when the statement has no aggregates, its
+// answers are merged as they are. Aggregates that can't be split into
+// partials, e.g. unsupported functions, math on aggregates, aggregates of
+// subqueries or fill(linear), are an error.
+func newAggregation(st *Statement) (*aggregation, error) {
+	if st.Type != StatementSelect || st.Explain || st.Into != nil || len(st.Fields) == 0 {
+		return nil, nil
+	}
+	if !hasAggregate(st) {
+		return nil, nil
+	}
+	if st.Fill == "linear" {
+		return nil, errors.New("fill(linear) cannot be computed across shards")
+	}
+	for _, s := range st.Sources {
+		if _, ok := s.(*Measurement); !ok {
+			return nil, errors.New("aggregates of subqueries cannot be computed across shards")
+		}
+	}
+
+	a := &aggregation{st: st}
+	push := *st
+	push.Fields = nil
+	push.Fill = ""
+	shardLimits(&push)
+
+	names := make(map[string]int)
+	for i, f := range st.Fields {
+		c, ok := f.Expr.(*Call)
+		if !ok || len(c.Args) != 1 {
+			return nil, fmt.Errorf("aggregate %s cannot be computed across shards", f.Expr)
+		}
+		arg, ok := c.Args[0].(*VarRef)
+		if !ok {
+			return nil, fmt.Errorf("aggregate %s cannot be computed across shards", f.Expr)
+		}
+
+		fn := strings.ToLower(c.Name)
+		var parts []string
+		switch fn {
+		case "mean":
+			parts = []string{"sum", "count"}
+		case "count", "sum", "min", "max", "first", "last":
+			parts = []string{fn}
+		default:
+			return nil, fmt.Errorf("aggregate %s cannot be computed across shards", f.Expr)
+		}
+
+		pf := &partialField{name: columnName(names, f.Name()), fn: fn}
+		for _, p := range parts {
+			col := "__" + p + "_" + strconv.Itoa(i)
+			push.Fields = append(push.Fields, &Field{
+				Expr:  &Call{Name: p, Args: []Expr{arg}},
+				Alias: col,
+			})
+			pf.cols = append(pf.cols, col)
+		}
+		a.fields = append(a.fields, pf)
+	}
+
+	if len(a.fields) == 1 && !hasTimeDimension(st) {
+		switch a.fields[0].fn {
+		case "min", "max", "first", "last":
+			a.selector = true
+		}
+	}
+
+	push.Text = push.String()
+	a.push = &push
+	return a, nil
+}
+
+// aggregateFuncs are the functions that combine several points, including
+// the transformations of a series.
+var aggregateFuncs = map[string]bool{
+	"count": true, "distinct": true, "integral": true, "mean": true, "median": true,
+	"mode": true, "spread": true, "stddev": true, "sum": true,
+	"bottom": true, "first": true, "last": true, "max": true, "min": true,
+	"percentile": true, "sample": true, "top": true,
+	"cumulative_sum": true, "derivative": true, "difference": true, "elapsed": true,
+	"moving_average": true, "non_negative_derivative": true, "non_negative_difference": true,
+	"holt_winters": true, "holt_winters_with_fit": true,
+	"chande_momentum_oscillator": true, "exponential_moving_average": true,
+	"double_exponential_moving_average": true, "triple_exponential_moving_average": true,
+	"triple_exponential_derivative": true, "kaufmans_efficiency_ratio": true,
+	"kaufmans_adaptive_moving_average": true, "relative_strength_index": true,
+}
+
+// hasAggregate reports whether a field of the statement or of one of its
+// subqueries is an aggregate.
+func hasAggregate(st *Statement) bool {
+	for _, f := range st.Fields {
+		if exprHasAggregate(f.Expr) {
+			return true
+		}
+	}
+	for _, s := range st.Sources {
+		if sq, ok := s.(*SubQuery); ok && hasAggregate(sq.Statement) {
+			return true
+		}
+	}
+	return false
+}
+
+func exprHasAggregate(e Expr) bool {
+	switch e := e.(type) {
+	case *Call:
+		if aggregateFuncs[strings.ToLower(e.Name)] {
+			return true
+		}
+		for _, arg := range e.Args {
+			if exprHasAggregate(arg) {
+				return true
+			}
+		}
+	case *BinaryExpr:
+		return exprHasAggregate(e.LHS) || exprHasAggregate(e.RHS)
+	case *ParenExpr:
+		return exprHasAggregate(e.Expr)
+	}
+	return false
+}
+
+// columnName numbers duplicate column names the way InfluxDB does.
+func columnName(names map[string]int, name string) string {
+	n := names[name]
+	names[name]++
+	if n == 0 {
+		return name
+	}
+	return name + "_" + strconv.Itoa(n)
+}
+
+func hasTimeDimension(st *Statement) bool {
+	for _, d := range st.Dimensions {
+		if c, ok := d.Expr.(*Call); ok && strings.EqualFold(c.Name, "time") {
+			return true
+		}
+	}
+	return false
+}
+
+// accumulator combines the partials of one field in one bucket. points
+// is set once a shard had points for it, count() reports 0 otherwise.
+// Sums of integers are kept in isum, float64 loses precision above 2^53.
+// shard is the answer the value of a first or last came from.
+type accumulator struct {
+	sum    float64
+	isum   int64
+	float  bool
+	count  float64
+	val    interface{}
+	time   interface{}
+	shard  int
+	set    bool
+	points bool
+}
+
+// bucket holds the partials of a time bucket, former is set when they
+// come from the former ring.
+type bucket struct {
+	time   interface{}
+	acc    []*accumulator
+	former bool
+}
+
+func (b *bucket) points() bool {
+	for _, acc := range b.acc {
+		if acc.points {
+			return true
+		}
+	}
+	return false
+}
+
+type group struct {
+	s       *series
+	buckets map[string]*bucket
+	order   []*bucket
+}
+
+// combine merges the answers of all shards to the pushed statement. The
+// time of a first or last point is only returned for a lone selector
+// without GROUP BY time, otherwise a bucket several shards have a first or
+// last point for is an error.
+//
+// The former ring usually holds the same points as the current one, after
+// a migration or under dual-write, so its answers aren't added to the
+// current ones: they only fill the buckets the current ring has no points
+// for.
+func (a *aggregation) combine(bodies, former [][]byte) ([]byte, error) {
+	d := &data{}
+	groups := make(map[string]*group)
+	var order []*group
+
+	for i, p := range append(bodies[:len(bodies):len(bodies)], former...) {
+		if len(p) == 0 {
+			continue
+		}
+
+		r := new(Result)
+		if err := decodeResult(p, r); err != nil {
+			return nil, err
+		}
+		if r.Error != "" {
+			return p, nil
+		}
+
+		for _, res := range r.Results {
+			if res.Error != "" {
+				return p, nil
+			}
+			d.Partial = d.Partial || res.Partial
+
+			for _, s := range res.Series {
+				g, ok := groups[s.id()]
+				if !ok {
+					g = &group{
+						s:       &series{Name: s.Name, Tags: s.Tags},
+						buckets: make(map[string]*bucket),
+					}
+					groups[s.id()] = g
+					order = append(order, g)
+				}
+				g.s.Partial = g.s.Partial || s.Partial
+				if err := a.add(g, s, i, i >= len(bodies)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(order, func(i, j int) bool { return order[i].s.id() < order[j].s.id() })
+	lo, hi := window(len(order), a.st.SOffset, a.st.SLimit)
+	order = order[lo:hi]
+
+	for _, g := range order {
+		a.finish(g)
+		d.Series = append(d.Series, g.s)
+	}
+
+	return json.Marshal(&Result{Results: []*data{d}})
+}
+
+func (a *aggregation) add(g *group, s *series, shard int, former bool) error {
+	ti := columnIndex(s.Columns, "time")
+	cols := make([][]int, len(a.fields))
+	for i, f := range a.fields {
+		for _, c := range f.cols {
+			cols[i] = append(cols[i], columnIndex(s.Columns, c))
+		}
+	}
+
+	for _, row := range s.Values {
+		var t interface{}
+		if ti >= 0 && ti < len(row) {
+			t = row[ti]
+		}
+
+		key := ""
+		if !a.selector {
+			key = rowKey([]interface{}{t})
+		}
+		b, ok := g.buckets[key]
+		if !ok {
+			b = &bucket{time: t, acc: make([]*accumulator, len(a.fields)), former: former}
+			for i := range b.acc {
+				b.acc[i] = new(accumulator)
+			}
+			g.buckets[key] = b
+			g.order = append(g.order, b)
+		}
+		if former && !b.former {
+			if b.points() {
+				continue
+			}
+			b.former = true
+		}
+
+		for i, f := range a.fields {
+			vals := make([]interface{}, len(cols[i]))
+			for j, c := range cols[i] {
+				if c >= 0 && c < len(row) {
+					vals[j] = row[c]
+				}
+			}
+			if err := b.acc[i].add(f.fn, vals, t, shard, a.selector); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// add adds the partials of a shard. exact is set when t is the time of
+// the point rather than of the bucket.
+func (acc *accumulator) add(fn string, vals []interface{}, t interface{}, shard int, exact bool) error {
+	switch fn {
+	case "mean":
+		s, ok1 := number(vals[0])
+		c, ok2 := number(vals[1])
+		sf, _ := s.Float64()
+		cf, _ := c.Float64()
+		if ok1 && ok2 && cf > 0 {
+			acc.sum += sf
+			acc.count += cf
+			acc.set, acc.points = true, true
+		}
+		return nil
+	case "count", "sum":
+		v, ok := number(vals[0])
+		if !ok {
+			return nil
+		}
+		f, _ := v.Float64()
+		if i, err := v.Int64(); err == nil {
+			acc.isum += i
+		} else {
+			acc.float = true
+		}
+		acc.sum += f
+		acc.set = true
+		acc.points = acc.points || fn == "sum" || f > 0
+		return nil
+	case "min", "max":
+		v, ok := number(vals[0])
+		if !ok {
+			return nil
+		}
+		cur, _ := acc.val.(json.Number)
+		if !acc.set || (fn == "min" && numberLess(v, cur)) || (fn == "max" && numberLess(cur, v)) {
+			acc.val, acc.time, acc.set = v, t, true
+		}
+		acc.points = true
+	case "first", "last":
+		if vals[0] == nil {
+			return nil
+		}
+		if acc.set && !exact && acc.shard != shard {
+			return fmt.Errorf("aggregate %s cannot be computed across shards with GROUP BY time or other fields", fn)
+		}
+		if acc.set && !(fn == "first" && timeLess(t, acc.time)) && !(fn == "last" && timeLess(acc.time, t)) {
+			return nil
+		}
+		acc.val, acc.time, acc.shard, acc.set = vals[0], t, shard, true
+		acc.points = true
+	}
+	return nil
+}
+
+func (acc *accumulator) value(fn string) interface{} {
+	if !acc.set {
+		return nil
+	}
+	switch fn {
+	case "mean":
+		return acc.sum / acc.count
+	case "count", "sum":
+		if !acc.float {
+			return json.Number(strconv.FormatInt(acc.isum, 10))
+		}
+		return acc.sum
+	}
+	return acc.val
+}
+
+// finish turns the buckets of a group into rows, applying the fill, order
+// and limits of the original statement.
+func (a *aggregation) finish(g *group) {
+	g.s.Columns = []string{"time"}
+	for _, f := range a.fields {
+		g.s.Columns = append(g.s.Columns, f.name)
+	}
+
+	sort.SliceStable(g.order, func(i, j int) bool {
+		if a.st.Descending {
+			return timeLess(g.order[j].time, g.order[i].time)
+		}
+		return timeLess(g.order[i].time, g.order[j].time)
+	})
+
+	var fill interface{}
+	if _, err := strconv.ParseFloat(a.st.Fill, 64); err == nil {
+		fill = json.Number(a.st.Fill)
+	}
+
+	var prev []interface{}
+	for _, b := range g.order {
+		row := []interface{}{b.time}
+		empty := true
+		for i, f := range a.fields {
+			v := b.acc[i].value(f.fn)
+			if a.selector {
+				row[0] = b.acc[i].time
+			}
+			if v == nil {
+				switch {
+				case fill != nil:
+					v = fill
+				case a.st.Fill == "previous" && prev != nil:
+					v = prev[i+1]
+				}
+			}
+			if b.acc[i].points {
+				empty = false
+			}
+			row = append(row, v)
+		}
+
+		if empty && (a.st.Fill == "none" || a.selector) {
+			continue
+		}
+		g.s.Values = append(g.s.Values, row)
+		prev = row
+	}
+
+	lo, hi := window(len(g.s.Values), a.st.Offset, a.st.Limit)
+	g.s.Values = g.s.Values[lo:hi]
+}
+
+// shardLimits adds OFFSET and SOFFSET of a statement sent to several shards
+// to its limits: no shard can skip rows for the others, so the offsets are
+// applied once the answers are combined.
+func shardLimits(st *Statement) {
+	if st.Limit > 0 {
+		st.Limit += st.Offset
+	}
+	st.Offset = 0
+	if st.SLimit > 0 {
+		st.SLimit += st.SOffset
+	}
+	st.SOffset = 0
+}
+
+// window returns the bounds of a list of n items after OFFSET and LIMIT.
+func window(n, offset, limit int) (lo, hi int) {
+	lo, hi = offset, n
+	if lo > n {
+		lo = n
+	}
+	if limit > 0 && lo+limit < hi {
+		hi = lo + limit
+	}
+	return lo, hi
+}
@@ -0,0 +1,212 @@
+package relay
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAggregationRewrite(t *testing.T) {
+	cases := []struct {
+		q    string
+		push string
+		err  bool
+	}{
+		{
+			"SELECT mean(value), max(value) FROM cpu WHERE time > now() - 1h GROUP BY time(10m) fill(0) LIMIT 2 OFFSET 1",
+			`SELECT sum("value") AS "__sum_0", count("value") AS "__count_0", max("value") AS "__max_1" FROM "cpu" WHERE "time" > now() - 1h GROUP BY time(10m) LIMIT 3`,
+			false,
+		},
+		{
+			"SELECT first(value) FROM cpu GROUP BY host",
+			`SELECT first("value") AS "__first_0" FROM "cpu" GROUP BY "host"`,
+			false,
+		},
+		// raw values are merged as they are
+		{"SELECT value FROM cpu", "", false},
+		{"SELECT abs(value) FROM cpu", "", false},
+		{"SELECT value FROM (SELECT value FROM cpu)", "", false},
+		{"SELECT percentile(value, 95) FROM cpu", "", true},
+		{"SELECT median(value) FROM cpu", "", true},
+		{"SELECT count(distinct(value)) FROM cpu", "", true},
+		{"SELECT mean(value) * 2 FROM cpu", "", true},
+		{"SELECT mean(value) FROM cpu GROUP BY time(1m) fill(linear)", "", true},
+		{"SELECT mean(value) FROM (SELECT value FROM cpu)", "", true},
+		{"SELECT value FROM (SELECT mean(value) FROM cpu)", "", true},
+	}
+
+	for _, c := range cases {
+		stmts, err := ParseInfluxQL(c.q)
+		if err != nil {
+			t.Fatalf("%s: %s", c.q, err)
+		}
+		a, err := newAggregation(stmts[0])
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.q)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.q, err)
+			continue
+		}
+		if c.push == "" {
+			if a != nil {
+				t.Errorf("%s: unexpected rewrite %s", c.q, a.push.Text)
+			}
+			continue
+		}
+		if a == nil {
+			t.Errorf("%s: not rewritten", c.q)
+			continue
+		}
+		if a.push.Text != c.push {
+			t.Errorf("%s:\n got %s\nwant %s", c.q, a.push.Text, c.push)
+		}
+	}
+}
+
+func combine(t *testing.T, q string, bodies ...string) *Result {
+	stmts, err := ParseInfluxQL(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAggregation(stmts[0])
+	if err != nil || a == nil {
+		t.Fatalf("%s: not rewritten: %v", q, err)
+	}
+
+	ps := make([][]byte, len(bodies))
+	for i, b := range bodies {
+		ps[i] = []byte(b)
+	}
+	p, err := a.combine(ps, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := new(Result)
+	if err := json.Unmarshal(p, r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestAggregationCombine(t *testing.T) {
+	r := combine(t, "SELECT mean(value), count(value), min(value) FROM cpu GROUP BY time(1m) fill(none)",
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__sum_0","__count_0","__count_1","__min_2"],"values":[[0,10,1,1,10],[60,null,null,0,null]]}]}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__sum_0","__count_0","__count_1","__min_2"],"values":[[0,2,3,3,0.5],[120,4,2,2,1]]}]}]}`,
+	)
+
+	s := r.Results[0].Series
+	if len(s) != 1 {
+		t.Fatalf("expected one series, got %+v", r)
+	}
+	if !reflect.DeepEqual(s[0].Columns, []string{"time", "mean", "count", "min"}) {
+		t.Errorf("unexpected columns %v", s[0].Columns)
+	}
+	expected := [][]interface{}{
+		{float64(0), float64(3), float64(4), 0.5},
+		{float64(120), float64(2), float64(2), float64(1)},
+	}
+	if !reflect.DeepEqual(s[0].Values, expected) {
+		t.Errorf("unexpected values %v", s[0].Values)
+	}
+
+	// a lone selector keeps the time of the selected point
+	r = combine(t, "SELECT last(value) FROM cpu GROUP BY host",
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","__last_0"],"values":[["2018-01-01T00:00:05Z",5]]}]}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","__last_0"],"values":[["2018-01-01T00:00:03Z",3]]},{"name":"cpu","tags":{"host":"b"},"columns":["time","__last_0"],"values":[["2018-01-01T00:00:01Z",1]]}]}]}`,
+	)
+
+	s = r.Results[0].Series
+	if len(s) != 2 {
+		t.Fatalf("expected two series, got %+v", r)
+	}
+	if !reflect.DeepEqual(s[0].Values, [][]interface{}{{"2018-01-01T00:00:05Z", float64(5)}}) {
+		t.Errorf("unexpected last for host a: %v", s[0].Values)
+	}
+	if !reflect.DeepEqual(s[1].Columns, []string{"time", "last"}) {
+		t.Errorf("unexpected columns %v", s[1].Columns)
+	}
+}
+
+func TestAggregationCombineExact(t *testing.T) {
+	stmts, err := ParseInfluxQL("SELECT sum(value), max(value) FROM cpu GROUP BY time(1u)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAggregation(stmts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// integers and epoch=ns times stay exact
+	p, err := a.combine([][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__sum_0","__max_1"],"values":[[1514764800000001000,9007199254740993,9007199254740993]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__sum_0","__max_1"],"values":[[1514764800000001000,2,2],[1514764800000002000,1.5,1.5]]}]}]}`),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","sum","max"],"values":[[1514764800000001000,9007199254740995,9007199254740993],[1514764800000002000,1.5,1.5]]}]}]}`
+	if string(p) != expected {
+		t.Errorf("unexpected result:\n%s\n%s", p, expected)
+	}
+}
+
+func TestAggregationFirstAcrossShards(t *testing.T) {
+	stmts, err := ParseInfluxQL("SELECT first(value) FROM cpu GROUP BY time(1m)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAggregation(stmts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// buckets only one shard has points for are fine
+	_, err = a.combine([][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__first_0"],"values":[[0,1],[60,null]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__first_0"],"values":[[0,null],[60,2]]}]}]}`),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the bucket time doesn't tell which point came first
+	_, err = a.combine([][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__first_0"],"values":[[0,1]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__first_0"],"values":[[0,2]]}]}]}`),
+	}, nil)
+	if err == nil {
+		t.Error("expected an error for a bucket with points on two shards")
+	}
+}
+
+func TestAggregationFormerFillsBuckets(t *testing.T) {
+	stmts, err := ParseInfluxQL("SELECT count(value) FROM cpu GROUP BY time(1m)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAggregation(stmts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the former ring holds the same points for the first bucket, only the
+	// bucket the current ring has no points for is taken from it
+	p, err := a.combine([][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__count_0"],"values":[[0,5],[60,0]]}]}]}`),
+	}, [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__count_0"],"values":[[0,5],[60,3]]}]}]}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","count"],"values":[[0,5],[60,3]]}]}]}`
+	if string(p) != expected {
+		t.Errorf("unexpected result:\n%s\n%s", p, expected)
+	}
+}
@@ -0,0 +1,447 @@
+package relay
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatementType classifies a parsed InfluxQL statement.
+type StatementType int
+
+const (
+	StatementUnknown StatementType = iota
+	StatementSelect
+	StatementDelete
+	StatementDropSeries
+	StatementDropMeasurement
+	StatementDrop
+	StatementShowMeasurements
+	StatementShowTagKeys
+	StatementShowTagValues
+	StatementShowFieldKeys
+	StatementShowSeries
+	StatementShowCardinality
+	StatementShowDatabases
+	StatementShowRetentionPolicies
+	StatementShow
+	StatementCreate
+	StatementAlter
+	StatementGrant
+	StatementRevoke
+	StatementKill
+)
+
+var statementTypes = map[StatementType]string{
+	StatementUnknown:               "UNKNOWN",
+	StatementSelect:                "SELECT",
+	StatementDelete:                "DELETE",
+	StatementDropSeries:            "DROP SERIES",
+	StatementDropMeasurement:       "DROP MEASUREMENT",
+	StatementDrop:                  "DROP",
+	StatementShowMeasurements:      "SHOW MEASUREMENTS",
+	StatementShowTagKeys:           "SHOW TAG KEYS",
+	StatementShowTagValues:         "SHOW TAG VALUES",
+	StatementShowFieldKeys:         "SHOW FIELD KEYS",
+	StatementShowSeries:            "SHOW SERIES",
+	StatementShowCardinality:       "SHOW CARDINALITY",
+	StatementShowDatabases:         "SHOW DATABASES",
+	StatementShowRetentionPolicies: "SHOW RETENTION POLICIES",
+	StatementShow:                  "SHOW",
+	StatementCreate:                "CREATE",
+	StatementAlter:                 "ALTER",
+	StatementGrant:                 "GRANT",
+	StatementRevoke:                "REVOKE",
+	StatementKill:                  "KILL",
+}
+
+func (t StatementType) String() string {
+	return statementTypes[t]
+}
+
+// Statement is a single parsed InfluxQL statement. Only the parts the
+// relay needs for routing and merging are kept; statements other than
+// SELECT, SHOW, DELETE and DROP are classified but not parsed further.
+type Statement struct {
+	Type StatementType
+
+	// Text is the statement as it appeared in the query.
+	Text string
+
+	// Database set by an ON clause.
+	Database string
+
+	Explain bool
+	Analyze bool
+
+	Fields     []*Field
+	Into       *Measurement
+	Sources    []Source
+	Condition  Expr
+	Dimensions []*Dimension
+	Fill       string
+	Descending bool
+	Limit      int
+	Offset     int
+	SLimit     int
+	SOffset    int
+	Location   string
+}
+
+// Source is a *Measurement or a *SubQuery.
+type Source interface {
+	Node
+	source()
+}
+
+// Measurement is a source or INTO target. Regex is set for /regex/ sources,
+// an empty Name on a target stands for :MEASUREMENT.
+type Measurement struct {
+	Database        string
+	RetentionPolicy string
+	Name            string
+	Regex           string
+	IsTarget        bool
+}
+
+// SubQuery is a SELECT used as a source.
+type SubQuery struct {
+	Statement *Statement
+}
+
+func (*Measurement) source() {}
+func (*SubQuery) source()    {}
+
+type Node interface {
+	String() string
+}
+
+type Expr interface {
+	Node
+	expr()
+}
+
+type (
+	VarRef struct {
+		Val  string
+		Type string
+	}
+
+	Call struct {
+		Name string
+		Args []Expr
+	}
+
+	BinaryExpr struct {
+		Op  Token
+		LHS Expr
+		RHS Expr
+	}
+
+	ParenExpr struct {
+		Expr Expr
+	}
+
+	Wildcard struct {
+		Type string
+	}
+
+	StringLiteral struct {
+		Val string
+	}
+
+	NumberLiteral struct {
+		Val float64
+	}
+
+	IntegerLiteral struct {
+		Val int64
+	}
+
+	DurationLiteral struct {
+		Val time.Duration
+	}
+
+	BooleanLiteral struct {
+		Val bool
+	}
+
+	RegexLiteral struct {
+		Val string
+	}
+
+	BoundParameter struct {
+		Name string
+	}
+)
+
+func (*VarRef) expr()          {}
+func (*Call) expr()            {}
+func (*BinaryExpr) expr()      {}
+func (*ParenExpr) expr()       {}
+func (*Wildcard) expr()        {}
+func (*StringLiteral) expr()   {}
+func (*NumberLiteral) expr()   {}
+func (*IntegerLiteral) expr()  {}
+func (*DurationLiteral) expr() {}
+func (*BooleanLiteral) expr()  {}
+func (*RegexLiteral) expr()    {}
+func (*BoundParameter) expr()  {}
+
+// Field is a selected expression with an optional alias.
+type Field struct {
+	Expr  Expr
+	Alias string
+}
+
+// Name returns the column name InfluxDB uses for the field.
+func (f *Field) Name() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	switch e := f.Expr.(type) {
+	case *Call:
+		return e.Name
+	case *VarRef:
+		return e.Val
+	case *ParenExpr:
+		return (&Field{Expr: e.Expr}).Name()
+	}
+	return ""
+}
+
+// Dimension is a GROUP BY expression.
+type Dimension struct {
+	Expr Expr
+}
+
+func quoteIdent(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, r := range s {
+		if r == '"' || r == '\\' {
+			buf.WriteByte('\\')
+		}
+		if r == '\n' {
+			buf.WriteString(`\n`)
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+func quoteString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `'`, `\'`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return "'" + s + "'"
+}
+
+func (r *VarRef) String() string {
+	if r.Type != "" {
+		return quoteIdent(r.Val) + "::" + r.Type
+	}
+	return quoteIdent(r.Val)
+}
+
+func (c *Call) String() string {
+	args := make([]string, len(c.Args))
+	for i, a := range c.Args {
+		args[i] = a.String()
+	}
+	return c.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (e *BinaryExpr) String() string {
+	return e.LHS.String() + " " + e.Op.String() + " " + e.RHS.String()
+}
+
+func (e *ParenExpr) String() string { return "(" + e.Expr.String() + ")" }
+
+func (w *Wildcard) String() string {
+	if w.Type != "" {
+		return "*::" + w.Type
+	}
+	return "*"
+}
+
+func (l *StringLiteral) String() string { return quoteString(l.Val) }
+
+func (l *NumberLiteral) String() string {
+	return strconv.FormatFloat(l.Val, 'f', -1, 64)
+}
+
+func (l *IntegerLiteral) String() string { return strconv.FormatInt(l.Val, 10) }
+
+func (l *DurationLiteral) String() string { return formatDuration(l.Val) }
+
+func (l *BooleanLiteral) String() string {
+	if l.Val {
+		return "true"
+	}
+	return "false"
+}
+
+func (l *RegexLiteral) String() string {
+	return "/" + strings.Replace(l.Val, "/", `\/`, -1) + "/"
+}
+
+func (p *BoundParameter) String() string { return "$" + p.Name }
+
+func (f *Field) String() string {
+	if f.Alias != "" {
+		return f.Expr.String() + " AS " + quoteIdent(f.Alias)
+	}
+	return f.Expr.String()
+}
+
+func (d *Dimension) String() string { return d.Expr.String() }
+
+func (m *Measurement) String() string {
+	var buf bytes.Buffer
+	if m.Database != "" {
+		buf.WriteString(quoteIdent(m.Database))
+		buf.WriteByte('.')
+	}
+	if m.RetentionPolicy != "" || m.Database != "" {
+		if m.RetentionPolicy != "" {
+			buf.WriteString(quoteIdent(m.RetentionPolicy))
+		}
+		buf.WriteByte('.')
+	}
+
+	switch {
+	case m.Regex != "":
+		buf.WriteString((&RegexLiteral{Val: m.Regex}).String())
+	case m.Name == "" && m.IsTarget:
+		buf.WriteString(":MEASUREMENT")
+	default:
+		buf.WriteString(quoteIdent(m.Name))
+	}
+	return buf.String()
+}
+
+func (s *SubQuery) String() string { return "(" + s.Statement.String() + ")" }
+
+// String returns the statement as InfluxQL. SELECT statements are
+// rebuilt from the AST, other statements return their original text.
+func (st *Statement) String() string {
+	if st.Type != StatementSelect {
+		return st.Text
+	}
+
+	var buf bytes.Buffer
+	if st.Explain {
+		buf.WriteString("EXPLAIN ")
+		if st.Analyze {
+			buf.WriteString("ANALYZE ")
+		}
+	}
+	buf.WriteString("SELECT ")
+	for i, f := range st.Fields {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(f.String())
+	}
+
+	if st.Into != nil {
+		buf.WriteString(" INTO ")
+		buf.WriteString(st.Into.String())
+	}
+
+	buf.WriteString(" FROM ")
+	for i, s := range st.Sources {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(s.String())
+	}
+
+	if st.Condition != nil {
+		buf.WriteString(" WHERE ")
+		buf.WriteString(st.Condition.String())
+	}
+
+	if len(st.Dimensions) > 0 {
+		buf.WriteString(" GROUP BY ")
+		for i, d := range st.Dimensions {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(d.String())
+		}
+	}
+
+	if st.Fill != "" {
+		buf.WriteString(" fill(" + st.Fill + ")")
+	}
+	if st.Descending {
+		buf.WriteString(" ORDER BY time DESC")
+	}
+	if st.Limit > 0 {
+		buf.WriteString(" LIMIT " + strconv.Itoa(st.Limit))
+	}
+	if st.Offset > 0 {
+		buf.WriteString(" OFFSET " + strconv.Itoa(st.Offset))
+	}
+	if st.SLimit > 0 {
+		buf.WriteString(" SLIMIT " + strconv.Itoa(st.SLimit))
+	}
+	if st.SOffset > 0 {
+		buf.WriteString(" SOFFSET " + strconv.Itoa(st.SOffset))
+	}
+	if st.Location != "" {
+		buf.WriteString(" tz(" + quoteString(st.Location) + ")")
+	}
+
+	return buf.String()
+}
+
+// formatDuration writes a duration with the largest unit that divides it.
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "0s"
+	}
+
+	units := []struct {
+		d    time.Duration
+		unit string
+	}{
+		{7 * 24 * time.Hour, "w"},
+		{24 * time.Hour, "d"},
+		{time.Hour, "h"},
+		{time.Minute, "m"},
+		{time.Second, "s"},
+		{time.Millisecond, "ms"},
+		{time.Microsecond, "u"},
+	}
+	for _, u := range units {
+		if d%u.d == 0 {
+			return strconv.FormatInt(int64(d/u.d), 10) + u.unit
+		}
+	}
+	return strconv.FormatInt(int64(d), 10) + "ns"
+}
+
+// walk calls fn for every node of the expression tree.
+func walk(e Expr, fn func(Expr)) {
+	if e == nil {
+		return
+	}
+	fn(e)
+	switch e := e.(type) {
+	case *BinaryExpr:
+		walk(e.LHS, fn)
+		walk(e.RHS, fn)
+	case *ParenExpr:
+		walk(e.Expr, fn)
+	case *Call:
+		for _, a := range e.Args {
+			walk(a, fn)
+		}
+	}
+}
@@ -8,21 +8,42 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type HttpBackend struct {
+	cfg       HTTPOutputConfig
 	name      string
 	client    *http.Client
 	transport http.Transport
 	Location  string
-	Active    bool
 	bufferOn  bool
-	Ticker    *time.Ticker
 	rb        *retryBuffer
+	metrics   *backendMetrics
+	counters  backendCounters
+
+	// writes the backend rejected for good end up here
+	deadLetter *deadLetter
+
+	// set for udp:// locations, which only take writes
+	udp *udpWriter
+
+	health   *health
+	interval time.Duration
+
+	closed    int32
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func NewHttpBackend(cfg *HTTPOutputConfig) (*HttpBackend, error) {
+	return newHttpBackend(cfg, nil, nil)
+}
+
+func newHttpBackend(cfg *HTTPOutputConfig, m *backendMetrics, dl *deadLetter) (*HttpBackend, error) {
 	timeout := DefaultHTTPTimeout
 	if cfg.Timeout != "" {
 		t, err := time.ParseDuration(cfg.Timeout)
@@ -50,21 +71,46 @@ func NewHttpBackend(cfg *HTTPOutputConfig) (*HttpBackend, error) {
 		// client_query: &http.Client{
 		// 	Timeout: time.Millisecond * time.Duration(cfg.TimeoutQuery),
 		// },
-		name:     cfg.Name,
-		Location: cfg.Location,
-		Active:   true,
-		bufferOn: false,
-		Ticker:   time.NewTicker(interval),
+		cfg:        *cfg,
+		metrics:    m,
+		deadLetter: dl,
+		name:       cfg.Name,
+		Location:   cfg.Location,
+		bufferOn:   false,
+		health:     newHealth(cfg.FailThreshold, cfg.SuccessThreshold),
+		interval:   interval,
+		done:       make(chan struct{}),
+	}
+	hb.health.onChange(hb.stateChanged)
+
+	if strings.HasPrefix(cfg.Location, "udp://") {
+		size := DefaultUDPPayloadSize
+		if cfg.UDPPayloadSize > 0 {
+			size = cfg.UDPPayloadSize
+		}
+		w, err := newUDPWriter(strings.TrimPrefix(cfg.Location, "udp://"), size)
+		if err != nil {
+			return nil, fmt.Errorf("error opening udp backend '%v'", err)
+		}
+		hb.udp = w
+	}
+
+	// the udp socket is closed when a later step fails
+	fail := func(err error) (*HttpBackend, error) {
+		if hb.udp != nil {
+			hb.udp.close()
+		}
+		return nil, err
 	}
 
 	// If configured, create a retryBuffer per backend.
 	// This way we serialize retries against each backend.
-	if cfg.BufferSizeMB > 0 {
+	if cfg.BufferSizeMB > 0 || cfg.WALDir != "" {
 		max := DefaultMaxDelayInterval
 		if cfg.MaxDelayInterval != "" {
 			m, err := time.ParseDuration(cfg.MaxDelayInterval)
 			if err != nil {
-				return nil, err
+				return fail(err)
 			}
 			max = m
 		}
@@ -74,30 +120,49 @@ func NewHttpBackend(cfg *HTTPOutputConfig) (*HttpBackend, error) {
 			batch = cfg.MaxBatchKB * KB
 		}
 
+		wait := timeout
+		if cfg.BufferWait != "" {
+			w, err := time.ParseDuration(cfg.BufferWait)
+			if err != nil {
+				return fail(fmt.Errorf("error parsing buffer wait '%v'", err))
+			}
+			wait = w
+		}
+
+		var wal *diskQueue
+		if cfg.WALDir != "" {
+			segment := DefaultWALSegmentSizeMB
+			if cfg.WALSegmentSizeMB > 0 {
+				segment = cfg.WALSegmentSizeMB
+			}
+
+			size := DefaultWALMaxSizeMB
+			if cfg.WALMaxSizeMB > 0 {
+				size = cfg.WALMaxSizeMB
+			} else if cfg.BufferSizeMB > 0 {
+				size = cfg.BufferSizeMB
+			}
+
+			var err error
+			wal, err = openDiskQueue(cfg.WALDir, int64(segment)*MB, int64(size)*MB, cfg.WALFsync)
+			if err != nil {
+				return fail(fmt.Errorf("error opening wal '%v'", err))
+			}
+		}
+
 		hb.bufferOn = true
-		hb.rb = newRetryBuffer(cfg.BufferSizeMB*MB, batch, max, hb)
+		hb.rb = newRetryBuffer(cfg.BufferSizeMB*MB, batch, max, wait, wal, hb)
 	}
 	go hb.CheckActive()
 	return hb, nil
 }
 
-func (hb *HttpBackend) CheckActive() {
-	for range hb.Ticker.C {
-		_, err := hb.Ping()
-		if err != nil {
-			hb.Active = false
-			log.Printf("%s inactive.", hb.name)
-		} else {
-			hb.Active = true
-		}
+func (hb *HttpBackend) Ping() (version string, err error) {
+	// there is nothing to ping over UDP
+	if hb.udp != nil {
+		return
 	}
-}
 
-func (hb *HttpBackend) IsActive() bool {
-	return hb.Active
-}
-
-func (hb *HttpBackend) Ping() (version string, err error) {
 	resp, err := hb.client.Get(hb.Location + "/ping")
 	if err != nil {
 		log.Println("http ping error: ", err)
@@ -111,14 +176,11 @@ func (hb *HttpBackend) Ping() (version string, err error) {
 		return
 	}
 
-	log.Printf("write status code: %d, the backend is %s\n", resp.StatusCode, hb.Location)
-
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Println("readall body error: ", err)
-		return
-	}
-	log.Println("ping result: ", respBody)
+	// a backend answering with anything else, e.g. a 503 while it is
+	// starting, is not healthy
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	err = fmt.Errorf("ping status %d: %s", resp.StatusCode, bytes.TrimSpace(respBody))
+	log.Printf("http ping error on %s: %s\n", hb.Location, err)
 	return
 }
 
@@ -133,6 +195,10 @@ func copyHeader(dst, src http.Header) {
 // Don't setup Accept-Encoding: gzip. Let real client do so.
 // If real client don't support gzip and we setted, it will be a mistake.
 func (hb *HttpBackend) Query(req *http.Request) (resp *http.Response, err error) {
+	if hb.udp != nil {
+		return nil, ErrUDPQuery
+	}
+
 	if len(req.Form) == 0 {
 		req.Form = url.Values{}
 	}
@@ -145,10 +211,46 @@ func (hb *HttpBackend) Query(req *http.Request) (resp *http.Response, err error)
 		return
 	}
 
-	return hb.transport.RoundTrip(req)
+	start := time.Now()
+	resp, err = hb.transport.RoundTrip(req)
+	if err != nil {
+		hb.metrics.request("query", start, 0, err)
+	} else {
+		hb.metrics.request("query", start, resp.StatusCode, nil)
+	}
+	return
 }
 
+// Write sends buf to the backend over HTTP, or over UDP for udp://
+// locations.
 func (hb *HttpBackend) Write(buf []byte, query, auth string) (*responseData, error) {
+	start := time.Now()
+	var resp *responseData
+	var err error
+	if hb.udp != nil {
+		resp, err = hb.udp.write(buf, query)
+	} else {
+		resp, err = hb.post(buf, query, auth)
+	}
+	if err != nil {
+		hb.metrics.request("write", start, 0, err)
+		hb.counters.write(len(buf), err)
+		return nil, err
+	}
+	hb.metrics.request("write", start, resp.StatusCode, nil)
+
+	if resp.StatusCode/100 != 2 {
+		hb.counters.write(len(buf), fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(resp.Body)))
+	} else {
+		hb.counters.write(len(buf), nil)
+	}
+	if rejected(resp, nil) {
+		hb.reject(buf, query, resp)
+	}
+	return resp, nil
+}
+
+func (hb *HttpBackend) post(buf []byte, query, auth string) (*responseData, error) {
 	location := hb.Location + "/write"
 	req, err := http.NewRequest("POST", location, bytes.NewReader(buf))
 	if err != nil {
@@ -181,9 +283,48 @@ func (hb *HttpBackend) Write(buf []byte, query, auth string) (*responseData, err
 	}, nil
 }
 
+// queryable reports whether queries can be sent to the backend.
+func (hb *HttpBackend) queryable() bool {
+	return hb.udp == nil && hb.IsActive()
+}
+
+// bufferedBytes returns the size of the writes waiting in the retry buffer
+// or the wal.
+func (hb *HttpBackend) bufferedBytes() int64 {
+	if hb.rb == nil {
+		return 0
+	}
+	n := int64(hb.rb.buffered())
+	if hb.rb.wal != nil {
+		n += hb.rb.wal.bytes()
+	}
+	return n
+}
+
+// Drain waits up to timeout for the buffered writes of a backend that is
+// taken out of service to be delivered, then closes it.
+func (hb *HttpBackend) Drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for hb.rb != nil && hb.rb.pending() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if hb.rb != nil && hb.rb.pending() {
+		log.Printf("backend %s closed with writes still buffered\n", hb.name)
+	}
+	hb.Close()
+}
+
 func (hb *HttpBackend) Close() (err error) {
-	hb.transport.CloseIdleConnections()
-	hb.Ticker.Stop()
-	hb.Active = false
+	hb.closeOnce.Do(func() {
+		atomic.StoreInt32(&hb.closed, 1)
+		close(hb.done)
+		hb.transport.CloseIdleConnections()
+		if hb.rb != nil {
+			err = hb.rb.close()
+		}
+		if hb.udp != nil {
+			hb.udp.close()
+		}
+	})
 	return
 }
@@ -0,0 +1,246 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// shardBatch is a group of lines routed to the same shard that is sent to
+// every backend of the shard in a single request.
+type shardBatch struct {
+	query string
+	auth  string
+	buf   bytes.Buffer
+	lines int
+
+	// set once the batch has been written, errs holds one entry per backend
+	done     chan struct{}
+	backends []*HttpBackend
+	errs     []error
+}
+
+func newShardBatch(query, auth string) *shardBatch {
+	return &shardBatch{
+		query: query,
+		auth:  auth,
+		done:  make(chan struct{}),
+	}
+}
+
+// shardWriter batches lines for one shard of the ring. With a linger the
+// lines of concurrent writes are coalesced until the batch is full or the
+// linger expires, otherwise every incoming write is flushed at once. Every
+// batch is flushed in its own goroutine.
+type shardWriter struct {
+	ic    *InfluxCluster
+	shard string
+
+	maxBatch int
+	linger   time.Duration
+
+	// former writers send to the former ring, leaving out the backends
+	// in skip which already got the lines from the current ring
+	former bool
+	skip   map[string]bool
+
+	lock    sync.Mutex
+	pending map[string]*shardBatch
+}
+
+func newShardWriter(ic *InfluxCluster, shard string, maxBatch int, linger time.Duration) *shardWriter {
+	return &shardWriter{
+		ic:       ic,
+		shard:    shard,
+		maxBatch: maxBatch,
+		linger:   linger,
+		pending:  make(map[string]*shardBatch),
+	}
+}
+
+// write queues newline terminated lines and returns the batches they were
+// added to. Callers wait on batch.done for the result.
+func (sw *shardWriter) write(lines [][]byte, query, auth string) []*shardBatch {
+	if sw.linger <= 0 {
+		return sw.writeNow(lines, query, auth)
+	}
+
+	key := query + "\x00" + auth
+	var batches []*shardBatch
+
+	sw.lock.Lock()
+	for _, line := range lines {
+		b := sw.pending[key]
+		if b != nil && b.buf.Len()+len(line) > sw.maxBatch {
+			delete(sw.pending, key)
+			go sw.flushLinger(b)
+			b = nil
+		}
+
+		if b == nil {
+			b = newShardBatch(query, auth)
+			sw.pending[key] = b
+			atomic.AddInt64(&sw.ic.inflight, 1)
+			time.AfterFunc(sw.linger, func() { sw.expire(key, b) })
+		}
+
+		b.buf.Write(line)
+		b.lines++
+		if len(batches) == 0 || batches[len(batches)-1] != b {
+			batches = append(batches, b)
+		}
+	}
+	sw.lock.Unlock()
+
+	return batches
+}
+
+func (sw *shardWriter) writeNow(lines [][]byte, query, auth string) []*shardBatch {
+	var batches []*shardBatch
+	var b *shardBatch
+
+	for _, line := range lines {
+		if b != nil && b.buf.Len()+len(line) > sw.maxBatch {
+			batches = append(batches, b)
+			b = nil
+		}
+		if b == nil {
+			b = newShardBatch(query, auth)
+		}
+		b.buf.Write(line)
+		b.lines++
+	}
+	if b != nil {
+		batches = append(batches, b)
+	}
+
+	// batches are sent concurrently, a slow batch doesn't hold up the
+	// others
+	for _, b := range batches {
+		atomic.AddInt64(&sw.ic.inflight, 1)
+		go sw.flushLinger(b)
+	}
+	return batches
+}
+
+// expire flushes a lingering batch unless it was already flushed for size.
+func (sw *shardWriter) expire(key string, b *shardBatch) {
+	sw.lock.Lock()
+	if sw.pending[key] != b {
+		sw.lock.Unlock()
+		return
+	}
+	delete(sw.pending, key)
+	sw.lock.Unlock()
+
+	sw.flushLinger(b)
+}
+
+// flushPending flushes the lingering batches without waiting for them.
+func (sw *shardWriter) flushPending() {
+	sw.lock.Lock()
+	for key, b := range sw.pending {
+		delete(sw.pending, key)
+		go sw.flushLinger(b)
+	}
+	sw.lock.Unlock()
+}
+
+// flushLinger flushes a batch that was counted as in flight when it was
+// queued.
+func (sw *shardWriter) flushLinger(b *shardBatch) {
+	defer atomic.AddInt64(&sw.ic.inflight, -1)
+	sw.flush(b)
+}
+
+// flush sends the batch to every backend of the shard concurrently.
+func (sw *shardWriter) flush(b *shardBatch) {
+	defer close(b.done)
+
+	b.backends = sw.backends()
+	b.errs = make([]error, len(b.backends))
+
+	written, failed := &sw.ic.stats.PointsWritten, &sw.ic.stats.PointsWrittenFail
+	if sw.former {
+		written, failed = &sw.ic.stats.FormerPointsWritten, &sw.ic.stats.FormerPointsFail
+	}
+
+	var wg sync.WaitGroup
+	p := b.buf.Bytes()
+
+	for i, hb := range b.backends {
+		// buffered backends keep the writes until they are back up
+		if !hb.bufferOn && !hb.IsActive() {
+			b.errs[i] = ErrBackendInactive
+			continue
+		}
+		wg.Add(1)
+		go func(i int, hb *HttpBackend) {
+			defer wg.Done()
+			var resp *responseData
+			var err error
+			if hb.bufferOn {
+				resp, err = hb.rb.Write(p, b.query, b.auth)
+			} else {
+				resp, err = hb.Write(p, b.query, b.auth)
+			}
+			if err == nil && resp != nil && resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(resp.Body))
+			}
+			hb.metrics.points(b.lines, err == nil)
+			if err != nil {
+				log.Printf("cluster write to %s (shard %s) fail: %s\n", hb.name, sw.shard, err)
+				atomic.AddInt64(failed, int64(b.lines))
+				b.errs[i] = err
+			}
+		}(i, hb)
+	}
+	wg.Wait()
+
+	atomic.AddInt64(written, int64(b.lines))
+}
+
+func (sw *shardWriter) backends() []*HttpBackend {
+	if !sw.former {
+		return sw.ic.backends(sw.shard)
+	}
+
+	var list []*HttpBackend
+	for _, hb := range sw.ic.formerBackends(sw.shard) {
+		if !sw.skip[hb.Location] {
+			list = append(list, hb)
+		}
+	}
+	return list
+}
+
+// check reports the backends that failed the batch when fewer than the
+// consistency level requires accepted it.
+func (b *shardBatch) check(shard string, level models.ConsistencyLevel) []BackendError {
+	if level == models.ConsistencyLevelAny {
+		return nil
+	}
+	if len(b.backends) == 0 {
+		return []BackendError{{Shard: shard, Error: "no backends for shard"}}
+	}
+
+	acked := 0
+	var failed []BackendError
+	for i, err := range b.errs {
+		if err == nil {
+			acked++
+			continue
+		}
+		failed = append(failed, BackendError{Shard: shard, Backend: b.backends[i].name, Error: err.Error()})
+	}
+
+	if acked >= requiredAcks(level, len(b.backends)) {
+		return nil
+	}
+	return failed
+}
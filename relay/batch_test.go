@@ -0,0 +1,239 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestWriteBatchesPerShard(t *testing.T) {
+	var lock sync.Mutex
+	var requests int
+	var lines int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		requests++
+		lines += bytes.Count(p, []byte("\n"))
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas: 10,
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: ts.URL}},
+			"b": {{Name: "b1", Location: ts.URL}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	p := []byte("cpu value=1\ncpu value=2\nmem value=3\ndisk value=4\nnet value=5")
+	if err := ic.Write(p, "db=test", "", models.ConsistencyLevelAll); err != nil {
+		t.Fatal(err)
+	}
+
+	shards := make(map[string]bool)
+	for _, m := range []string{"cpu", "mem", "disk", "net"} {
+		shards[ic.ring.Get(m)] = true
+	}
+
+	if requests != len(shards) {
+		t.Errorf("expected one request per shard (%d), got %d", len(shards), requests)
+	}
+	if lines != 5 {
+		t.Errorf("expected 5 lines written, got %d", lines)
+	}
+}
+
+func TestWriteConsistency(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ok.Close()
+
+	fail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer fail.Close()
+
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas: 10,
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {
+				{Name: "ok1", Location: ok.URL},
+				{Name: "ok2", Location: ok.URL},
+				{Name: "fail", Location: fail.URL},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	p := []byte("cpu value=1\n")
+
+	if err := ic.Write(p, "db=test", "", models.ConsistencyLevelQuorum); err != nil {
+		t.Errorf("quorum should be met: %s", err)
+	}
+
+	err = ic.Write(p, "db=test", "", models.ConsistencyLevelAll)
+	we, ok2 := err.(*WriteError)
+	if !ok2 {
+		t.Fatalf("expected *WriteError, got %v", err)
+	}
+	if we.Partial || len(we.Failed) != 1 || we.Failed[0].Backend != "fail" {
+		t.Errorf("unexpected write error: %+v", we)
+	}
+}
+
+func TestWriteShardWithoutWriter(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ok.Close()
+
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas: 10,
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "ok", Location: ok.URL}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	// a reload dropped the shard after the lines were routed to it
+	rw := ic.routeLines([]byte("cpu value=1\n"))
+	ic.lock.Lock()
+	delete(ic.writers, "a")
+	ic.lock.Unlock()
+
+	err = ic.writeRouted(rw, "db=test", "", models.ConsistencyLevelAll)
+	we, ok2 := err.(*WriteError)
+	if !ok2 {
+		t.Fatalf("expected *WriteError, got %v", err)
+	}
+	if we.Partial || len(we.Failed) != 1 || we.Failed[0].Shard != "a" {
+		t.Errorf("unexpected write error: %+v", we)
+	}
+
+	if err := ic.writeRouted(rw, "db=test", "", models.ConsistencyLevelAny); err != nil {
+		t.Errorf("consistency any should not fail: %s", err)
+	}
+}
+
+func TestDualWrite(t *testing.T) {
+	var lock sync.Mutex
+	counts := make(map[string]int)
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			counts[name]++
+			lock.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	}
+
+	shared := newServer("shared")
+	defer shared.Close()
+	old := newServer("old")
+	defer old.Close()
+
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas:  10,
+		DualWrite: true,
+		Outputs: map[string][]HTTPOutputConfig{
+			"new": {{Name: "shared", Location: shared.URL}},
+		},
+		Former: map[string][]HTTPOutputConfig{
+			"old": {
+				{Name: "shared", Location: shared.URL},
+				{Name: "old", Location: old.URL},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	count := func(name string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return counts[name]
+	}
+
+	if err := ic.Write([]byte("cpu value=1\n"), "db=test", "", models.ConsistencyLevelAll); err != nil {
+		t.Fatal(err)
+	}
+
+	// the former ring is written in the background
+	for i := 0; i < 100 && count("old") == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count("shared") != 1 || count("old") != 1 {
+		t.Errorf("expected one write per backend, got %v", counts)
+	}
+
+	if err := ic.SetDualWrite(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ic.Write([]byte("cpu value=2\n"), "db=test", "", models.ConsistencyLevelAll); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if count("shared") != 2 || count("old") != 1 {
+		t.Errorf("former ring written after dual-write was switched off: %v", counts)
+	}
+}
+
+func TestWriteShardsConcurrently(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer slow.Close()
+
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas:     10,
+		ShardBatchKB: 1,
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: slow.URL, Interval: "1h"}},
+			"b": {{Name: "b1", Location: slow.URL, Interval: "1h"}},
+			"c": {{Name: "c1", Location: slow.URL, Interval: "1h"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	// several batches for every shard
+	var buf bytes.Buffer
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&buf, "m%d value=%d\n", i%30, i)
+	}
+
+	start := time.Now()
+	if err := ic.Write(buf.Bytes(), "db=test", "", models.ConsistencyLevelAll); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Errorf("batches were written one after another, took %s", d)
+	}
+}
@@ -2,24 +2,34 @@ package relay
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/influxdata/influxdb/models"
 	"github.com/sumaig/toolkits/consistent"
 )
 
 var (
-	ErrQueryForbidden = errors.New("query forbidden")
-	ForbidCmd         = "(?i:select\\s+\\*|^\\s*delete|^\\s*drop|^\\s*grant|^\\s*revoke|\\(\\)\\$)"
+	ErrQueryForbidden  = errors.New("query forbidden")
+	ErrBackendInactive = errors.New("backend inactive")
+
+	// ForbidCmd is the rule the relay used to apply to raw query text.
+	// CheckStatement refuses the same commands on parsed statements, it is
+	// kept for callers that add it with ForbidQuery.
+	ForbidCmd = "(?i:select\\s+\\*|^\\s*delete|^\\s*drop|^\\s*grant|^\\s*revoke|\\(\\)\\$)"
 )
 
 func ScanKey(point []byte) (key string, err error) {
@@ -52,6 +62,35 @@ type InfluxCluster struct {
 	formerRing     *consistent.Map
 	nodes          map[string][]*HttpBackend
 	formerNodes    map[string][]*HttpBackend
+	writers        map[string]*shardWriter
+	shardKey       *ShardKey
+	replicas       int
+
+	// reloadLock serializes Reload and the admin API. cfg is the
+	// configuration in use, swapped in under lock with the topology
+	reloadLock sync.Mutex
+	cfg        HTTPConfig
+	// edited is set when cfg has changes made through the admin API
+	edited bool
+
+	// dual-write to the former ring, formerWriters are keyed by former
+	// and current shard and skip the backends both have
+	dualWrite     int32
+	formerWriters map[string]*shardWriter
+	maxBatch      int
+	linger        time.Duration
+
+	// writes running in the background, see async
+	inflight int64
+
+	metrics    *metrics
+	deadLetter *deadLetter
+
+	// listeners feeding the cluster, see addListener
+	listeners []*listenerCounters
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 type Statistics struct {
@@ -64,61 +103,420 @@ type Statistics struct {
 	PingRequestsFail     int64
 	PointsWritten        int64
 	PointsWrittenFail    int64
+	FormerPointsWritten  int64
+	FormerPointsFail     int64
 	WriteRequestDuration int64
 	QueryRequestDuration int64
 }
 
-func NewInfluxCluster(cfg HTTPConfig) *InfluxCluster {
+func NewInfluxCluster(cfg HTTPConfig) (*InfluxCluster, error) {
 	ic := new(InfluxCluster)
-
 	ic.stats = &Statistics{}
-	ic.nodes = make(map[string][]*HttpBackend)
-	ic.ring = consistent.New(cfg.Replicas, nil)
 	ic.ticker = time.NewTicker(time.Duration(5) * time.Second)
+	ic.metrics = newMetrics(httpRelayName(cfg))
+	ic.deadLetter = new(deadLetter)
+	ic.done = make(chan struct{})
 
-	for k, v := range cfg.Outputs {
-		ic.ring.Add(k)
-		for _, b := range v {
-			backend, err := NewHttpBackend(&b)
-			if err != nil {
-				continue
-			}
-			if _, ok := ic.nodes[k]; !ok {
-				ic.nodes[k] = []*HttpBackend{backend}
-			} else {
-				ic.nodes[k] = append(ic.nodes[k], backend)
-			}
+	if err := ic.Reload(cfg); err != nil {
+		ic.ticker.Stop()
+		return nil, err
+	}
+
+	ic.Flush()
+	go ic.monitor()
+
+	return ic, nil
+}
+
+// Reload applies a configuration to the cluster. Shards are added to or
+// removed from the rings, backends whose configuration changed are
+// replaced and the new topology is swapped in under ic.lock. Backends that
+// are no longer used are drained in the background before being closed.
+func (ic *InfluxCluster) Reload(cfg HTTPConfig) error {
+	ic.reloadLock.Lock()
+	defer ic.reloadLock.Unlock()
+	return ic.reload(cfg)
+}
+
+// updateConfig applies the changes fn makes to a copy of the configuration
+// in use. fn returning an error leaves the cluster untouched. The changes
+// are not written back to the configuration file, the next reload from the
+// file replaces them.
+func (ic *InfluxCluster) updateConfig(fn func(cfg *HTTPConfig) error) error {
+	ic.reloadLock.Lock()
+	defer ic.reloadLock.Unlock()
+
+	cfg := ic.cfg
+	cfg.Outputs = copyOutputs(ic.cfg.Outputs)
+	cfg.Former = copyOutputs(ic.cfg.Former)
+	if err := fn(&cfg); err != nil {
+		return err
+	}
+
+	r, err := ic.prepare(cfg)
+	if err != nil {
+		return err
+	}
+	r.admin = true
+	return r.apply()
+}
+
+func copyOutputs(outputs map[string][]HTTPOutputConfig) map[string][]HTTPOutputConfig {
+	if outputs == nil {
+		return nil
+	}
+	c := make(map[string][]HTTPOutputConfig, len(outputs))
+	for k, v := range outputs {
+		c[k] = append([]HTTPOutputConfig(nil), v...)
+	}
+	return c
+}
+
+func (ic *InfluxCluster) reload(cfg HTTPConfig) error {
+	r, err := ic.prepare(cfg)
+	if err != nil {
+		return err
+	}
+	return r.apply()
+}
+
+// clusterReload is a configuration checked and with its backends built,
+// ready to be applied to the cluster.
+type clusterReload struct {
+	ic  *InfluxCluster
+	cfg HTTPConfig
+
+	// admin is set for changes made through the admin API
+	admin bool
+
+	maxBatch int
+	linger   time.Duration
+	shardKey *ShardKey
+	interval time.Duration
+
+	nodes, former       map[string][]*HttpBackend
+	oldNodes, oldFormer map[string][]*HttpBackend
+	takeovers           []*walTakeover
+}
+
+// prepare checks cfg and builds the backends it needs without changing
+// the cluster. It is called with ic.reloadLock held, which has to stay held
+// until the result is applied or aborted.
+func (ic *InfluxCluster) prepare(cfg HTTPConfig) (*clusterReload, error) {
+	r := &clusterReload{ic: ic, cfg: cfg}
+
+	r.maxBatch = DefaultBatchSizeKB * KB
+	if cfg.ShardBatchKB > 0 {
+		r.maxBatch = cfg.ShardBatchKB * KB
+	}
+
+	if cfg.ShardLinger != "" {
+		l, err := time.ParseDuration(cfg.ShardLinger)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing shard linger '%v'", err)
+		}
+		r.linger = l
+	}
+
+	shardKey, err := ParseShardKey(cfg.ShardKey)
+	if err != nil {
+		return nil, err
+	}
+	r.shardKey = shardKey
+
+	r.interval = DefaultMonitorInterval
+	if cfg.MonitorInterval != "" {
+		i, err := time.ParseDuration(cfg.MonitorInterval)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing monitor interval '%v'", err)
 		}
+		r.interval = i
+	}
+	if r.interval <= 0 {
+		return nil, errors.New("monitor interval must be positive")
+	}
+
+	ic.lock.RLock()
+	r.oldNodes, r.oldFormer = ic.nodes, ic.formerNodes
+	ic.lock.RUnlock()
+
+	// every backend is built before anything changes, a backend that
+	// can't be built fails the reload and leaves the cluster as it is
+	r.nodes, r.takeovers, err = reuseBackends(cfg.Outputs, "", r.oldNodes, ic.metrics, ic.deadLetter)
+	if err != nil {
+		return nil, err
 	}
 
 	// 加载扩容前的节点
 	if cfg.Former != nil {
-		ic.formerNodes = make(map[string][]*HttpBackend)
-		ic.formerRing = consistent.New(cfg.Replicas, nil)
-		for k, v := range cfg.Former {
-			ic.formerRing.Add(k)
-			for _, b := range v {
-				backend, err := NewHttpBackend(&b)
+		former, t, err := reuseBackends(cfg.Former, "former", r.oldFormer, ic.metrics, ic.deadLetter)
+		if err != nil {
+			closeNewBackends(r.nodes, r.oldNodes)
+			return nil, err
+		}
+		r.former = former
+		r.takeovers = append(r.takeovers, t...)
+	}
+	return r, nil
+}
+
+// abort closes the backends built for a reload that isn't applied.
+func (r *clusterReload) abort() {
+	closeNewBackends(r.nodes, r.oldNodes)
+	closeNewBackends(r.former, r.oldFormer)
+}
+
+// apply swaps the new topology in under ic.lock. It only fails when a WAL
+// can't be opened, the cluster is left as it was then.
+func (r *clusterReload) apply() error {
+	ic, cfg := r.ic, r.cfg
+
+	ic.lock.Lock()
+	if err := ic.takeOver(r.takeovers); err != nil {
+		ic.lock.Unlock()
+		r.abort()
+		return err
+	}
+
+	ic.ring = updateRing(ic.ring, ic.nodes, r.nodes, ic.replicas, cfg.Replicas)
+	if r.former != nil {
+		ic.formerRing = updateRing(ic.formerRing, ic.formerNodes, r.former, ic.replicas, cfg.Replicas)
+	} else {
+		ic.formerRing = nil
+	}
+
+	ic.writers = make(map[string]*shardWriter)
+	for k := range r.nodes {
+		ic.writers[k] = newShardWriter(ic, k, r.maxBatch, r.linger)
+	}
+	ic.formerWriters = make(map[string]*shardWriter)
+
+	if r.admin {
+		ic.edited = true
+	} else if ic.edited {
+		log.Printf("reload replaces the ring changes made through the admin API\n")
+		ic.edited = false
+	}
+	ic.cfg = cfg
+	ic.defaultTags = defaultTagsFor(cfg)
+	ic.nodes, ic.formerNodes = r.nodes, r.former
+	ic.replicas = cfg.Replicas
+	ic.shardKey = r.shardKey
+	ic.maxBatch = r.maxBatch
+	ic.linger = r.linger
+	if r.former != nil && cfg.DualWrite {
+		atomic.StoreInt32(&ic.dualWrite, 1)
+	} else {
+		atomic.StoreInt32(&ic.dualWrite, 0)
+	}
+	ic.lock.Unlock()
+
+	ic.ticker.Reset(r.interval)
+	ic.deadLetter.setPath(cfg.DeadLetterFile)
+	ic.retireBackends(r.oldNodes, r.nodes)
+	ic.retireBackends(r.oldFormer, r.former)
+	return nil
+}
+
+// walTakeover is a changed backend that takes over the WAL of the backend
+// it replaces. The WAL can only be opened once the old backend let go of
+// it, so it is built by takeOver while the new topology is swapped in.
+type walTakeover struct {
+	nodes   map[string][]*HttpBackend
+	shard   string
+	index   int
+	cfg     HTTPOutputConfig
+	metrics *backendMetrics
+	old     *HttpBackend
+}
+
+// reuseBackends builds the backends of every shard of outputs, keeping the
+// ones of old whose configuration didn't change. WAL directories get the
+// shard and backend name appended, under prefix for the former ring. The
+// backends taking over a WAL are left nil in nodes, see walTakeover.
+func reuseBackends(outputs map[string][]HTTPOutputConfig, prefix string, old map[string][]*HttpBackend, m *metrics, dl *deadLetter) (map[string][]*HttpBackend, []*walTakeover, error) {
+	nodes := make(map[string][]*HttpBackend)
+	var takeovers []*walTakeover
+
+	for k, v := range outputs {
+		if len(v) == 0 {
+			closeNewBackends(nodes, old)
+			return nil, nil, fmt.Errorf("shard %s has no backends", k)
+		}
+
+		nodes[k] = nil
+		for _, b := range v {
+			if b.WALDir != "" {
+				b.WALDir = filepath.Join(b.WALDir, prefix, k, b.Name)
+			}
+
+			var backend, replaced *HttpBackend
+			for _, o := range old[k] {
+				if o.cfg == b {
+					backend = o
+					break
+				}
+				if o.cfg.Name == b.Name && o.cfg.WALDir != "" && o.cfg.WALDir == b.WALDir {
+					replaced = o
+				}
+			}
+
+			switch {
+			case backend != nil:
+			case replaced != nil:
+				// check the configuration without the WAL, which
+				// is still held by the backend being replaced
+				c := b
+				c.WALDir = ""
+				hb, err := newHttpBackend(&c, nil, dl)
 				if err != nil {
-					continue
+					closeNewBackends(nodes, old)
+					return nil, nil, fmt.Errorf("create backend %s error: %s", b.Name, err)
 				}
-				if _, ok := ic.formerNodes[k]; !ok {
-					ic.formerNodes[k] = []*HttpBackend{backend}
-				} else {
-					ic.formerNodes[k] = append(ic.formerNodes[k], backend)
+				hb.Close()
+				takeovers = append(takeovers, &walTakeover{
+					nodes:   nodes,
+					shard:   k,
+					index:   len(nodes[k]),
+					cfg:     b,
+					metrics: m.backend(prefix, k, b.Name),
+					old:     replaced,
+				})
+			default:
+				var err error
+				backend, err = newHttpBackend(&b, m.backend(prefix, k, b.Name), dl)
+				if err != nil {
+					closeNewBackends(nodes, old)
+					return nil, nil, fmt.Errorf("create backend %s error: %s", b.Name, err)
 				}
 			}
+			nodes[k] = append(nodes[k], backend)
+		}
+	}
+	return nodes, takeovers, nil
+}
+
+// takeOver closes the backends being replaced and builds their successors
+// on the same WAL. It is called with ic.lock held, right before the new
+// topology is swapped in. When a successor can't be built, the WALs are
+// handed back to backends with the old configuration.
+func (ic *InfluxCluster) takeOver(takeovers []*walTakeover) error {
+	for i, t := range takeovers {
+		t.old.Close()
+		hb, err := newHttpBackend(&t.cfg, t.metrics, ic.deadLetter)
+		if err == nil {
+			t.nodes[t.shard][t.index] = hb
+			continue
+		}
+
+		for _, u := range takeovers[:i+1] {
+			if b := u.nodes[u.shard][u.index]; b != nil {
+				b.Close()
+				u.nodes[u.shard][u.index] = nil
+			}
+			ic.reopen(u.old)
 		}
+		return fmt.Errorf("create backend %s error: %s", t.cfg.Name, err)
 	}
+	return nil
+}
 
-	err := ic.ForbidQuery(ForbidCmd)
+// reopen replaces a closed backend of the rings in use by a new one with
+// the same configuration. It is called with ic.lock held.
+func (ic *InfluxCluster) reopen(old *HttpBackend) {
+	hb, err := newHttpBackend(&old.cfg, old.metrics, ic.deadLetter)
 	if err != nil {
-		panic(err)
+		log.Printf("reopen backend %s error: %s\n", old.name, err)
+		return
 	}
 
-	ic.Flush()
+	for _, nodes := range []map[string][]*HttpBackend{ic.nodes, ic.formerNodes} {
+		for k, list := range nodes {
+			for i, b := range list {
+				if b == old {
+					// readers may hold the old list
+					list = append([]*HttpBackend(nil), list...)
+					list[i] = hb
+					nodes[k] = list
+					return
+				}
+			}
+		}
+	}
+	hb.Close()
+}
 
-	return ic
+// closeNewBackends closes the backends of nodes that are not part of old,
+// the ones built for a reload that failed.
+func closeNewBackends(nodes, old map[string][]*HttpBackend) {
+	keep := make(map[*HttpBackend]bool)
+	for _, list := range old {
+		for _, b := range list {
+			keep[b] = true
+		}
+	}
+
+	for _, list := range nodes {
+		for _, b := range list {
+			if b != nil && !keep[b] {
+				b.Close()
+			}
+		}
+	}
+}
+
+// updateRing adds and removes the shards that changed. A new ring is made
+// when the number of replicas changed.
+func updateRing(ring *consistent.Map, old, nodes map[string][]*HttpBackend, oldReplicas, replicas int) *consistent.Map {
+	if ring == nil || oldReplicas != replicas {
+		ring = consistent.New(replicas, nil)
+		old = nil
+	}
+
+	for k := range old {
+		if _, ok := nodes[k]; !ok {
+			ring.Remove(k)
+		}
+	}
+	for k := range nodes {
+		if _, ok := old[k]; !ok {
+			ring.Add(k)
+		}
+	}
+	return ring
+}
+
+// retireBackends drains and closes the backends of old that are not
+// part of nodes.
+func (ic *InfluxCluster) retireBackends(old, nodes map[string][]*HttpBackend) {
+	keep := make(map[*HttpBackend]bool)
+	for _, list := range nodes {
+		for _, b := range list {
+			keep[b] = true
+		}
+	}
+
+	for _, list := range old {
+		for _, b := range list {
+			if !keep[b] {
+				b := b
+				ic.async(func() { b.Drain(DefaultDrainTimeout) })
+			}
+		}
+	}
+}
+
+// routing is a consistent view of what requests are routed by.
+type routing struct {
+	ring   *consistent.Map
+	former *consistent.Map
+	key    *ShardKey
+}
+
+func (ic *InfluxCluster) routing() routing {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	return routing{ic.ring, ic.formerRing, ic.shardKey}
 }
 
 func (ic *InfluxCluster) Flush() {
@@ -130,10 +528,181 @@ func (ic *InfluxCluster) Flush() {
 	ic.stats.PingRequestsFail = 0
 	ic.stats.PointsWritten = 0
 	ic.stats.PointsWrittenFail = 0
+	ic.stats.FormerPointsWritten = 0
+	ic.stats.FormerPointsFail = 0
 	ic.stats.WriteRequestDuration = 0
 	ic.stats.QueryRequestDuration = 0
 }
 
+type queryResult struct {
+	header http.Header
+	status int
+	body   []byte
+}
+
+// queryShard returns the response of the first active backend of the
+// shard that answers the query.
+func queryShard(backends []*HttpBackend, req *http.Request) *queryResult {
+	for _, n := range backends {
+		if !n.queryable() {
+			continue
+		}
+
+		resp, err := n.Query(req.WithContext(req.Context()))
+		if err != nil {
+			log.Printf("query %s error: %s\n", n.name, err)
+			continue
+		}
+		p, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("read body error: %s,the query is %s\n", err, req.FormValue("q"))
+			continue
+		}
+		return &queryResult{resp.Header, resp.StatusCode, p}
+	}
+	return nil
+}
+
+// queryShards sends the query to every listed shard of the current and
+// former rings in parallel. Like formerWriter, a former shard is only asked
+// through the backends the current shards don't have, and not at all when
+// they have every one of its backends.
+func (ic *InfluxCluster) queryShards(req *http.Request, shards, former []string) (cur, old []*queryResult) {
+	ic.lock.RLock()
+	var targets [][]*HttpBackend
+	skip := make(map[string]bool)
+	for _, s := range shards {
+		targets = append(targets, ic.nodes[s])
+		for _, b := range ic.nodes[s] {
+			skip[b.Location] = true
+		}
+	}
+	nCur := len(targets)
+	seen := make(map[string]bool)
+	for _, s := range former {
+		var list []*HttpBackend
+		key := ""
+		for _, b := range ic.formerNodes[s] {
+			if !skip[b.Location] {
+				list = append(list, b)
+				key += b.Location + "\x00"
+			}
+		}
+		if len(list) > 0 && !seen[key] {
+			seen[key] = true
+			targets = append(targets, list)
+		}
+	}
+	ic.lock.RUnlock()
+
+	if len(targets) > 1 {
+		// results are merged, so let the transport handle compression
+		r := req.WithContext(req.Context())
+		r.Header = make(http.Header)
+		copyHeader(r.Header, req.Header)
+		r.Header.Del("Accept-Encoding")
+		req = r
+	}
+
+	results := make([]*queryResult, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t []*HttpBackend) {
+			defer wg.Done()
+			results[i] = queryShard(t, req)
+		}(i, t)
+	}
+	wg.Wait()
+
+	for i, r := range results {
+		switch {
+		case r == nil:
+		case i < nCur:
+			cur = append(cur, r)
+		default:
+			old = append(old, r)
+		}
+	}
+	return cur, old
+}
+
+// shardNames returns every shard of the current or former ring.
+func (ic *InfluxCluster) shardNames(former bool) []string {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+
+	nodes := ic.nodes
+	if former {
+		nodes = ic.formerNodes
+	}
+
+	var names []string
+	for k := range nodes {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// routeQuery returns the shards of the current and former rings the
+// statements have to be sent to. scatter is set when the results of
+// several shards of the same ring have to be combined.
+func (ic *InfluxCluster) routeQuery(stmts []*Statement) (shards, former []string, scatter bool, err error) {
+	rt := ic.routing()
+	cur := make(map[string]bool)
+	old := make(map[string]bool)
+
+	for _, st := range stmts {
+		ms := st.Measurements()
+		// regex sources, statements without FROM and SHOW statements
+		// that aren't about measurements are sent to every shard
+		if st.AllMeasurements() || (st.IsShow() && len(ms) == 0) {
+			return ic.shardNames(false), ic.shardNames(true), true, nil
+		}
+		if len(ms) == 0 {
+			return nil, nil, false, ErrIllegalQL
+		}
+
+		for _, m := range ms {
+			k, ok := rt.key.QueryKey(st, m.Name)
+			if !ok {
+				// the shard tags aren't pinned
+				return ic.shardNames(false), ic.shardNames(true), true, nil
+			}
+			cur[rt.ring.Get(k)] = true
+			// 扩容后需要同时从查询之前节点
+			if rt.former != nil {
+				old[rt.former.Get(k)] = true
+			}
+		}
+	}
+
+	for k := range cur {
+		shards = append(shards, k)
+	}
+	for k := range old {
+		former = append(former, k)
+	}
+	sort.Strings(shards)
+	sort.Strings(former)
+
+	return shards, former, len(shards) > 1 || len(former) > 1, nil
+}
+
+// ForbidStatements are the statement types the relay refuses to forward.
+var ForbidStatements = []StatementType{
+	StatementDelete,
+	StatementDropSeries,
+	StatementDropMeasurement,
+	StatementDrop,
+	StatementGrant,
+	StatementRevoke,
+}
+
+// ForbidQuery adds a rule refusing the statements whose text matches the
+// regular expression s, on top of ForbidStatements.
 func (ic *InfluxCluster) ForbidQuery(s string) (err error) {
 	r, err := regexp.Compile(s)
 	if err != nil {
@@ -146,21 +715,39 @@ func (ic *InfluxCluster) ForbidQuery(s string) (err error) {
 	return
 }
 
+// CheckQuery matches q against the rules added by ForbidQuery.
 func (ic *InfluxCluster) CheckQuery(q string) (err error) {
 	ic.lock.RLock()
 	defer ic.lock.RUnlock()
 
-	if len(ic.ForbiddenQuery) != 0 {
-		for _, fq := range ic.ForbiddenQuery {
-			if fq.MatchString(q) {
-				return ErrQueryForbidden
-			}
+	for _, fq := range ic.ForbiddenQuery {
+		if fq.MatchString(q) {
+			return ErrQueryForbidden
 		}
 	}
 
 	return
 }
 
+// CheckStatement applies the forbid rules to a parsed statement, which
+// also catches statements hidden behind another one in the same query.
+// The statement types are checked first, keywords in strings and
+// identifiers don't matter for them; the rules added by ForbidQuery are
+// then matched against the text of the statement.
+func (ic *InfluxCluster) CheckStatement(st *Statement) error {
+	for _, t := range ForbidStatements {
+		if st.Type == t {
+			return ErrQueryForbidden
+		}
+	}
+
+	if st.Type == StatementSelect && st.HasWildcard() {
+		return ErrQueryForbidden
+	}
+
+	return ic.CheckQuery(st.Text)
+}
+
 func (ic *InfluxCluster) Query(w http.ResponseWriter, req *http.Request) {
 	defer func(start time.Time) {
 		atomic.AddInt64(&ic.stats.QueryRequestDuration, time.Since(start).Nanoseconds())
@@ -174,178 +761,537 @@ func (ic *InfluxCluster) Query(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err := ic.CheckQuery(q); err != nil {
+	stmts, err := ParseInfluxQL(q)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
 		return
 	}
 
-	key, err := GetMeasurementFromInfluxQL(q)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("can't get measurement"))
+	for _, st := range stmts {
+		if err := ic.CheckStatement(st); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+			return
+		}
+	}
+
+	var r *queryResult
+	if len(stmts) == 1 {
+		r = ic.execute(req, stmts)
+	} else {
+		r = ic.executeEach(req, stmts)
+	}
+
+	copyHeader(w.Header(), r.header)
+	w.WriteHeader(r.status)
+	w.Write(r.body)
+	if r.status/100 != 2 {
 		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
-		log.Printf("can't get measurement: %s\n", q)
 		return
 	}
+	atomic.AddInt64(&ic.stats.QueryRequests, 1)
+}
 
-	node := ic.ring.Get(key)
-
-	pn := getBuf()
-	po := getBuf()
+// execute sends statements to the shards they are routed to and combines
+// the answers into a single result.
+func (ic *InfluxCluster) execute(req *http.Request, stmts []*Statement) *queryResult {
+	shards, former, scatter, err := ic.routeQuery(stmts)
+	if err != nil {
+		log.Printf("can't get measurement: %s\n", req.FormValue("q"))
+		return &queryResult{status: http.StatusBadRequest, body: []byte("can't get measurement")}
+	}
 
-	for _, n := range ic.nodes[node] {
-		if !n.IsActive() {
-			continue
+	var a *aggregation
+	if len(stmts) == 1 && len(shards)+len(former) > 1 {
+		// aggregates of several shards are computed from partials
+		if a, err = newAggregation(stmts[0]); err != nil {
+			return errorResult(http.StatusBadRequest, err.Error())
 		}
+		if a != nil {
+			req = statementRequest(req, a.push)
+		}
+	}
 
-		resp, err := n.Query(req)
-		if err == nil {
-			copyHeader(w.Header(), resp.Header)
-			p, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				log.Printf("read body error: %s,the query is %s\n", err, q)
-				return
-			}
-			w.WriteHeader(resp.StatusCode)
-			pn.Write(p)
-			resp.Body.Close()
-			// log.Printf("query from [new] %s result: %s\n", n.name, pn.String())
-			break
+	if st := stmts[0]; a == nil && scatter && (st.Offset > 0 || st.SOffset > 0) {
+		// the offsets are applied by union
+		if st.Type != StatementSelect {
+			return errorResult(http.StatusBadRequest, "OFFSET and SOFFSET of SHOW statements cannot be applied across shards")
 		}
+		push := *st
+		shardLimits(&push)
+		push.Text = push.String()
+		req = statementRequest(req, &push)
 	}
 
-	// 扩容后需要同时从查询之前节点
-	if ic.formerRing != nil {
-		node := ic.formerRing.Get(key)
-		for _, n := range ic.formerNodes[node] {
-			if !n.IsActive() {
-				continue
-			}
+	cur, old := ic.queryShards(req, shards, former)
+	results := append(cur, old...)
+	if len(results) == 0 {
+		return errorResult(http.StatusServiceUnavailable, "no backend available")
+	}
+	if len(results) == 1 && a == nil && !scatter {
+		return results[0]
+	}
 
-			resp, err := n.Query(req)
-			if err == nil {
-				copyHeader(w.Header(), resp.Header)
-				p, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					log.Printf("read body error: %s,the query is %s\n", err, q)
-					return
-				}
-				w.WriteHeader(resp.StatusCode)
-				po.Write(p)
-				resp.Body.Close()
-				// log.Printf("query from [former] %s result: %s\n", n.name, po.String())
-				break
-			}
+	for _, r := range results {
+		if r.status != http.StatusOK {
+			return r
 		}
 	}
 
 	// 合并查询结果
-	pp, err := merge(pn.Bytes(), po.Bytes())
+	bodies := make([][]byte, len(results))
+	for i, r := range results {
+		bodies[i] = r.body
+	}
+
+	var pp []byte
+	switch {
+	case a != nil:
+		if pp, err = a.combine(bodies[:len(cur)], bodies[len(cur):]); err != nil {
+			return errorResult(http.StatusBadRequest, err.Error())
+		}
+	case scatter:
+		pp, err = union(stmts[0], bodies...)
+	default:
+		pp, err = merge(bodies...)
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintln("merge query failed: ", err)))
-		return
+		return &queryResult{status: http.StatusBadRequest, body: []byte(fmt.Sprintln("merge query failed: ", err))}
 	}
 
-	// log.Println("query result: ", string(pp))
+	return mergedResult(results[0].header, pp)
+}
 
-	putBuf(pn)
-	putBuf(po)
+// executeEach routes every statement of a multi-statement query on its
+// own, runs them concurrently and numbers the answers by their position
+// in the query.
+func (ic *InfluxCluster) executeEach(req *http.Request, stmts []*Statement) *queryResult {
+	results := make([]*queryResult, len(stmts))
 
-	if err == nil {
-		w.Write(pp)
-		atomic.AddInt64(&ic.stats.QueryRequests, 1)
-		return
+	var wg sync.WaitGroup
+	for i, st := range stmts {
+		wg.Add(1)
+		go func(i int, st *Statement) {
+			defer wg.Done()
+			results[i] = ic.execute(statementRequest(req, st), []*Statement{st})
+		}(i, st)
 	}
+	wg.Wait()
 
-	w.WriteHeader(http.StatusBadRequest)
-	w.Write([]byte("invalid query"))
-	log.Print("invalid query")
-	atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
-	return
+	r := new(Result)
+	for i, res := range results {
+		if res.status != http.StatusOK {
+			return res
+		}
+
+		ri := new(Result)
+		if err := decodeResult(res.body, ri); err != nil {
+			return &queryResult{status: http.StatusBadRequest, body: []byte(fmt.Sprintln("merge query failed: ", err))}
+		}
+		for _, d := range ri.Results {
+			d.StatementID = i
+			r.Results = append(r.Results, d)
+		}
+	}
+
+	pp, err := json.Marshal(r)
+	if err != nil {
+		return &queryResult{status: http.StatusBadRequest, body: []byte(fmt.Sprintln("merge query failed: ", err))}
+	}
+
+	return mergedResult(results[0].header, pp)
 }
 
-func (ic *InfluxCluster) Write(p []byte, query, auth string) {
+// statementRequest returns a copy of req that only carries statement st.
+func statementRequest(req *http.Request, st *Statement) *http.Request {
+	r := req.WithContext(req.Context())
+
+	r.Form = make(url.Values, len(req.Form))
+	for k, v := range req.Form {
+		r.Form[k] = v
+	}
+	r.Form.Set("q", st.Text)
+
+	// the answer is decoded, so let the transport handle compression
+	r.Header = make(http.Header)
+	copyHeader(r.Header, req.Header)
+	r.Header.Del("Accept-Encoding")
+
+	return r
+}
+
+func mergedResult(header http.Header, body []byte) *queryResult {
+	h := make(http.Header)
+	copyHeader(h, header)
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	return &queryResult{h, http.StatusOK, body}
+}
+
+func errorResult(code int, message string) *queryResult {
+	h := make(http.Header)
+	h.Set("Content-Type", "application/json")
+	return &queryResult{h, code, []byte(fmt.Sprintf("{\"error\":%q}\n", message))}
+}
+
+// BackendError records why a backend didn't accept a write.
+type BackendError struct {
+	Shard   string `json:"shard"`
+	Backend string `json:"backend"`
+	Error   string `json:"error"`
+}
+
+// WriteError is returned when a write didn't reach the required
+// consistency level on every shard it was routed to.
+type WriteError struct {
+	// Partial is set when some lines met the consistency level.
+	Partial bool
+	Failed  []BackendError
+}
+
+func (e *WriteError) Error() string {
+	if e.Partial {
+		return "partial write: consistency level not met"
+	}
+	return "write failed: consistency level not met"
+}
+
+// requiredAcks returns how many of n replicas must accept a write.
+func requiredAcks(level models.ConsistencyLevel, n int) int {
+	switch level {
+	case models.ConsistencyLevelOne:
+		return 1
+	case models.ConsistencyLevelQuorum:
+		return n/2 + 1
+	case models.ConsistencyLevelAll:
+		return n
+	}
+	return 0
+}
+
+// backends returns the backends of a shard in the current ring.
+func (ic *InfluxCluster) backends(shard string) []*HttpBackend {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	return ic.nodes[shard]
+}
+
+// formerBackends returns the backends of a shard in the former ring.
+func (ic *InfluxCluster) formerBackends(shard string) []*HttpBackend {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	return ic.formerNodes[shard]
+}
+
+// DualWriting reports whether writes are copied to the former ring.
+func (ic *InfluxCluster) DualWriting() bool {
+	return atomic.LoadInt32(&ic.dualWrite) == 1
+}
+
+// SetDualWrite switches copying writes to the former ring on or off, e.g.
+// once the migration to the current ring is confirmed.
+func (ic *InfluxCluster) SetDualWrite(on bool) error {
+	if ic.routing().former == nil {
+		return ErrNoFormer
+	}
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&ic.dualWrite, v)
+	return nil
+}
+
+// routedWrite holds newline terminated lines grouped by shard. With
+// dual-write the lines are also grouped by former and current shard.
+type routedWrite struct {
+	order  []string
+	shards map[string][][]byte
+
+	formerOrder []formerShard
+	former      map[formerShard][][]byte
+}
+
+type formerShard struct {
+	former, current string
+}
+
+func newRoutedWrite() *routedWrite {
+	return &routedWrite{
+		shards: make(map[string][][]byte),
+		former: make(map[formerShard][][]byte),
+	}
+}
+
+func (rw *routedWrite) add(shard string, line []byte) {
+	if _, ok := rw.shards[shard]; !ok {
+		rw.order = append(rw.order, shard)
+	}
+	rw.shards[shard] = append(rw.shards[shard], line)
+}
+
+func (rw *routedWrite) addFormer(fs formerShard, line []byte) {
+	if _, ok := rw.former[fs]; !ok {
+		rw.formerOrder = append(rw.formerOrder, fs)
+	}
+	rw.former[fs] = append(rw.former[fs], line)
+}
+
+// route adds a line under the shards its key maps to.
+func (rt routing) route(rw *routedWrite, key string, line []byte, dual bool) {
+	shard := rt.ring.Get(key)
+	rw.add(shard, line)
+	if dual && rt.former != nil {
+		rw.addFormer(formerShard{rt.former.Get(key), shard}, line)
+	}
+}
+
+// routeLines groups lines of line protocol by the shard their key maps to.
+func (ic *InfluxCluster) routeLines(p []byte) *routedWrite {
+	rw := newRoutedWrite()
+	rt := ic.routing()
+	dual := ic.DualWriting()
+
+	for len(p) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line, p = p[:i+1], p[i+1:]
+		} else {
+			line, p = p, nil
+		}
+
+		// empty line, ignore it.
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		key, err := rt.key.ScanKey(line)
+		if err != nil {
+			log.Printf("scan key error: %s\n", err)
+			atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
+			continue
+		}
+
+		if line[len(line)-1] != '\n' {
+			line = append(line[:len(line):len(line)], '\n')
+		}
+		rt.route(rw, key, line, dual)
+	}
+
+	return rw
+}
+
+// routePoints serializes parsed points and groups them by shard.
+func (ic *InfluxCluster) routePoints(points []models.Point, precision string) *routedWrite {
+	rw := newRoutedWrite()
+	rt := ic.routing()
+	dual := ic.DualWriting()
+
+	for _, p := range points {
+		line := []byte(p.PrecisionString(precision) + "\n")
+		rt.route(rw, rt.key.Key(p), line, dual)
+	}
+
+	return rw
+}
+
+// Write routes every line by its key and sends one batch per shard to the
+// backends of that shard. Wrong in one row will not stop others.
+func (ic *InfluxCluster) Write(p []byte, query, auth string, level models.ConsistencyLevel) error {
+	return ic.writeRouted(ic.routeLines(p), query, auth, level)
+}
+
+// WritePoints is like Write for points that were already parsed.
+func (ic *InfluxCluster) WritePoints(points []models.Point, precision, query, auth string, level models.ConsistencyLevel) error {
+	return ic.writeRouted(ic.routePoints(points, precision), query, auth, level)
+}
+
+func (ic *InfluxCluster) writeRouted(rw *routedWrite, query, auth string, level models.ConsistencyLevel) error {
 	atomic.AddInt64(&ic.stats.WriteRequests, 1)
 	defer func(start time.Time) {
 		atomic.AddInt64(&ic.stats.WriteRequestDuration, time.Since(start).Nanoseconds())
 	}(time.Now())
 
-	buf := bytes.NewBuffer(p)
+	// the former ring is kept up to date on a best-effort basis, the
+	// consistency level applies to the current ring only
+	for _, fs := range rw.formerOrder {
+		if sw := ic.formerWriter(fs); sw != nil {
+			lines := rw.former[fs]
+			ic.async(func() { sw.write(lines, query, auth) })
+		}
+	}
 
-	for {
-		line, err := buf.ReadBytes('\n')
-		switch err {
-		default:
-			log.Printf("error: %s\n", err)
-			atomic.AddInt64(&ic.stats.WriteRequestsFail, 1)
-			return
-		case io.EOF, nil:
-			err = nil
+	type pending struct {
+		shard   string
+		batches []*shardBatch
+	}
+	var writes []pending
+
+	var lines, failed int
+	var failures []BackendError
+	seen := make(map[BackendError]bool)
+
+	for _, c := range rw.order {
+		sw := ic.shardWriter(c)
+		if sw == nil {
+			// the shard went away in a reload after routing, nothing acked it
+			log.Printf("no backends for shard %s\n", c)
+			lines += len(rw.shards[c])
+			if level != models.ConsistencyLevelAny {
+				failed += len(rw.shards[c])
+				failures = append(failures, BackendError{Shard: c, Error: "no backends for shard"})
+			}
+			continue
 		}
+		writes = append(writes, pending{c, sw.write(rw.shards[c], query, auth)})
+	}
 
-		if len(line) == 0 {
-			break
+	for _, w := range writes {
+		for _, b := range w.batches {
+			<-b.done
+			lines += b.lines
+			errs := b.check(w.shard, level)
+			if errs == nil {
+				continue
+			}
+			failed += b.lines
+			for _, f := range errs {
+				if !seen[f] {
+					seen[f] = true
+					failures = append(failures, f)
+				}
+			}
 		}
+	}
 
-		ic.WriteRow(line, query, auth)
+	if failed == 0 {
+		return nil
+	}
+
+	atomic.AddInt64(&ic.stats.WriteRequestsFail, 1)
+	return &WriteError{
+		Partial: failed < lines,
+		Failed:  failures,
 	}
 }
 
-// Wrong in one row will not stop others.
-// So don't try to return error, just print it.
-func (ic *InfluxCluster) WriteRow(line []byte, query, auth string) {
-	var wg sync.WaitGroup
-	// maybe trim?
-	line = bytes.TrimRight(line, " \t\r\n")
+func (ic *InfluxCluster) shardWriter(shard string) *shardWriter {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	return ic.writers[shard]
+}
 
-	// empty line, ignore it.
-	if len(line) == 0 {
-		return
+// formerWriter returns the writer copying lines to a former shard, or nil
+// when every backend of the former shard is also one of the current shard.
+func (ic *InfluxCluster) formerWriter(fs formerShard) *shardWriter {
+	key := fs.former + "\x00" + fs.current
+
+	ic.lock.RLock()
+	sw, ok := ic.formerWriters[key]
+	ic.lock.RUnlock()
+	if ok {
+		return sw
 	}
 
-	key, err := ScanKey(line)
-	if err != nil {
-		log.Printf("scan key error: %s\n", err)
-		atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
-		return
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	if sw, ok := ic.formerWriters[key]; ok {
+		return sw
+	}
+
+	skip := make(map[string]bool)
+	for _, b := range ic.nodes[fs.current] {
+		skip[b.Location] = true
+	}
+	sw = nil
+	for _, b := range ic.formerNodes[fs.former] {
+		if !skip[b.Location] {
+			sw = newShardWriter(ic, fs.former, ic.maxBatch, ic.linger)
+			sw.former = true
+			sw.skip = skip
+			break
+		}
+	}
+	ic.formerWriters[key] = sw
+	return sw
+}
+
+// async runs fn in the background, Shutdown waits for it to return.
+func (ic *InfluxCluster) async(fn func()) {
+	atomic.AddInt64(&ic.inflight, 1)
+	go func() {
+		defer atomic.AddInt64(&ic.inflight, -1)
+		fn()
+	}()
+}
+
+// Shutdown flushes the lingering batches and waits until deadline for the
+// background writes and the retry buffers to be delivered before closing
+// the backends. The error lists the writes that had to be dropped.
+func (ic *InfluxCluster) Shutdown(deadline time.Time) error {
+	ic.lock.RLock()
+	var writers []*shardWriter
+	for _, sw := range ic.writers {
+		writers = append(writers, sw)
+	}
+	for _, sw := range ic.formerWriters {
+		if sw != nil {
+			writers = append(writers, sw)
+		}
+	}
+	var backends []*HttpBackend
+	for _, nodes := range []map[string][]*HttpBackend{ic.nodes, ic.formerNodes} {
+		for _, list := range nodes {
+			backends = append(backends, list...)
+		}
+	}
+	ic.lock.RUnlock()
+
+	for _, sw := range writers {
+		sw.flushPending()
 	}
 
-	c := ic.ring.Get(key)
+	for atomic.LoadInt64(&ic.inflight) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, hb := range backends {
+		for hb.rb != nil && hb.rb.pending() && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
 
-	for _, b := range ic.nodes[c] {
-		if !b.Active || b == nil {
+	var dropped []string
+	if n := atomic.LoadInt64(&ic.inflight); n > 0 {
+		dropped = append(dropped, fmt.Sprintf("%d background writes", n))
+	}
+	for _, hb := range backends {
+		if hb.rb == nil || !hb.rb.pending() {
 			continue
 		}
-		wg.Add(1)
-		go func(b *HttpBackend) {
-			defer wg.Done()
-			if b.bufferOn {
-				_, err := b.rb.Write(line, query, auth)
-				if err != nil {
-					log.Printf("cluster write fail: %s\n", key)
-					atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
-					return
-				}
-			} else {
-				_, err := b.Write(line, query, auth)
-				if err != nil {
-					log.Printf("cluster write fail: %s\n", key)
-					atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
-					return
-				}
-			}
+		if hb.rb.wal != nil {
+			log.Printf("backend %s: buffered writes are kept in the wal\n", hb.name)
+			continue
+		}
+		dropped = append(dropped, fmt.Sprintf("%d bytes buffered for %s", hb.rb.buffered(), hb.name))
+	}
+
+	ic.Close()
 
-			// log.Printf("%s write to %s done", string(line), b.name)
-		}(b)
+	if len(dropped) > 0 {
+		return fmt.Errorf("dropped %s", strings.Join(dropped, ", "))
 	}
-	wg.Wait()
-	atomic.AddInt64(&ic.stats.PointsWritten, 1)
+	return nil
 }
 
 func (ic *InfluxCluster) Close() {
+	ic.closeOnce.Do(func() {
+		ic.ticker.Stop()
+		close(ic.done)
+	})
+
 	ic.lock.Lock()
 	defer ic.lock.Unlock()
 
@@ -354,4 +1300,11 @@ func (ic *InfluxCluster) Close() {
 			b.Close()
 		}
 	}
+
+	for _, c := range ic.formerNodes {
+		for _, b := range c {
+			b.Close()
+		}
+	}
+	ic.deadLetter.close()
 }
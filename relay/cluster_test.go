@@ -0,0 +1,591 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestQueryMultiStatement(t *testing.T) {
+	// every backend answers with its name as the series name
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.FormValue("q")
+			if strings.Contains(q, ";") {
+				t.Errorf("%s got a multi-statement query: %s", name, q)
+			}
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":%q,"columns":["time","q","n"],"values":[[1514764800000000001,%q,9007199254740993]]}]}]}`, name, q)
+		}))
+	}
+
+	a := newBackend("a")
+	defer a.Close()
+	b := newBackend("b")
+	defer b.Close()
+
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas: 10,
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: a.URL}},
+			"b": {{Name: "b1", Location: b.URL}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	// find two measurements living on different shards
+	var ms []string
+	owners := make(map[string]bool)
+	for i := 0; len(ms) < 2 && i < 100; i++ {
+		m := fmt.Sprintf("m%d", i)
+		if s := ic.ring.Get(m); !owners[s] {
+			owners[s] = true
+			ms = append(ms, m)
+		}
+	}
+	if len(ms) != 2 {
+		t.Fatal("measurements not spread over both shards")
+	}
+
+	q := fmt.Sprintf("SELECT value FROM %s; SELECT value FROM %s", ms[0], ms[1])
+	req := httptest.NewRequest("GET", "/query?"+url.Values{"db": {"test"}, "q": {q}}.Encode(), nil)
+	req.ParseForm()
+	w := httptest.NewRecorder()
+	ic.Query(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+
+	// numbers are passed through exactly
+	if bytes.Count(w.Body.Bytes(), []byte("[1514764800000000001,")) != 2 || bytes.Count(w.Body.Bytes(), []byte(",9007199254740993]")) != 2 {
+		t.Errorf("numbers changed: %s", w.Body)
+	}
+
+	r := new(Result)
+	if err := json.Unmarshal(w.Body.Bytes(), r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Results) != 2 {
+		t.Fatalf("expected 2 results, got %s", w.Body.String())
+	}
+	for i, d := range r.Results {
+		if d.StatementID != i {
+			t.Errorf("result %d has statement_id %d", i, d.StatementID)
+		}
+		if len(d.Series) != 1 {
+			t.Fatalf("result %d: expected 1 series, got %d", i, len(d.Series))
+		}
+		if d.Series[0].Name != ic.ring.Get(ms[i]) {
+			t.Errorf("statement %d answered by %s, expected %s", i, d.Series[0].Name, ic.ring.Get(ms[i]))
+		}
+		if got := d.Series[0].Values[0][1]; got != "SELECT value FROM "+ms[i] {
+			t.Errorf("statement %d sent as %v", i, got)
+		}
+	}
+}
+
+func TestClusterReload(t *testing.T) {
+	cfg := HTTPConfig{
+		Replicas: 10,
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: "http://127.0.0.1:1"}},
+			"b": {{Name: "b1", Location: "http://127.0.0.1:2"}},
+		},
+	}
+	ic, err := NewInfluxCluster(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	a1 := ic.backends("a")[0]
+	b1 := ic.backends("b")[0]
+
+	cfg.Outputs = map[string][]HTTPOutputConfig{
+		"b": {{Name: "b1", Location: "http://127.0.0.1:2"}},
+		"c": {{Name: "c1", Location: "http://127.0.0.1:3"}},
+	}
+	if err := ic.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ic.backends("b"); len(got) != 1 || got[0] != b1 {
+		t.Error("unchanged backend was replaced")
+	}
+	if len(ic.backends("c")) != 1 || ic.shardWriter("c") == nil {
+		t.Error("new shard not added")
+	}
+	if ic.backends("a") != nil || ic.shardWriter("a") != nil {
+		t.Error("removed shard still present")
+	}
+
+	for i := 0; i < 100; i++ {
+		if s := ic.ring.Get(fmt.Sprintf("m%d", i)); s != "b" && s != "c" {
+			t.Fatalf("ring still routes to %q", s)
+		}
+	}
+
+	// the removed backend has nothing buffered and is closed right away
+	for i := 0; i < 100 && a1.IsActive(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if a1.IsActive() {
+		t.Error("removed backend not closed")
+	}
+}
+
+func TestClusterReloadFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := HTTPConfig{
+		Replicas: 10,
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: "http://127.0.0.1:1"}},
+			"b": {{Name: "b1", Location: "http://127.0.0.1:2", WALDir: dir}},
+		},
+	}
+	ic, err := NewInfluxCluster(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	a1 := ic.backends("a")[0]
+	b1 := ic.backends("b")[0]
+
+	bad := []map[string][]HTTPOutputConfig{
+		{
+			"a": {{Name: "a1", Location: "http://127.0.0.1:1"}},
+			"b": {{Name: "b1", Location: "http://127.0.0.1:2", WALDir: dir}},
+			"c": {{Name: "c1", Location: "http://127.0.0.1:3", Timeout: "bogus"}},
+		},
+		{
+			"a": {{Name: "a1", Location: "http://127.0.0.1:1"}},
+			"b": {{Name: "b1", Location: "http://127.0.0.1:2", WALDir: dir, Timeout: "bogus"}},
+		},
+		{
+			"a": {{Name: "a1", Location: "http://127.0.0.1:1"}},
+			"b": {},
+		},
+	}
+	for i, outputs := range bad {
+		c := cfg
+		c.Outputs = outputs
+		if err := ic.Reload(c); err == nil {
+			t.Errorf("config %d: expected an error", i)
+		}
+		if ic.backends("a")[0] != a1 || ic.backends("b")[0] != b1 || ic.backends("c") != nil {
+			t.Fatalf("config %d: cluster changed by a failed reload", i)
+		}
+		if !a1.IsActive() || !b1.IsActive() {
+			t.Fatalf("config %d: backend closed by a failed reload", i)
+		}
+	}
+
+	// the wal fsync setting is only checked when the wal is opened, the
+	// old configuration gets it back
+	c := cfg
+	c.Outputs = map[string][]HTTPOutputConfig{
+		"a": {{Name: "a1", Location: "http://127.0.0.1:1"}},
+		"b": {{Name: "b1", Location: "http://127.0.0.1:2", WALDir: dir, WALFsync: "bogus"}},
+	}
+	if err := ic.Reload(c); err == nil {
+		t.Error("expected an error for the wal fsync")
+	}
+	if got := ic.backends("b")[0]; !got.IsActive() || got.cfg != b1.cfg || got.rb.wal == nil {
+		t.Fatal("wal not handed back to the old configuration")
+	}
+	if ic.backends("a")[0] != a1 {
+		t.Fatal("cluster changed by a failed reload")
+	}
+
+	// a changed backend takes over the wal once the old one is closed
+	cfg.Outputs = map[string][]HTTPOutputConfig{
+		"a": {{Name: "a1", Location: "http://127.0.0.1:1"}},
+		"b": {{Name: "b1", Location: "http://127.0.0.1:2", WALDir: dir, Timeout: "5s"}},
+	}
+	if err := ic.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	b2 := ic.backends("b")[0]
+	if b2 == b1 || b2.rb == nil || b2.rb.wal == nil {
+		t.Fatal("changed backend not rebuilt on the wal")
+	}
+	if b1.IsActive() {
+		t.Error("replaced backend not closed")
+	}
+	if _, err := b2.rb.Write([]byte("cpu value=1\n"), "db=test", ""); err != ErrBufferedWAL {
+		t.Errorf("write to the new backend: %v", err)
+	}
+}
+
+func TestClusterShutdown(t *testing.T) {
+	var lines int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/write" {
+			p, _ := ioutil.ReadAll(r.Body)
+			atomic.AddInt64(&lines, int64(bytes.Count(p, []byte("\n"))))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas:    10,
+		ShardLinger: "1h",
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {
+				{Name: "a1", Location: ts.URL},
+				{Name: "a2", Location: "http://127.0.0.1:1", BufferSizeMB: 1},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lingering for an hour, the write is only flushed by the shutdown
+	ic.async(func() {
+		ic.Write([]byte("cpu value=1\n"), "db=test", "", models.ConsistencyLevelAny)
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	err = ic.Shutdown(time.Now().Add(500 * time.Millisecond))
+	if n := atomic.LoadInt64(&lines); n != 1 {
+		t.Errorf("got %d lines, want 1", n)
+	}
+	if err == nil || !strings.Contains(err.Error(), "buffered for a2") {
+		t.Errorf("dropped writes not reported: %v", err)
+	}
+}
+
+func TestQueryForbidden(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"results":[{"statement_id":0}]}`)
+	}))
+	defer ts.Close()
+
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas: 10,
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: ts.URL}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	tests := []struct {
+		q    string
+		code int
+	}{
+		// keywords in strings and identifiers are not statements
+		{"SELECT value FROM cpu WHERE msg = 'select *'", 200},
+		{"SELECT value FROM cpu WHERE msg = 'drop database telegraf'", 200},
+		{"SELECT \"delete\" FROM cpu", 200},
+		{"select * from cpu", 400},
+		{"SELECT max(v) FROM (SELECT * FROM cpu)", 400},
+		{"SELECT value FROM cpu; DROP MEASUREMENT cpu", 400},
+		{"DELETE FROM cpu", 400},
+		{"GRANT ALL TO \"jdoe\"", 400},
+		{"REVOKE READ ON \"mydb\" FROM \"jdoe\"", 400},
+		{"SHOW SERIES", 200},
+	}
+	query := func(q string) int {
+		req := httptest.NewRequest("GET", "/query?"+url.Values{"db": {"test"}, "q": {q}}.Encode(), nil)
+		req.ParseForm()
+		w := httptest.NewRecorder()
+		ic.Query(w, req)
+		return w.Code
+	}
+	for _, tt := range tests {
+		if code := query(tt.q); code != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.q, tt.code, code)
+		}
+	}
+
+	// rules added on top are matched against every statement
+	if err := ic.ForbidQuery("(?i)^show\\s+series"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ic.ForbidQuery("("); err == nil {
+		t.Error("invalid rule should fail")
+	}
+	for _, q := range []string{"SHOW SERIES", "SHOW MEASUREMENTS; show  series"} {
+		if code := query(q); code != 400 {
+			t.Errorf("%s: expected 400, got %d", q, code)
+		}
+	}
+	if code := query("SHOW MEASUREMENTS"); code != 200 {
+		t.Errorf("SHOW MEASUREMENTS: expected 200, got %d", code)
+	}
+}
+
+func TestQueryAggregateAcrossShards(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"results":[{"statement_id":0}]}`)
+	}))
+	defer ts.Close()
+
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas: 10,
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: ts.URL}},
+			"b": {{Name: "b1", Location: ts.URL}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	tests := []struct {
+		q    string
+		code int
+	}{
+		{"SELECT value FROM /cpu.*/", 200},
+		{"SELECT mean(value) FROM /cpu.*/ GROUP BY time(1m)", 200},
+		{"SELECT percentile(value, 95) FROM /cpu.*/", 400},
+		{"SELECT mean(value) * 2 FROM /cpu.*/", 400},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/query?"+url.Values{"db": {"test"}, "q": {tt.q}}.Encode(), nil)
+		req.ParseForm()
+		w := httptest.NewRecorder()
+		ic.Query(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d %s", tt.q, tt.code, w.Code, w.Body)
+		}
+	}
+}
+
+func TestQueryScatterLimits(t *testing.T) {
+	var lock sync.Mutex
+	var queries []string
+	newServer := func(rows string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			queries = append(queries, r.FormValue("q"))
+			lock.Unlock()
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":%s}]}]}`, rows)
+		}))
+	}
+	a := newServer(`[[3,3],[1,1]]`)
+	defer a.Close()
+	b := newServer(`[[4,4],[2,2]]`)
+	defer b.Close()
+
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas: 10,
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: a.URL}},
+			"b": {{Name: "b1", Location: b.URL}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	tests := []struct {
+		q        string
+		pushed   string
+		expected string
+	}{
+		{
+			"SELECT value FROM /cpu.*/ LIMIT 1",
+			"SELECT value FROM /cpu.*/ LIMIT 1",
+			`[[1,1]]`,
+		},
+		{
+			"SELECT value FROM /cpu.*/ ORDER BY time DESC LIMIT 2 OFFSET 1",
+			`SELECT "value" FROM /cpu.*/ ORDER BY time DESC LIMIT 3`,
+			`[[3,3],[2,2]]`,
+		},
+	}
+	for _, tt := range tests {
+		queries = nil
+		req := httptest.NewRequest("GET", "/query?"+url.Values{"db": {"test"}, "epoch": {"ns"}, "q": {tt.q}}.Encode(), nil)
+		req.ParseForm()
+		w := httptest.NewRecorder()
+		ic.Query(w, req)
+		if w.Code != 200 {
+			t.Fatalf("%s: expected 200, got %d %s", tt.q, w.Code, w.Body)
+		}
+
+		r := new(Result)
+		if err := decodeResult(w.Body.Bytes(), r); err != nil {
+			t.Fatal(err)
+		}
+		values, _ := json.Marshal(r.Results[0].Series[0].Values)
+		if string(values) != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.q, tt.expected, values)
+		}
+		for _, q := range queries {
+			if q != tt.pushed {
+				t.Errorf("%s: shard got %q, expected %q", tt.q, q, tt.pushed)
+			}
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/query?"+url.Values{"db": {"test"}, "q": {"SHOW MEASUREMENTS OFFSET 1"}}.Encode(), nil)
+	req.ParseForm()
+	w := httptest.NewRecorder()
+	ic.Query(w, req)
+	if w.Code != 400 {
+		t.Errorf("SHOW with OFFSET across shards: expected 400, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestRouteQueryScatter(t *testing.T) {
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas: 10,
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: "http://127.0.0.1:1"}},
+			"b": {{Name: "b1", Location: "http://127.0.0.1:2"}},
+			"c": {{Name: "c1", Location: "http://127.0.0.1:3"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	route := func(q string) ([]string, bool) {
+		stmts, err := ParseInfluxQL(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards, _, scatter, err := ic.routeQuery(stmts)
+		if err != nil {
+			t.Fatalf("%s: %s", q, err)
+		}
+		return shards, scatter
+	}
+
+	for _, q := range []string{
+		"SELECT mean(\"value\") INTO \"cpu_1h\".:MEASUREMENT FROM /cpu.*/",
+		"SHOW MEASUREMENTS",
+		"SHOW MEASUREMENTS WITH MEASUREMENT =~ /h2o.*/",
+		"SHOW TAG KEYS",
+		"SHOW TAG KEYS FROM /c.*/",
+	} {
+		if shards, scatter := route(q); !scatter || len(shards) != 3 {
+			t.Errorf("%s: expected every shard, got %v %v", q, shards, scatter)
+		}
+	}
+
+	for _, q := range []string{
+		"select value from cpu",
+		"select value from \"cpu,mem\"",
+		"SHOW TAG KEYS FROM cpu",
+	} {
+		if shards, scatter := route(q); scatter || len(shards) != 1 {
+			t.Errorf("%s: expected a single shard, got %v %v", q, shards, scatter)
+		}
+	}
+
+	// several measurements go to the shards of each of them
+	cpu, _ := route("select value from cpu")
+	disk, _ := route("select value from disk")
+	for _, q := range []string{
+		"select value from cpu, disk",
+		"select value from cpu,disk",
+		"select value from \"cpu\",\"disk\"",
+	} {
+		shards, scatter := route(q)
+		if scatter != (cpu[0] != disk[0]) || !reflect.DeepEqual(shards, uniqueSorted(cpu[0], disk[0])) {
+			t.Errorf("%s: got %v %v, cpu on %v, disk on %v", q, shards, scatter, cpu, disk)
+		}
+	}
+}
+
+func uniqueSorted(list ...string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestQueryAggregateSharedBackend(t *testing.T) {
+	var lock sync.Mutex
+	counts := make(map[string]int)
+	newServer := func(name string, count int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			counts[name]++
+			lock.Unlock()
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__count_0"],"values":[[0,%d]]}]}]}`, count)
+		}))
+	}
+	shared := newServer("shared", 5)
+	defer shared.Close()
+	old := newServer("old", 5)
+	defer old.Close()
+
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas: 10,
+		Outputs: map[string][]HTTPOutputConfig{
+			"new": {{Name: "shared", Location: shared.URL}},
+		},
+		Former: map[string][]HTTPOutputConfig{
+			"same": {{Name: "shared", Location: shared.URL}},
+			"old":  {{Name: "old", Location: old.URL}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	for _, q := range []string{"SELECT count(value) FROM cpu", "SELECT count(value) FROM /cpu.*/"} {
+		req := httptest.NewRequest("GET", "/query?"+url.Values{"db": {"test"}, "epoch": {"ns"}, "q": {q}}.Encode(), nil)
+		req.ParseForm()
+		w := httptest.NewRecorder()
+		ic.Query(w, req)
+		if w.Code != 200 {
+			t.Fatalf("%s: expected 200, got %d %s", q, w.Code, w.Body)
+		}
+
+		// the rings hold the same points, they are counted once
+		expected := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","count"],"values":[[0,5]]}]}]}`
+		if strings.TrimSpace(w.Body.String()) != expected {
+			t.Errorf("%s: expected %s, got %s", q, expected, w.Body)
+		}
+	}
+
+	// the shared backend is asked once per query
+	lock.Lock()
+	defer lock.Unlock()
+	if counts["shared"] != 2 {
+		t.Errorf("shared backend queried %d times for 2 queries", counts["shared"])
+	}
+}
@@ -8,6 +8,10 @@ import (
 
 type Config struct {
 	HTTPRelays []HTTPConfig `toml:"http"`
+	UDPRelays  []UDPConfig  `toml:"udp"`
+
+	GraphiteRelays []GraphiteConfig `toml:"graphite"`
+	OpenTSDBRelays []OpenTSDBConfig `toml:"opentsdb"`
 }
 
 type HTTPConfig struct {
@@ -26,6 +30,78 @@ type HTTPConfig struct {
 	// Default retention policy to set for forwarded requests
 	DefaultRetentionPolicy string `toml:"default-retention-policy"`
 
+	// Write consistency required before a write is acknowledged: any, one,
+	// quorum or all. Clients may override it with the consistency parameter.
+	// (Default any, writes are forwarded in the background)
+	WriteConsistency string `toml:"write-consistency"`
+
+	// What points are hashed on to pick a shard: "measurement", "series" or
+	// "measurement" followed by tag keys, e.g. "measurement,host".
+	// (Default "measurement")
+	ShardKey string `toml:"shard-key"`
+
+	// Maximum size of a batch sent to the backends of a shard in KB (Default 512)
+	ShardBatchKB int `toml:"shard-batch-kb"`
+
+	// How long to wait for more lines before sending a shard batch.
+	// The format used is the same seen in time.ParseDuration
+	// (Default 0, every incoming write is sent at once)
+	ShardLinger string `toml:"shard-linger"`
+
+	// Copy writes to the owners in the former ring as well, so the old
+	// topology stays complete during an expansion. Can be switched off at
+	// runtime with POST /admin/dual-write?enabled=false. (Default false)
+	DualWrite bool `toml:"dual-write"`
+
+	// File the progress of a migration from the former to the current ring
+	// is kept in, an interrupted migration resumes from it.
+	// (Default "migrate.json")
+	MigrateCheckpoint string `toml:"migrate-checkpoint"`
+
+	// Time range copied by a single migration query.
+	// The format used is the same seen in time.ParseDuration (Default 1h)
+	MigrateChunk string `toml:"migrate-chunk"`
+
+	// Databases to migrate (Default every database but _internal)
+	MigrateDatabases []string `toml:"migrate-databases"`
+
+	// Credentials used to read from and write to the backends while migrating
+	MigrateUsername string `toml:"migrate-username"`
+	MigratePassword string `toml:"migrate-password"`
+
+	// Database and retention policy, as "db/rp" or "db", the buckets of
+	// /api/v2/write are written to. (Default a bucket "db/rp" is
+	// database db and retention policy rp)
+	Buckets map[string]string `toml:"buckets"`
+
+	// Token required by the /admin endpoints, in an "Authorization: Bearer"
+	// or X-Admin-Token header. (Default "", admin endpoints disabled)
+	AdminToken string `toml:"admin-token"`
+
+	// How long a shutdown waits for running requests and buffered writes
+	// before dropping them. (Default 30s)
+	ShutdownTimeout string `toml:"shutdown-timeout"`
+
+	// Database the relay writes its own statistics to, through its own
+	// routing. (Default "", self-monitoring disabled)
+	MonitorDatabase string `toml:"monitor-database"`
+
+	// Retention policy of the monitor database (Default "", the default
+	// retention policy of the database)
+	MonitorRetentionPolicy string `toml:"monitor-retention-policy"`
+
+	// How often statistics are written to the monitor database (Default 10s)
+	MonitorInterval string `toml:"monitor-interval"`
+
+	// Tags added to the statistics, next to host and relay
+	MonitorTags map[string]string `toml:"monitor-tags"`
+
+	// File the writes the backends reject for good (parse errors, field
+	// type conflicts, tag limits, other 4xx) are appended to, one JSON
+	// record per write. They are never retried. (Default "", rejected
+	// lines are only counted)
+	DeadLetterFile string `toml:"dead-letter-file"`
+
 	// Outputs is a list of backed servers where read or writes will be forwarded
 	Outputs map[string][]HTTPOutputConfig `toml:"output"`
 
@@ -35,30 +111,149 @@ type HTTPConfig struct {
 
 type HTTPOutputConfig struct {
 	// Name of the backend server
-	Name string `toml:"name"`
+	Name string `toml:"name" json:"name,omitempty"`
+
+	// Location should be set to the URL of the backend server's write endpoint,
+	// or to udp://host:port for a UDP listener, which only takes writes
+	Location string `toml:"location" json:"location,omitempty"`
 
-	// Location should be set to the URL of the backend server's write endpoint
-	Location string `toml:"location"`
+	// Maximum size of a datagram sent to a udp:// location, larger
+	// batches are split. (Default 512)
+	UDPPayloadSize int `toml:"udp-payload-size" json:"udp-payload-size,omitempty"`
 
 	// Timeout sets a per-backend timeout for write requests. (Default 10s)
 	// The format used is the same seen in time.ParseDuration
-	Timeout string `toml:"timeout"`
+	Timeout string `toml:"timeout" json:"timeout,omitempty"`
+
+	// Interval between health checks, spread by up to 20%. (Default 10s)
+	Interval string `toml:"interval" json:"interval,omitempty"`
+
+	// Failed health checks in a row before the backend is taken out of
+	// use. (Default 3)
+	FailThreshold int `toml:"fail-threshold" json:"fail-threshold,omitempty"`
 
-	Interval string `toml:"interval"`
+	// Successful health checks in a row before a backend that was down is
+	// used again. (Default 2)
+	SuccessThreshold int `toml:"success-threshold" json:"success-threshold,omitempty"`
 
 	// Buffer failed writes up to maximum count. (Default 0, retry/buffering disabled)
-	BufferSizeMB int `toml:"buffer-size-mb"`
+	BufferSizeMB int `toml:"buffer-size-mb" json:"buffer-size-mb,omitempty"`
+
+	// How long a write waits for its buffered copy to be delivered before
+	// it is reported as failed, the copy stays buffered. (Default timeout)
+	BufferWait string `toml:"buffer-wait" json:"buffer-wait,omitempty"`
 
 	// Maximum batch size in KB (Default 512)
-	MaxBatchKB int `toml:"max-batch-kb"`
+	MaxBatchKB int `toml:"max-batch-kb" json:"max-batch-kb,omitempty"`
 
 	// Maximum delay between retry attempts.
 	// The format used is the same seen in time.ParseDuration (Default 10s)
-	MaxDelayInterval string `toml:"max-delay-interval"`
+	MaxDelayInterval string `toml:"max-delay-interval" json:"max-delay-interval,omitempty"`
+
+	// Directory of the on-disk write-ahead queue for failed writes.
+	// Each output gets its own subdirectory. (Default "", disk queue disabled)
+	WALDir string `toml:"wal-dir" json:"wal-dir,omitempty"`
+
+	// Maximum size of a single queue segment in MB (Default 64)
+	WALSegmentSizeMB int `toml:"wal-segment-size-mb" json:"wal-segment-size-mb,omitempty"`
+
+	// Maximum size of the whole queue in MB (Default buffer-size-mb, or 1024)
+	WALMaxSizeMB int `toml:"wal-max-size-mb" json:"wal-max-size-mb,omitempty"`
+
+	// When to fsync queued writes: "always", "never" or a sync interval
+	// such as "1s". (Default "always")
+	WALFsync string `toml:"wal-fsync" json:"wal-fsync,omitempty"`
 
 	// Skip TLS verification in order to use self signed certificate.
 	// WARNING: It's insecure. Use it only for developing and don't use in production.
-	SkipTLSVerification bool `toml:"skip-tls-verification"`
+	SkipTLSVerification bool `toml:"skip-tls-verification" json:"skip-tls-verification,omitempty"`
+}
+
+type UDPConfig struct {
+	// Name identifies the UDP relay
+	Name string `toml:"name"`
+
+	// Addr is where the UDP relay will listen for packets
+	Addr string `toml:"bind-addr"`
+
+	// Name of the HTTP relay whose cluster routes the points
+	// (Default the only [[http]] relay)
+	Relay string `toml:"relay"`
+
+	// Database the points are written to
+	Database string `toml:"database"`
+
+	// Retention policy the points are written to (Default "", the
+	// default retention policy of the database)
+	RetentionPolicy string `toml:"retention-policy"`
+
+	// Precision of the timestamps: n, u, ms, s, m or h (Default n)
+	Precision string `toml:"precision"`
+
+	// Size of the socket receive buffer in bytes (Default 0, system default)
+	ReadBuffer int `toml:"read-buffer"`
+}
+
+type GraphiteConfig struct {
+	// Name identifies the Graphite relay
+	Name string `toml:"name"`
+
+	// Addr is where the Graphite relay will listen
+	Addr string `toml:"bind-addr"`
+
+	// Protocol the Graphite relay listens on: tcp or udp (Default tcp)
+	Protocol string `toml:"protocol"`
+
+	// Name of the HTTP relay whose cluster routes the points
+	// (Default the only [[http]] relay)
+	Relay string `toml:"relay"`
+
+	// Database the points are written to
+	Database string `toml:"database"`
+
+	// Retention policy the points are written to (Default "", the
+	// default retention policy of the database)
+	RetentionPolicy string `toml:"retention-policy"`
+
+	// Separator of the nodes joined into measurements, fields and tags
+	// (Default ".")
+	Separator string `toml:"separator"`
+
+	// Templates turning metric names into points, as "[filter] template
+	// [tag=value,...]", e.g. "servers.* .host.measurement*". The parts of
+	// a template are measurement, field, a tag name or empty to skip a
+	// node, measurement* and field* take the remaining nodes.
+	// (Default "measurement*")
+	Templates []string `toml:"templates"`
+
+	// Tags added to every point, as "tag=value"
+	Tags []string `toml:"tags"`
+
+	// Points written at once (Default 1000)
+	BatchSize int `toml:"batch-size"`
+}
+
+type OpenTSDBConfig struct {
+	// Name identifies the OpenTSDB relay
+	Name string `toml:"name"`
+
+	// Addr is where the OpenTSDB relay will listen for telnet and HTTP
+	// connections
+	Addr string `toml:"bind-addr"`
+
+	// Name of the HTTP relay whose cluster routes the points
+	// (Default the only [[http]] relay)
+	Relay string `toml:"relay"`
+
+	// Database the points are written to
+	Database string `toml:"database"`
+
+	// Retention policy the points are written to (Default "", the
+	// default retention policy of the database)
+	RetentionPolicy string `toml:"retention-policy"`
+
+	// Points written at once (Default 1000)
+	BatchSize int `toml:"batch-size"`
 }
 
 // LoadConfigFile parses the specified file into a Config object
@@ -0,0 +1,210 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors InfluxDB returns for points it will never accept, retrying the
+// write doesn't help no matter the status code.
+var permanentErrors = []string{
+	"partial write",
+	"field type conflict",
+	"max-values-per-tag",
+	"unable to parse",
+	"points beyond retention policy",
+}
+
+var (
+	parseErrorRE  = regexp.MustCompile(`unable to parse '(.*?)': `)
+	measurementRE = regexp.MustCompile(`measurement[= ]"((?:[^"\\]|\\.)*)"`)
+)
+
+// errorMessage returns the error of an InfluxDB response body, which is
+// {"error": "..."} for most failures.
+func errorMessage(body []byte) string {
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &e) == nil && e.Error != "" {
+		return e.Error
+	}
+	return string(bytes.TrimSpace(body))
+}
+
+func permanentMessage(msg string) bool {
+	for _, s := range permanentErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable reports whether a failed write may succeed later: connection
+// errors, timeouts and 5xx responses, unless the body blames the points.
+func retryable(resp *responseData, err error) bool {
+	if err != nil {
+		return true
+	}
+	if resp.StatusCode/100 == 2 || permanentMessage(errorMessage(resp.Body)) {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return resp.StatusCode/100 == 5
+}
+
+// rejected reports whether the backend refused a write for good.
+func rejected(resp *responseData, err error) bool {
+	return err == nil && resp.StatusCode/100 != 2 && !retryable(resp, err)
+}
+
+// rejectedLines picks the lines of buf an error message points at: the
+// lines that failed to parse and the lines of the measurements named in
+// type conflicts and tag limits. The whole of buf is returned when none
+// can be told apart.
+func rejectedLines(buf []byte, msg string) ([]byte, int) {
+	bad := make(map[string]bool)
+	for _, m := range parseErrorRE.FindAllStringSubmatch(msg, -1) {
+		bad[m[1]] = true
+	}
+	measurements := make(map[string]bool)
+	for _, m := range measurementRE.FindAllStringSubmatch(msg, -1) {
+		measurements[strings.Replace(m[1], `\"`, `"`, -1)] = true
+	}
+
+	var out bytes.Buffer
+	var all, n int
+	for _, line := range bytes.Split(buf, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		all++
+
+		match := bad[string(line)]
+		if !match && len(measurements) > 0 {
+			key, err := ScanKey(line)
+			match = err == nil && measurements[key]
+		}
+		if match {
+			out.Write(line)
+			out.WriteByte('\n')
+			n++
+		}
+	}
+
+	if n == 0 {
+		return buf, all
+	}
+	return out.Bytes(), n
+}
+
+// deadLetter appends the writes the backends rejected for good to a file,
+// one JSON record per line, so they can be looked at and replayed.
+type deadLetter struct {
+	lock sync.Mutex
+	path string
+	f    *os.File
+}
+
+type deadLetterRecord struct {
+	Time    time.Time `json:"time"`
+	Backend string    `json:"backend"`
+	Query   string    `json:"query"`
+	Status  int       `json:"status"`
+	Error   string    `json:"error"`
+	Lines   string    `json:"lines"`
+}
+
+// setPath switches the file records are appended to, an empty path
+// disables the sink.
+func (d *deadLetter) setPath(path string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if path == d.path {
+		return
+	}
+	if d.f != nil {
+		d.f.Close()
+		d.f = nil
+	}
+	d.path = path
+}
+
+func (d *deadLetter) write(rec *deadLetterRecord) error {
+	if d == nil {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.path == "" {
+		return nil
+	}
+
+	if d.f == nil {
+		f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		d.f = f
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = d.f.Write(append(b, '\n'))
+	return err
+}
+
+func (d *deadLetter) close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.f == nil {
+		return nil
+	}
+	err := d.f.Close()
+	d.f = nil
+	return err
+}
+
+// reject counts the lines of a write the backend refused for good and
+// hands them to the dead-letter sink. Credentials are kept out of the
+// recorded query.
+func (hb *HttpBackend) reject(buf []byte, query string, resp *responseData) {
+	msg := errorMessage(resp.Body)
+	lines, n := rejectedLines(buf, msg)
+	atomic.AddInt64(&hb.counters.rejected, int64(n))
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		values = url.Values{}
+	}
+	values.Del("u")
+	values.Del("p")
+
+	err = hb.deadLetter.write(&deadLetterRecord{
+		Time:    time.Now(),
+		Backend: hb.name,
+		Query:   values.Encode(),
+		Status:  resp.StatusCode,
+		Error:   msg,
+		Lines:   string(lines),
+	})
+	if err != nil {
+		log.Printf("dead letter of %s: %s, %d lines lost\n", hb.name, err, n)
+	}
+}
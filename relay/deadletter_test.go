@@ -0,0 +1,129 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		code int
+		body string
+		err  error
+		want bool
+	}{
+		{0, "", errors.New("connection refused"), true},
+		{204, "", nil, false},
+		{500, `{"error":"timeout"}`, nil, true},
+		{503, "", nil, true},
+		{429, "", nil, true},
+		{400, `{"error":"unable to parse 'cpu value=': missing fields"}`, nil, false},
+		{404, `{"error":"database not found: \"db\""}`, nil, false},
+		{500, `{"error":"partial write: max-values-per-tag limit exceeded (10/10): measurement=\"cpu\" tag=\"host\" value=\"c\" dropped=1"}`, nil, false},
+	}
+	for _, tt := range tests {
+		var resp *responseData
+		if tt.err == nil {
+			resp = &responseData{StatusCode: tt.code, Body: []byte(tt.body)}
+		}
+		if got := retryable(resp, tt.err); got != tt.want {
+			t.Errorf("%d %s: expected retryable %v, got %v", tt.code, tt.body, tt.want, got)
+		}
+	}
+
+	lines, n := rejectedLines([]byte("cpu,host=a value=1\nmem value=2\ncpu value=\n"),
+		`partial write: unable to parse 'cpu value=': missing field value`)
+	if n != 1 || string(lines) != "cpu value=\n" {
+		t.Errorf("unexpected rejected lines %d %q", n, lines)
+	}
+	lines, n = rejectedLines([]byte("cpu value=1i\nmem value=2\ncpu,host=a value=3i\n"),
+		`partial write: field type conflict: input field "value" on measurement "cpu" is type integer, already exists as type float dropped=2`)
+	if n != 2 || string(lines) != "cpu value=1i\ncpu,host=a value=3i\n" {
+		t.Errorf("unexpected rejected lines %d %q", n, lines)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	var status, calls int32
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		w.Write([]byte(`{"error":"partial write: field type conflict: input field \"value\" on measurement \"cpu\" is type integer, already exists as type float dropped=1"}`))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dl := new(deadLetter)
+	dl.setPath(filepath.Join(dir, "dead.json"))
+	defer dl.close()
+
+	hb, err := newHttpBackend(&HTTPOutputConfig{
+		Name:             "b",
+		Location:         ts.URL,
+		Interval:         "1h",
+		BufferSizeMB:     1,
+		BufferWait:       "50ms",
+		MaxDelayInterval: "20ms",
+	}, nil, dl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hb.Close()
+
+	// a permanent error is returned as is, not buffered
+	resp, err := hb.rb.Write([]byte("cpu value=1i\nmem value=2\n"), "db=test&u=user&p=secret", "")
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the 400 back, got %v %v", resp, err)
+	}
+	if hb.rb.pending() || atomic.LoadInt32(&calls) != 1 {
+		t.Fatal("rejected write was buffered")
+	}
+
+	// the same error with a 5xx isn't retried either
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	if _, err := hb.rb.Write([]byte("cpu value=2i\n"), "db=test", ""); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if hb.rb.pending() || atomic.LoadInt32(&calls) != 2 {
+		t.Fatal("rejected write was retried")
+	}
+
+	if s := hb.statistics(); s.Rejected != 2 || s.Dropped != 0 {
+		t.Errorf("rejections not counted: %+v", s)
+	}
+
+	p, err := ioutil.ReadFile(filepath.Join(dir, "dead.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(p))
+	var recs []deadLetterRecord
+	for dec.More() {
+		var rec deadLetterRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("expected 2 dead letters, got %d", len(recs))
+	}
+	if recs[0].Backend != "b" || recs[0].Status != 400 || recs[0].Lines != "cpu value=1i\n" || recs[0].Query != "db=test" {
+		t.Errorf("unexpected dead letter %+v", recs[0])
+	}
+}
@@ -0,0 +1,273 @@
+package relay
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	DefaultGraphiteSeparator = "."
+	DefaultGraphiteTemplate  = "measurement*"
+	graphiteField            = "value"
+)
+
+// Graphite is a relay for the Graphite plaintext protocol, "name value
+// timestamp" lines. Names are turned into a measurement, tags and a field
+// by templates, the same way the Graphite service of InfluxDB does.
+type Graphite struct {
+	*listener
+	cfg GraphiteConfig
+}
+
+// NewGraphite binds a Graphite relay that writes to the cluster ic.
+func NewGraphite(cfg GraphiteConfig, ic *InfluxCluster) (Relay, error) {
+	sep := cfg.Separator
+	if sep == "" {
+		sep = DefaultGraphiteSeparator
+	}
+	p, err := newGraphiteParser(sep, cfg.Templates, cfg.Tags)
+	if err != nil {
+		return nil, fmt.Errorf("graphite relay %s: %v", graphiteRelayName(cfg), err)
+	}
+
+	l, err := newListener("graphite", cfg.Name, cfg.Protocol, cfg.Addr, cfg.Database, cfg.RetentionPolicy, cfg.BatchSize, ic)
+	if err != nil {
+		return nil, err
+	}
+	l.parse = p.parse
+	return &Graphite{listener: l, cfg: cfg}, nil
+}
+
+// graphiteRelayName returns the name a Graphite relay with cfg gets.
+func graphiteRelayName(cfg GraphiteConfig) string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return "graphite://" + cfg.Addr
+}
+
+// graphiteTemplate maps the nodes of the names its filter matches.
+type graphiteTemplate struct {
+	filter []string
+	parts  []string
+	tags   map[string]string
+}
+
+// matches reports whether the first nodes of a name match the filter, a
+// "*" node matches any node.
+func (t *graphiteTemplate) matches(nodes []string) bool {
+	if len(t.filter) > len(nodes) {
+		return false
+	}
+	for i, f := range t.filter {
+		if f != "*" && f != nodes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// specificity ranks the templates matching the same name, the filter
+// with the most literal nodes wins.
+func (t *graphiteTemplate) specificity() int {
+	n := 0
+	for _, f := range t.filter {
+		if f != "*" {
+			n++
+		}
+	}
+	return n*100 + len(t.filter)
+}
+
+type graphiteParser struct {
+	separator string
+	templates []*graphiteTemplate
+	def       *graphiteTemplate
+	tags      map[string]string
+}
+
+// newGraphiteParser parses templates of the form "[filter] template
+// [tag=value,...]" and the default tags of every point.
+func newGraphiteParser(separator string, templates, tags []string) (*graphiteParser, error) {
+	p := &graphiteParser{separator: separator, tags: make(map[string]string)}
+
+	for _, t := range tags {
+		if err := parseGraphiteTags(t, p.tags); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range templates {
+		fields := strings.Fields(s)
+		t := &graphiteTemplate{tags: make(map[string]string)}
+
+		switch len(fields) {
+		case 1:
+			t.parts = strings.Split(fields[0], ".")
+		case 2:
+			if strings.Contains(fields[1], "=") {
+				t.parts = strings.Split(fields[0], ".")
+				if err := parseGraphiteTags(fields[1], t.tags); err != nil {
+					return nil, err
+				}
+			} else {
+				t.filter = strings.Split(fields[0], ".")
+				t.parts = strings.Split(fields[1], ".")
+			}
+		case 3:
+			t.filter = strings.Split(fields[0], ".")
+			t.parts = strings.Split(fields[1], ".")
+			if err := parseGraphiteTags(fields[2], t.tags); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("invalid template %q", s)
+		}
+
+		hasMeasurement := false
+		for _, part := range t.parts {
+			if strings.HasPrefix(part, "measurement") {
+				hasMeasurement = true
+			}
+		}
+		if !hasMeasurement {
+			return nil, fmt.Errorf("template %q has no measurement", s)
+		}
+
+		if t.filter == nil {
+			if p.def != nil {
+				return nil, fmt.Errorf("more than one template without filter")
+			}
+			p.def = t
+			continue
+		}
+		p.templates = append(p.templates, t)
+	}
+
+	if p.def == nil {
+		p.def = &graphiteTemplate{parts: []string{DefaultGraphiteTemplate}}
+	}
+	return p, nil
+}
+
+func parseGraphiteTags(s string, tags map[string]string) error {
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 || i == len(kv)-1 {
+			return fmt.Errorf("invalid tag %q", kv)
+		}
+		tags[kv[:i]] = kv[i+1:]
+	}
+	return nil
+}
+
+// template returns the most specific template matching nodes.
+func (p *graphiteParser) template(nodes []string) *graphiteTemplate {
+	var best *graphiteTemplate
+	for _, t := range p.templates {
+		if t.matches(nodes) && (best == nil || t.specificity() > best.specificity()) {
+			best = t
+		}
+	}
+	if best == nil {
+		return p.def
+	}
+	return best
+}
+
+// apply maps the nodes of a name to a measurement, tags and a field.
+func (p *graphiteParser) apply(t *graphiteTemplate, nodes []string, tags map[string]string) (measurement, field string) {
+	var ms, fs []string
+	tagParts := make(map[string][]string)
+
+	for i, part := range t.parts {
+		if i >= len(nodes) {
+			break
+		}
+		switch part {
+		case "":
+		case "measurement":
+			ms = append(ms, nodes[i])
+		case "measurement*":
+			ms = append(ms, nodes[i:]...)
+		case "field":
+			fs = append(fs, nodes[i])
+		case "field*":
+			fs = append(fs, nodes[i:]...)
+		default:
+			tagParts[part] = append(tagParts[part], nodes[i])
+		}
+		if strings.HasSuffix(part, "*") {
+			break
+		}
+	}
+
+	for k, v := range t.tags {
+		tags[k] = v
+	}
+	for k, v := range tagParts {
+		tags[k] = strings.Join(v, p.separator)
+	}
+
+	measurement = strings.Join(ms, p.separator)
+	if measurement == "" {
+		measurement = strings.Join(nodes, p.separator)
+	}
+	field = strings.Join(fs, p.separator)
+	if field == "" {
+		field = graphiteField
+	}
+	return
+}
+
+// parse turns a plaintext line into a point. Tags of the tagged format,
+// "name;tag=value value timestamp", override those of the templates.
+func (p *graphiteParser) parse(line string) (models.Point, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, fmt.Errorf("received %q which doesn't have required fields", line)
+	}
+
+	name := fields[0]
+	var nameTags []string
+	if i := strings.IndexByte(name, ';'); i >= 0 {
+		nameTags = strings.Split(name[i+1:], ";")
+		name = name[:i]
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("field %q value: %s", fields[0], err)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("field %q value: %v is unsupported", fields[0], value)
+	}
+
+	t := time.Now().UTC()
+	if len(fields) == 3 && fields[2] != "-1" && fields[2] != "N" {
+		ts, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("field %q time: %s", fields[0], err)
+		}
+		t = time.Unix(0, int64(ts*float64(time.Second))).UTC()
+	}
+
+	tags := make(map[string]string, len(p.tags))
+	for k, v := range p.tags {
+		tags[k] = v
+	}
+	nodes := strings.Split(name, ".")
+	measurement, field := p.apply(p.template(nodes), nodes, tags)
+	for _, kv := range nameTags {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			tags[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	return models.NewPoint(measurement, models.NewTags(tags), models.Fields{field: value}, t)
+}
@@ -0,0 +1,143 @@
+package relay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGraphiteTemplates(t *testing.T) {
+	p, err := newGraphiteParser(".", []string{
+		"servers.* .host.measurement.field*",
+		"servers.web.* .host.measurement* role=web",
+		"measurement.measurement.field region=us",
+	}, []string{"dc=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"servers.db1.cpu.load.avg 0.5 1500000000", "cpu,dc=1,host=db1 load.avg=0.5 1500000000000000000"},
+		{"servers.web.a.b 1 1500000000.5", "a.b,dc=1,host=web,role=web value=1 1500000000500000000"},
+		{"sys.mem.free 2 1500000000", "sys.mem,dc=1,region=us free=2 1500000000000000000"},
+		{"sys.mem.free;dc=2;app=x 2 1500000000", "sys.mem,app=x,dc=2,region=us free=2 1500000000000000000"},
+	}
+	for _, tt := range tests {
+		pt, err := p.parse(tt.line)
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if got := pt.String(); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+
+	for _, line := range []string{"cpu", "cpu x 1500000000", "cpu 1 now", "cpu NaN 1500000000"} {
+		if _, err := p.parse(line); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+
+	p, err = newGraphiteParser("_", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := p.parse("a.b.c 1 -1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pt.Name()) != "a_b_c" || time.Since(pt.Time()) > time.Minute {
+		t.Errorf("unexpected point %v", pt)
+	}
+
+	for _, templates := range [][]string{{"a b c d"}, {"host.field"}, {"measurement*", ".measurement"}, {"measurement* tag"}} {
+		if _, err := newGraphiteParser(".", templates, nil); err == nil {
+			t.Errorf("%q: expected an error", templates)
+		}
+	}
+}
+
+func TestGraphite(t *testing.T) {
+	var lock sync.Mutex
+	var queries []string
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		body = append(body, p...)
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas: 10,
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: ts.URL, Interval: "1h"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	if _, err := NewGraphite(GraphiteConfig{Addr: "127.0.0.1:0", Database: "test", Protocol: "sctp"}, ic); err == nil {
+		t.Error("expected an error for an invalid protocol")
+	}
+
+	r, err := NewGraphite(GraphiteConfig{
+		Addr:            "127.0.0.1:0",
+		Database:        "test",
+		RetentionPolicy: "week",
+		Templates:       []string{".host.measurement"},
+	}, ic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := r.(*Graphite)
+	go g.Run()
+
+	conn, err := net.Dial("tcp", g.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("servers.a.cpu 1 1500000000\nservers.a.cpu x 1500000000\nservers.b.mem 2 1500000000\n"))
+	conn.Close()
+
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		n := len(body)
+		lock.Unlock()
+		if n == len("cpu,host=a value=1 1500000000000000000\nmem,host=b value=2 1500000000000000000\n") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := g.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(queries) == 0 || queries[0] != "db=test&rp=week" {
+		t.Fatalf("unexpected writes %v", queries)
+	}
+	if !bytes.Contains(body, []byte("cpu,host=a value=1 1500000000000000000\n")) || !bytes.Contains(body, []byte("mem,host=b value=2 1500000000000000000\n")) {
+		t.Errorf("unexpected points %q", body)
+	}
+
+	s := ic.listenerStatistics()
+	if len(s) != 1 || s[0].Listener != g.Name() || s[0].Protocol != "graphite" || s[0].Received != 3 || s[0].Points != 2 || s[0].ParseFail != 1 {
+		t.Errorf("unexpected listener stats %+v", s)
+	}
+}
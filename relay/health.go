@@ -0,0 +1,182 @@
+package relay
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultFailThreshold    = 3
+	DefaultSuccessThreshold = 2
+
+	// pings are spread by up to this fraction of the interval, so the
+	// backends of a relay aren't all pinged at once
+	healthJitter = 0.2
+)
+
+// HealthState is where a backend is in its health checks. Healthy and
+// suspect backends are used, down and recovering ones are not.
+type HealthState int32
+
+const (
+	// StateHealthy answers its pings.
+	StateHealthy HealthState = iota
+	// StateSuspect failed fewer pings in a row than the fail threshold.
+	StateSuspect
+	// StateDown failed the fail threshold of pings in a row.
+	StateDown
+	// StateRecovering is down but answered fewer pings in a row than the
+	// success threshold.
+	StateRecovering
+)
+
+var healthStates = map[HealthState]string{
+	StateHealthy:    "healthy",
+	StateSuspect:    "suspect",
+	StateDown:       "down",
+	StateRecovering: "recovering",
+}
+
+func (s HealthState) String() string {
+	return healthStates[s]
+}
+
+// Usable reports whether writes and queries are sent to a backend in s.
+func (s HealthState) Usable() bool {
+	return s == StateHealthy || s == StateSuspect
+}
+
+// health is the state machine of a backend's health checks. The state is
+// read atomically by writes and queries; pings and hooks only run on the
+// goroutine of the health check.
+type health struct {
+	state int32
+
+	failThreshold    int
+	successThreshold int
+	fails            int
+	successes        int
+
+	lock  sync.Mutex
+	hooks []func(from, to HealthState)
+}
+
+func newHealth(failThreshold, successThreshold int) *health {
+	if failThreshold <= 0 {
+		failThreshold = DefaultFailThreshold
+	}
+	if successThreshold <= 0 {
+		successThreshold = DefaultSuccessThreshold
+	}
+	return &health{failThreshold: failThreshold, successThreshold: successThreshold}
+}
+
+func (h *health) get() HealthState {
+	return HealthState(atomic.LoadInt32(&h.state))
+}
+
+// onChange registers fn to be called on every state change.
+func (h *health) onChange(fn func(from, to HealthState)) {
+	h.lock.Lock()
+	h.hooks = append(h.hooks, fn)
+	h.lock.Unlock()
+}
+
+// observe moves the state machine by the result of a ping.
+func (h *health) observe(ok bool) {
+	from := h.get()
+	to := from
+
+	if ok {
+		h.fails = 0
+		switch from {
+		case StateSuspect:
+			to = StateHealthy
+		case StateDown, StateRecovering:
+			h.successes++
+			to = StateRecovering
+			if h.successes >= h.successThreshold {
+				to = StateHealthy
+			}
+		}
+	} else {
+		h.successes = 0
+		switch from {
+		case StateHealthy, StateSuspect:
+			h.fails++
+			to = StateSuspect
+			if h.fails >= h.failThreshold {
+				to = StateDown
+			}
+		case StateRecovering:
+			to = StateDown
+		}
+	}
+
+	if to == from {
+		return
+	}
+	if to == StateHealthy || to == StateDown {
+		h.fails, h.successes = 0, 0
+	}
+	atomic.StoreInt32(&h.state, int32(to))
+
+	h.lock.Lock()
+	hooks := h.hooks
+	h.lock.Unlock()
+	for _, fn := range hooks {
+		fn(from, to)
+	}
+}
+
+// jitter returns interval spread randomly by healthJitter.
+func jitter(interval time.Duration) time.Duration {
+	d := time.Duration((rand.Float64()*2 - 1) * healthJitter * float64(interval))
+	return interval + d
+}
+
+// CheckActive pings the backend every interval until it is closed.
+func (hb *HttpBackend) CheckActive() {
+	for {
+		select {
+		case <-hb.done:
+			return
+		case <-time.After(jitter(hb.interval)):
+		}
+
+		_, err := hb.Ping()
+		if err == nil {
+			hb.counters.pinged()
+		}
+		hb.health.observe(err == nil)
+	}
+}
+
+// stateChanged logs and counts the transitions of the backend.
+func (hb *HttpBackend) stateChanged(from, to HealthState) {
+	log.Printf("backend %s is %s (was %s)\n", hb.name, to, from)
+	switch {
+	case to == StateDown:
+		atomic.AddInt64(&hb.counters.down, 1)
+	case to == StateHealthy && from == StateRecovering:
+		atomic.AddInt64(&hb.counters.up, 1)
+	}
+
+	// retry right away instead of at the end of the backoff
+	if to == StateHealthy && hb.rb != nil {
+		hb.rb.wakeUp()
+	}
+}
+
+// State returns the health state of the backend.
+func (hb *HttpBackend) State() HealthState {
+	return hb.health.get()
+}
+
+// IsActive reports whether writes and queries are sent to the backend.
+func (hb *HttpBackend) IsActive() bool {
+	return atomic.LoadInt32(&hb.closed) == 0 && hb.health.get().Usable()
+}
@@ -0,0 +1,91 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	h := newHealth(3, 2)
+	var changes []HealthState
+	h.onChange(func(from, to HealthState) { changes = append(changes, to) })
+
+	steps := []struct {
+		ok   bool
+		want HealthState
+	}{
+		{false, StateSuspect},
+		{true, StateHealthy},
+		{false, StateSuspect},
+		{false, StateSuspect},
+		{false, StateDown},
+		{false, StateDown},
+		{true, StateRecovering},
+		{false, StateDown},
+		{true, StateRecovering},
+		{true, StateHealthy},
+		{true, StateHealthy},
+	}
+	for i, s := range steps {
+		h.observe(s.ok)
+		if got := h.get(); got != s.want {
+			t.Fatalf("step %d: got %s, want %s", i, got, s.want)
+		}
+	}
+
+	want := []HealthState{StateSuspect, StateHealthy, StateSuspect, StateDown,
+		StateRecovering, StateDown, StateRecovering, StateHealthy}
+	if len(changes) != len(want) {
+		t.Fatalf("got %d state changes, want %d", len(changes), len(want))
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("change %d: got %s, want %s", i, changes[i], want[i])
+		}
+	}
+
+	if !StateSuspect.Usable() || StateRecovering.Usable() {
+		t.Error("suspect backends are used, recovering ones are not")
+	}
+}
+
+func TestHealthPingStatus(t *testing.T) {
+	var code int32 = http.StatusServiceUnavailable
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&code)))
+	}))
+	defer ts.Close()
+
+	hb, err := newHttpBackend(&HTTPOutputConfig{
+		Name:             "a1",
+		Location:         ts.URL,
+		Interval:         "10ms",
+		FailThreshold:    1,
+		SuccessThreshold: 1,
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hb.Close()
+
+	if _, err := hb.Ping(); err == nil {
+		t.Error("expected an error for a 503 ping")
+	}
+	for i := 0; i < 100 && hb.IsActive(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hb.IsActive() {
+		t.Fatal("backend answering 503 is still active")
+	}
+
+	atomic.StoreInt32(&code, http.StatusNoContent)
+	for i := 0; i < 100 && !hb.IsActive(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !hb.IsActive() {
+		t.Error("backend not active again after a 204 ping")
+	}
+}
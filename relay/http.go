@@ -3,6 +3,7 @@ package relay
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,19 +29,35 @@ type HTTP struct {
 	schema string
 
 	cert string
-	rp   string
+
+	// *httpSettings, replaced as a whole by Reload
+	settings atomic.Value
+
+	// reload re-reads the configuration file of the service
+	reload func() error
 
 	closing int64
-	l       net.Listener
+	server  *http.Server
 	ic      *InfluxCluster
 	mux     *http.ServeMux
 }
 
+// httpSettings are the reloadable settings of the handlers. They are never
+// changed once published, so requests read them without locking.
+type httpSettings struct {
+	rp              string
+	consistency     models.ConsistencyLevel
+	migrator        *Migrator
+	shutdownTimeout time.Duration
+}
+
 const (
 	DefaultHTTPTimeout      = 10 * time.Second
 	DefaultHTTPInterval     = 10 * time.Second
 	DefaultMaxDelayInterval = 10 * time.Second
 	DefaultBatchSizeKB      = 512
+	DefaultDrainTimeout     = 30 * time.Second
+	DefaultShutdownTimeout  = 30 * time.Second
 
 	KB = 1024
 	MB = 1024 * KB
@@ -52,8 +70,37 @@ func NewHTTP(cfg HTTPConfig) (Relay, error) {
 	h.name = cfg.Name
 
 	h.cert = cfg.SSLCombinedPem
-	h.rp = cfg.DefaultRetentionPolicy
-	h.ic = NewInfluxCluster(cfg)
+	s := &httpSettings{rp: cfg.DefaultRetentionPolicy}
+
+	if cfg.WriteConsistency != "" {
+		level, err := models.ParseConsistencyLevel(cfg.WriteConsistency)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing write consistency '%v'", err)
+		}
+		s.consistency = level
+	}
+
+	timeout, err := parseShutdownTimeout(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.shutdownTimeout = timeout
+
+	ic, err := NewInfluxCluster(cfg)
+	if err != nil {
+		return nil, err
+	}
+	h.ic = ic
+
+	if cfg.Former != nil {
+		m, err := NewMigrator(ic, cfg)
+		if err != nil {
+			ic.Close()
+			return nil, err
+		}
+		s.migrator = m
+	}
+	h.settings.Store(s)
 
 	h.schema = "http"
 	if h.cert != "" {
@@ -62,6 +109,7 @@ func NewHTTP(cfg HTTPConfig) (Relay, error) {
 
 	h.mux = http.NewServeMux()
 	h.Register()
+	h.server = &http.Server{Handler: h}
 
 	return h, nil
 }
@@ -69,8 +117,18 @@ func NewHTTP(cfg HTTPConfig) (Relay, error) {
 func (h *HTTP) Register() {
 	h.mux.HandleFunc("/ping", h.HandlerPing)
 	h.mux.HandleFunc("/stats", h.HandlerStats)
+	h.mux.HandleFunc("/metrics", h.HandlerMetrics)
 	h.mux.HandleFunc("/query", h.HandlerQuery)
 	h.mux.HandleFunc("/write", h.HandlerWrite)
+	h.mux.HandleFunc("/api/v2/write", h.HandlerWriteV2)
+	h.mux.HandleFunc("/api/v1/prom/write", h.HandlerPromWrite)
+	h.mux.HandleFunc("/api/v1/prom/read", h.HandlerPromRead)
+	h.mux.HandleFunc("/migrate", h.adminWrite(h.HandlerMigrate))
+	h.mux.HandleFunc("/admin/reload", h.admin(h.HandlerReload))
+	h.mux.HandleFunc("/admin/ring", h.admin(h.HandlerRing))
+	h.mux.HandleFunc("/admin/ring/shard", h.admin(h.HandlerRingShard))
+	h.mux.HandleFunc("/admin/ring/backend", h.admin(h.HandlerRingBackend))
+	h.mux.HandleFunc("/admin/dual-write", h.admin(h.HandlerDualWrite))
 	h.mux.HandleFunc("/debug/pprof/", pprof.Index)
 	h.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 }
@@ -82,6 +140,18 @@ func (h *HTTP) Name() string {
 	return h.name
 }
 
+// httpRelayName returns the name a relay with cfg gets.
+func httpRelayName(cfg HTTPConfig) string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	schema := "http"
+	if cfg.SSLCombinedPem != "" {
+		schema = "https"
+	}
+	return fmt.Sprintf("%s://%s", schema, cfg.Addr)
+}
+
 func (h *HTTP) Run() error {
 	l, err := net.Listen("tcp", h.addr)
 	if err != nil {
@@ -100,21 +170,157 @@ func (h *HTTP) Run() error {
 		})
 	}
 
-	h.l = l
-
 	log.Printf("Starting %s relay %q on %v", strings.ToUpper(h.schema), h.Name(), h.addr)
 
-	err = http.Serve(l, h.mux)
+	err = h.server.Serve(l)
 	if atomic.LoadInt64(&h.closing) != 0 {
 		return nil
 	}
 	return err
 }
 
+// Reload applies a new configuration without restarting the listener.
+// The listen address and certificate can't be changed this way.
+func (h *HTTP) Reload(cfg HTTPConfig) error {
+	r, err := h.prepareReload(cfg)
+	if err != nil {
+		return err
+	}
+	return r.apply()
+}
+
+// httpReload is a configuration of the relay ready to be applied.
+type httpReload struct {
+	h   *HTTP
+	cfg HTTPConfig
+
+	consistency models.ConsistencyLevel
+	timeout     time.Duration
+	migrator    *Migrator
+	cluster     *clusterReload
+}
+
+// prepareReload checks cfg and builds what it needs without changing the
+// relay. It returns with ic.reloadLock held until the result is applied or
+// aborted, so reloads don't interleave; requests don't take that lock.
+func (h *HTTP) prepareReload(cfg HTTPConfig) (*httpReload, error) {
+	if cfg.Addr != h.addr || cfg.SSLCombinedPem != h.cert {
+		log.Printf("relay %q: bind-addr and ssl-combined-pem changes need a restart\n", h.Name())
+	}
+
+	r := &httpReload{h: h, cfg: cfg, consistency: models.ConsistencyLevelAny}
+	if cfg.WriteConsistency != "" {
+		level, err := models.ParseConsistencyLevel(cfg.WriteConsistency)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing write consistency '%v'", err)
+		}
+		r.consistency = level
+	}
+
+	timeout, err := parseShutdownTimeout(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r.timeout = timeout
+
+	if cfg.Former != nil && h.migration() == nil {
+		if r.migrator, err = NewMigrator(h.ic, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	h.ic.reloadLock.Lock()
+	if r.cluster, err = h.ic.prepare(cfg); err != nil {
+		h.ic.reloadLock.Unlock()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *httpReload) abort() {
+	r.cluster.abort()
+	r.h.ic.reloadLock.Unlock()
+}
+
+func (r *httpReload) apply() error {
+	h := r.h
+	defer h.ic.reloadLock.Unlock()
+
+	if err := r.cluster.apply(); err != nil {
+		return err
+	}
+
+	s := &httpSettings{
+		rp:              r.cfg.DefaultRetentionPolicy,
+		consistency:     r.consistency,
+		migrator:        h.migration(),
+		shutdownTimeout: r.timeout,
+	}
+	if s.migrator == nil {
+		s.migrator = r.migrator
+	}
+	h.settings.Store(s)
+
+	log.Printf("relay %q reloaded\n", h.Name())
+	return nil
+}
+
+// writeDefaults returns the retention policy and write consistency of
+// writes that don't set them.
+func (h *HTTP) writeDefaults() (rp string, level models.ConsistencyLevel) {
+	s := h.settings.Load().(*httpSettings)
+	return s.rp, s.consistency
+}
+
+// migration returns the migrator of the former ring, nil without one.
+func (h *HTTP) migration() *Migrator {
+	return h.settings.Load().(*httpSettings).migrator
+}
+
 func (h *HTTP) Stop() error {
 	atomic.StoreInt64(&h.closing, 1)
+	if m := h.migration(); m != nil {
+		m.Stop()
+	}
 	h.ic.Close()
-	return h.l.Close()
+	return h.server.Close()
+}
+
+// Shutdown stops accepting requests, waits for the running ones and
+// delivers the buffered writes, dropping whatever is left at the shutdown
+// timeout.
+func (h *HTTP) Shutdown() error {
+	atomic.StoreInt64(&h.closing, 1)
+	deadline := time.Now().Add(h.settings.Load().(*httpSettings).shutdownTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	var errs []string
+	if err := h.server.Shutdown(ctx); err != nil {
+		errs = append(errs, "requests still running: "+err.Error())
+	}
+	if m := h.migration(); m != nil {
+		m.Stop()
+	}
+	if err := h.ic.Shutdown(deadline); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func parseShutdownTimeout(cfg HTTPConfig) (time.Duration, error) {
+	if cfg.ShutdownTimeout == "" {
+		return DefaultShutdownTimeout, nil
+	}
+	t, err := time.ParseDuration(cfg.ShutdownTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing shutdown timeout '%v'", err)
+	}
+	return t, nil
 }
 
 func (h *HTTP) HandlerPing(w http.ResponseWriter, req *http.Request) {
@@ -171,18 +377,66 @@ func (h *HTTP) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if params.Get("rp") == "" && h.rp != "" {
-		params.Set("rp", h.rp)
+	level, err := h.writeParams(params)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		atomic.AddInt64(&h.ic.stats.WriteRequestsFail, 1)
+		return
+	}
+
+	err = h.write(req, params, req.Header.Get("Authorization"), level, start)
+	if he, ok := err.(*requestError); ok {
+		jsonError(w, he.code, he.msg)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
+// writeParams sets the default retention policy in the parameters of a
+// write and returns the consistency level it asks for. The consistency
+// parameter is removed, the relay enforces consistency itself.
+func (h *HTTP) writeParams(params url.Values) (models.ConsistencyLevel, error) {
+	rp, level := h.writeDefaults()
+	if params.Get("rp") == "" && rp != "" {
+		params.Set("rp", rp)
+	}
+
+	if c := params.Get("consistency"); c != "" {
+		l, err := models.ParseConsistencyLevel(c)
+		if err != nil {
+			return level, err
+		}
+		level = l
+		params.Del("consistency")
+	}
+	return level, nil
+}
+
+// requestError is a write request the relay refused, answered with code.
+type requestError struct {
+	code int
+	msg  string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+// write parses the line protocol in the body of req and routes it to the
+// backends with the query string of params. Refused requests are returned
+// as a *requestError, writes that didn't meet level as a *WriteError.
+func (h *HTTP) write(req *http.Request, params url.Values, auth string, level models.ConsistencyLevel, start time.Time) error {
 	var body = req.Body
 
 	if req.Header.Get("Content-Encoding") == "gzip" {
 		b, err := gzip.NewReader(req.Body)
 		if err != nil {
-			jsonError(w, http.StatusBadRequest, "unable to decode gzip body")
 			atomic.AddInt64(&h.ic.stats.WriteRequestsFail, 1)
-			return
+			return &requestError{http.StatusBadRequest, "unable to decode gzip body"}
 		}
 		defer b.Close()
 		body = b
@@ -192,81 +446,152 @@ func (h *HTTP) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 	_, err := bodyBuf.ReadFrom(body)
 	if err != nil {
 		putBuf(bodyBuf)
-		jsonError(w, http.StatusInternalServerError, "problem reading request body")
 		atomic.AddInt64(&h.ic.stats.WriteRequestsFail, 1)
-		return
+		return &requestError{http.StatusInternalServerError, "problem reading request body"}
 	}
 
 	precision := params.Get("precision")
 	points, err := models.ParsePointsWithPrecision(bodyBuf.Bytes(), start, precision)
 	if err != nil {
 		putBuf(bodyBuf)
-		jsonError(w, http.StatusBadRequest, "unable to parse points")
 		atomic.AddInt64(&h.ic.stats.WriteRequestsFail, 1)
-		return
+		return &requestError{http.StatusBadRequest, "unable to parse points"}
 	}
 
-	outBuf := getBuf()
-	for _, p := range points {
-		if _, err = outBuf.WriteString(p.PrecisionString(precision)); err != nil {
-			break
-		}
-		if err = outBuf.WriteByte('\n'); err != nil {
-			break
-		}
-	}
+	// route the points by shard key, this copies them out of the body
+	rw := h.ic.routePoints(points, precision)
 
 	// done with the input points
 	putBuf(bodyBuf)
 
-	if err != nil {
-		putBuf(outBuf)
-		jsonError(w, http.StatusInternalServerError, "problem writing points")
-		atomic.AddInt64(&h.ic.stats.WriteRequestsFail, 1)
-		return
-	}
+	return h.send(rw, params, auth, level)
+}
 
+// send writes routed points with the query string of params, in the
+// background for consistency any.
+func (h *HTTP) send(rw *routedWrite, params url.Values, auth string, level models.ConsistencyLevel) error {
 	// normalize query string
 	query := params.Encode()
 
-	outBytes := outBuf.Bytes()
+	if level == models.ConsistencyLevelAny {
+		h.ic.async(func() { h.ic.writeRouted(rw, query, auth, level) })
+		return nil
+	}
 
-	// check for authorization performed via the header
-	authHeader := req.Header.Get("Authorization")
-	go h.ic.Write(outBytes, query, authHeader)
-	w.WriteHeader(http.StatusNoContent)
+	return h.ic.writeRouted(rw, query, auth, level)
 }
 
+// HandlerStats returns the cluster statistics with the statistics of every
+// backend, or with format=influxql the same as a result of SHOW STATS.
 func (h *HTTP) HandlerStats(w http.ResponseWriter, req *http.Request) {
-	h.ic.stats.Lock()
-	defer h.ic.stats.Unlock()
-	metric := &Metric{
-		Name: "influx.relay",
-		Tags: h.ic.defaultTags,
-		Fields: map[string]interface{}{
-			"statQueryRequest":         h.ic.stats.QueryRequests,
-			"statQueryRequestFail":     h.ic.stats.QueryRequestsFail,
-			"statWriteRequest":         h.ic.stats.WriteRequests,
-			"statWriteRequestFail":     h.ic.stats.WriteRequestsFail,
-			"statPingRequest":          h.ic.stats.PingRequests,
-			"statPingRequestFail":      h.ic.stats.PingRequestsFail,
-			"statPointsWritten":        h.ic.stats.PointsWritten,
-			"statPointsWrittenFail":    h.ic.stats.PointsWrittenFail,
-			"statQueryRequestDuration": h.ic.stats.QueryRequestDuration,
-			"statWriteRequestDuration": h.ic.stats.WriteRequestDuration,
-		},
-		Time: time.Now(),
-	}
-
-	stats, err := json.Marshal(metric)
+	var v interface{}
+	switch req.FormValue("format") {
+	case "", "json":
+		v = struct {
+			*Metric
+			Backends  []*BackendStats  `json:"backends"`
+			Listeners []*ListenerStats `json:"listeners,omitempty"`
+		}{h.ic.statsMetric(time.Now()), h.ic.backendStatistics(), h.ic.listenerStatistics()}
+	case "influxql":
+		v = h.ic.showStats()
+	default:
+		jsonError(w, http.StatusBadRequest, "invalid parameter: format")
+		return
+	}
+
+	stats, err := json.Marshal(v)
 	if err != nil {
 		jsonError(w, http.StatusInternalServerError, "json marshal failed")
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(stats)
 }
 
+// HandlerMigrate reports the progress of the migration from the former
+// ring, a POST starts it in the background.
+func (h *HTTP) HandlerMigrate(w http.ResponseWriter, req *http.Request) {
+	m := h.migration()
+	if m == nil {
+		jsonError(w, http.StatusNotFound, ErrNoFormer.Error())
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+	case "POST":
+		if err := m.Start(); err != nil {
+			jsonError(w, http.StatusConflict, err.Error())
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid method")
+		return
+	}
+
+	data, err := json.Marshal(struct {
+		Running      bool               `json:"running"`
+		Measurements []*MigrationStatus `json:"measurements"`
+	}{m.Running(), m.Status()})
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "json marshal failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if req.Method == "POST" {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	w.Write(data)
+}
+
+// HandlerReload reloads the configuration file of the service.
+func (h *HTTP) HandlerReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid method")
+		return
+	}
+	if h.reload == nil {
+		jsonError(w, http.StatusNotFound, "reload not available")
+		return
+	}
+
+	if err := h.reload(); err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandlerDualWrite reports whether writes are copied to the former ring,
+// a POST with enabled=true|false switches it.
+func (h *HTTP) HandlerDualWrite(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "POST":
+		on, err := strconv.ParseBool(req.FormValue("enabled"))
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid parameter: enabled")
+			return
+		}
+		if err := h.ic.SetDualWrite(on); err != nil {
+			jsonError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Printf("dual-write to former ring set to %v\n", on)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid method")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"enabled\":%v}\n", h.ic.DualWriting())
+}
+
 type responseData struct {
 	ContentType     string
 	ContentEncoding string
@@ -296,7 +621,42 @@ func jsonError(w http.ResponseWriter, code int, message string) {
 	w.Write([]byte(data))
 }
 
-var ErrBufferFull = errors.New("retry buffer full")
+// writeError reports a failed write, including per-backend detail
+// when the consistency level wasn't met.
+func writeError(w http.ResponseWriter, err error) {
+	we, ok := err.(*WriteError)
+	if !ok {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	data, err := json.Marshal(struct {
+		Error    string         `json:"error"`
+		Backends []BackendError `json:"backends"`
+	}{we.Error(), we.Failed})
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, we.Error())
+		return
+	}
+	data = append(data, '\n')
+
+	code := http.StatusServiceUnavailable
+	if we.Partial {
+		code = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+var (
+	ErrBufferFull    = errors.New("retry buffer full")
+	ErrBufferClosed  = errors.New("retry buffer closed")
+	ErrBufferTimeout = errors.New("write buffered, not delivered in time")
+	ErrBufferedWAL   = errors.New("write buffered in the wal, not delivered yet")
+)
 
 var bufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
 
@@ -0,0 +1,220 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandlerWriteConsistency(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ok.Close()
+
+	fail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer fail.Close()
+
+	dir, err := ioutil.TempDir("", "relay-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newHandler := func(outputs map[string][]HTTPOutputConfig) *HTTP {
+		r, err := NewHTTP(HTTPConfig{Replicas: 10, Outputs: outputs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.(*HTTP)
+	}
+
+	replicas := newHandler(map[string][]HTTPOutputConfig{
+		"a": {
+			{Name: "ok1", Location: ok.URL, Interval: "1h"},
+			{Name: "ok2", Location: ok.URL, Interval: "1h"},
+			{Name: "fail", Location: fail.URL, Interval: "1h"},
+		},
+	})
+	defer replicas.ic.Close()
+
+	shards := newHandler(map[string][]HTTPOutputConfig{
+		"a": {{Name: "ok", Location: ok.URL, Interval: "1h"}},
+		"b": {{Name: "fail", Location: fail.URL, Interval: "1h"}},
+	})
+	defer shards.ic.Close()
+
+	// a write kept in the wal is durable but not acknowledged
+	wal := newHandler(map[string][]HTTPOutputConfig{
+		"a": {
+			{Name: "ok", Location: ok.URL, Interval: "1h"},
+			{Name: "wal", Location: fail.URL, Interval: "1h", WALDir: dir, WALFsync: "never"},
+		},
+	})
+	defer wal.ic.Close()
+
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf("m%d value=1", i))
+	}
+	body := strings.Join(lines, "\n")
+
+	tests := []struct {
+		h           *HTTP
+		consistency string
+		code        int
+		partial     bool
+		failed      []string
+	}{
+		{replicas, "any", 204, false, nil},
+		{replicas, "one", 204, false, nil},
+		{replicas, "quorum", 204, false, nil},
+		{replicas, "all", 503, false, []string{"fail"}},
+		{replicas, "bogus", 400, false, nil},
+		{shards, "any", 204, false, nil},
+		{shards, "one", 500, true, []string{"fail"}},
+		{wal, "one", 204, false, nil},
+		{wal, "all", 503, false, []string{"wal"}},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest("POST", "/write?db=test&consistency="+tt.consistency, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		tt.h.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%d %s: expected %d, got %d %s", i, tt.consistency, tt.code, w.Code, w.Body)
+			continue
+		}
+		if tt.failed == nil {
+			continue
+		}
+
+		var e struct {
+			Error    string
+			Backends []BackendError
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+			t.Errorf("%d %s: unexpected body %s", i, tt.consistency, w.Body)
+			continue
+		}
+		if strings.HasPrefix(e.Error, "partial write") != tt.partial {
+			t.Errorf("%d %s: unexpected error %q", i, tt.consistency, e.Error)
+		}
+		var failed []string
+		for _, b := range e.Backends {
+			failed = append(failed, b.Backend)
+		}
+		if strings.Join(failed, ",") != strings.Join(tt.failed, ",") {
+			t.Errorf("%d %s: expected failed backends %v, got %+v", i, tt.consistency, tt.failed, e.Backends)
+		}
+	}
+}
+
+func TestReloadWhileWriting(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	cfg := HTTPConfig{
+		Replicas: 10,
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: ts.URL, Interval: "1h"}},
+		},
+	}
+	r, err := NewHTTP(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := r.(*HTTP)
+	defer h.ic.Close()
+
+	// the handlers read the settings Reload changes
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, p := range []string{"POST /write?db=test", "POST /api/v2/write?bucket=test", "POST /api/v1/prom/write?db=test", "GET /migrate"} {
+		wg.Add(1)
+		go func(method, path string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				req := httptest.NewRequest(method, path, strings.NewReader("cpu value=1"))
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		}(p[:strings.IndexByte(p, ' ')], p[strings.IndexByte(p, ' ')+1:])
+	}
+
+	for i := 0; i < 50; i++ {
+		c := cfg
+		c.DefaultRetentionPolicy = fmt.Sprintf("rp%d", i%2)
+		c.WriteConsistency = []string{"one", "all"}[i%2]
+		c.ShutdownTimeout = "10s"
+		if err := h.Reload(c); err != nil {
+			t.Error(err)
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+
+	// a reload that takes long, e.g. opening WALs, doesn't hold up writes
+	reload, err := h.prepareReload(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reload.abort()
+
+	written := make(chan int)
+	for _, p := range []string{"/write?db=test", "/api/v2/write?bucket=test"} {
+		go func(p string) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", p, strings.NewReader("cpu value=1")))
+			written <- w.Code
+		}(p)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case code := <-written:
+			if code != http.StatusNoContent {
+				t.Errorf("write during reload: expected 204, got %d", code)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("write blocked by a reload in progress")
+		}
+	}
+}
+
+func TestNewHTTPClosesClusterOnError(t *testing.T) {
+	before := runtime.NumGoroutine()
+	_, err := NewHTTP(HTTPConfig{
+		Replicas:     10,
+		MigrateChunk: "bogus",
+		Outputs:      map[string][]HTTPOutputConfig{"a": {{Name: "a1", Location: "http://127.0.0.1:1"}}},
+		Former:       map[string][]HTTPOutputConfig{"b": {{Name: "b1", Location: "http://127.0.0.1:2"}}},
+	})
+	if err == nil {
+		t.Fatal("invalid migrate chunk should fail")
+	}
+
+	// the cluster started before the migrator failed is stopped again
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines left running, %d before", n, before)
+	}
+}
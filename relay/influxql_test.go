@@ -43,35 +43,25 @@ import "testing"
 
 func TestInfluxQL(t *testing.T) {
 	checkPoint(t, "select * from cpu", "cpu")
-	checkPoint(t, "(select *) from cpu", "cpu")
-	checkPoint(t, "[select *] from cpu", "cpu")
-	checkPoint(t, "{select *} from cpu", "cpu")
 	checkPoint(t, "select * from \"cpu\"", "cpu")
 	checkPoint(t, "select * from \"c\\\"pu\"", "c\"pu")
-	checkPoint(t, "select * from 'cpu'", "cpu")
 
 	checkPoint(t, "SELECT mean(\"value\") FROM \"cpu\" WHERE \"region\" = 'uswest' GROUP BY time(10m) fill(0)", "cpu")
 	checkPoint(t, "SELECT mean(\"value\") INTO \"cpu\\\"_1h\".:MEASUREMENT FROM /cpu.*/", "/cpu.*/")
-
-	checkPoint(t, "REVOKE ALL PRIVILEGES FROM \"jdoe\"", "jdoe")
-	checkPoint(t, "REVOKE READ ON \"mydb\" FROM \"jdoe\"", "jdoe")
+	checkPoint(t, "SELECT value FROM cpu WHERE host = 'from mem'", "cpu")
+	checkPoint(t, "SELECT max(mean) FROM (SELECT mean(value) FROM cpu GROUP BY time(1m), (host))", "cpu")
 
 	checkPoint(t, "DELETE FROM \"cpu\"", "cpu")
 	checkPoint(t, "DELETE FROM \"cpu\" WHERE time < '2000-01-01T00:00:00Z'", "cpu")
 
-	// checkPoint(t, "DROP SERIES FROM \"telegraf\".\"autogen\".\"cpu\" WHERE cpu = 'cpu8'", "cpu")
-	// checkPoint(t, "SHOW FIELD KEYS", "cpu")
+	checkPoint(t, "DROP SERIES FROM \"telegraf\".\"autogen\".\"cpu\" WHERE cpu = 'cpu8'", "cpu")
 	checkPoint(t, "SHOW FIELD KEYS FROM \"cpu\"", "cpu")
-	// checkPoint(t, "SHOW SERIES FROM \"telegraf\".\"autogen\".\"cpu\" WHERE cpu = 'cpu8'", "cpu")
+	checkPoint(t, "SHOW SERIES FROM \"telegraf\".\"autogen\".\"cpu\" WHERE cpu = 'cpu8'", "cpu")
 
-	// checkPoint(t, "SHOW TAG KEYS", "cpu")
 	checkPoint(t, "SHOW TAG KEYS FROM cpu", "cpu")
 	checkPoint(t, "SHOW TAG KEYS FROM \"cpu\" WHERE \"region\" = 'uswest'", "cpu")
-	// checkPoint(t, "SHOW TAG KEYS WHERE \"host\" = 'serverA'", "cpu")
 
-	// checkPoint(t, "SHOW TAG VALUES WITH KEY = \"region\"", "cpu")
 	checkPoint(t, "SHOW TAG VALUES FROM \"cpu\" WITH KEY = \"region\"", "cpu")
-	// checkPoint(t, "SHOW TAG VALUES WITH KEY !~ /.*c.*/", "cpu")
 	checkPoint(t, "SHOW TAG VALUES FROM \"cpu\" WITH KEY IN (\"region\", \"host\") WHERE \"service\" = 'redis'", "cpu")
 
 	checkPoint(t, "SHOW FIELD KEYS FROM \"1h\".\"cpu\"", "cpu")
@@ -79,6 +69,81 @@ func TestInfluxQL(t *testing.T) {
 	checkPoint(t, "SHOW FIELD KEYS FROM \"cpu.load\"", "cpu.load")
 	checkPoint(t, "SHOW FIELD KEYS FROM 1h.\"cpu.load\"", "cpu.load")
 	checkPoint(t, "SHOW FIELD KEYS FROM \"1h\".\"cpu.load\"", "cpu.load")
+
+	// The old tokenizer picked the word after FROM out of anything, these
+	// used to give "cpu" and "jdoe". They aren't InfluxQL, or name a user
+	// rather than a measurement, so the parser refuses them.
+	checkIllegal(t, "(select *) from cpu")
+	checkIllegal(t, "[select *] from cpu")
+	checkIllegal(t, "{select *} from cpu")
+	checkIllegal(t, "select * from 'cpu'")
+	checkIllegal(t, "REVOKE ALL PRIVILEGES FROM \"jdoe\"")
+	checkIllegal(t, "REVOKE READ ON \"mydb\" FROM \"jdoe\"")
+
+	// no measurement involved
+	checkIllegal(t, "SHOW FIELD KEYS")
+	checkIllegal(t, "SHOW TAG KEYS WHERE \"host\" = 'serverA'")
+	checkIllegal(t, "SHOW TAG VALUES WITH KEY !~ /.*c.*/")
+}
+
+func TestParseInfluxQL(t *testing.T) {
+	stmts, err := ParseInfluxQL("SELECT mean(value) FROM telegraf.autogen.cpu WHERE time > now() - 1h; SELECT value FROM mem ; -- comment\nSHOW MEASUREMENTS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stmts) != 3 {
+		t.Fatalf("expected 3 statements, got %d", len(stmts))
+	}
+	if stmts[0].Type != StatementSelect || stmts[2].Type != StatementShowMeasurements {
+		t.Errorf("statement types wrong: %s, %s", stmts[0].Type, stmts[2].Type)
+	}
+	if stmts[1].Text != "SELECT value FROM mem" {
+		t.Errorf("statement text wrong: %q", stmts[1].Text)
+	}
+
+	m := stmts[0].Measurements()[0]
+	if m.Database != "telegraf" || m.RetentionPolicy != "autogen" || m.Name != "cpu" {
+		t.Errorf("measurement wrong: %+v", m)
+	}
+
+	stmts, err = ParseInfluxQL("SELECT value INTO \"1h\".:MEASUREMENT FROM cpu, /^mem/ WHERE time >= '2018-01-01T00:00:00Z' AND time <= '2018-01-02T00:00:00Z'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := stmts[0]
+	if st.Into == nil || st.Into.RetentionPolicy != "1h" || st.Into.Name != "" {
+		t.Errorf("into wrong: %+v", st.Into)
+	}
+	if ms := st.Measurements(); len(ms) != 2 || ms[1].Regex != "^mem" || !st.AllMeasurements() {
+		t.Errorf("sources wrong: %v", st.Sources)
+	}
+
+	stmts, err = ParseInfluxQL("select value from cpu; drop database telegraf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stmts) != 2 || stmts[1].Type != StatementDrop {
+		t.Errorf("hidden drop statement not found")
+	}
+
+	stmts, err = ParseInfluxQL("SELECT mean(\"value\") AS m FROM cpu WHERE host = 'a' GROUP BY time(10m), host fill(none) ORDER BY time DESC LIMIT 10 tz('Asia/Shanghai')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "SELECT mean(\"value\") AS \"m\" FROM \"cpu\" WHERE \"host\" = 'a' GROUP BY time(10m), \"host\" fill(none) ORDER BY time DESC LIMIT 10 tz('Asia/Shanghai')"
+	if s := stmts[0].String(); s != expected {
+		t.Errorf("statement string wrong:\n%s\n%s", s, expected)
+	}
+
+	if _, err := ParseInfluxQL("SELECT value FROM cpu WHERE host = 'a"); err == nil {
+		t.Error("unterminated string should fail")
+	}
+}
+
+func checkIllegal(t *testing.T, q string) {
+	if m, err := GetMeasurementFromInfluxQL(q); err == nil {
+		t.Errorf("expected error for %s, got %s", q, m)
+	}
 }
 
 func checkPoint(t *testing.T, q string, m string) {
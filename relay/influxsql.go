@@ -1,168 +1,1122 @@
 package relay
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
-	"log"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
-	ErrWrongQuote     = errors.New("wrong quote")
-	ErrUnmatchedQuote = errors.New("unmatched quote")
-	ErrUnclosed       = errors.New("unclosed parenthesis")
-	ErrIllegalQL      = errors.New("illegal InfluxQL")
+	ErrIllegalQL = errors.New("illegal InfluxQL")
 )
 
-func FindEndWithQuote(data []byte, start int, endchar byte) (end int, unquoted []byte, err error) {
-	unquoted = append(unquoted, data[start])
-	start++
-	for end = start; end < len(data); end++ {
-		switch data[end] {
-		case endchar:
-			unquoted = append(unquoted, data[end])
-			end++
-			return
-		case '\\':
-			switch {
-			case len(data) == end:
-				err = ErrUnmatchedQuote
-				return
-			case data[end+1] == endchar:
-				end++
-				unquoted = append(unquoted, data[end])
-			default:
-				err = ErrWrongQuote
-				return
+// ParseInfluxQL parses a query into its statements.
+func ParseInfluxQL(q string) ([]*Statement, error) {
+	p := newParser(q)
+
+	var stmts []*Statement
+	for {
+		it := p.scan()
+		switch it.tok {
+		case EOF:
+			if len(stmts) == 0 {
+				return nil, ErrIllegalQL
 			}
-		default:
-			unquoted = append(unquoted, data[end])
+			return stmts, nil
+		case SEMICOLON:
+			continue
+		}
+		p.unscan(it)
+
+		st, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+
+		next := p.scan()
+		st.Text = strings.TrimSpace(q[it.pos:next.pos])
+		stmts = append(stmts, st)
+
+		if next.tok != SEMICOLON && next.tok != EOF {
+			return nil, p.errorf(next, ";")
 		}
+		p.unscan(next)
 	}
-	err = ErrUnmatchedQuote
-	return
 }
 
-func ScanToken(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF && len(data) == 0 {
-		return 0, nil, nil
+type item struct {
+	tok Token
+	pos int
+	lit string
+}
+
+type parser struct {
+	s   *scanner
+	buf []item
+}
+
+func newParser(q string) *parser {
+	return &parser{s: newScanner(q)}
+}
+
+// scan returns the next token, skipping whitespace and comments.
+func (p *parser) scan() item {
+	if n := len(p.buf); n > 0 {
+		it := p.buf[n-1]
+		p.buf = p.buf[:n-1]
+		return it
 	}
 
-	start := 0
-	for ; start < len(data) && data[start] == ' '; start++ {
+	for {
+		tok, pos, lit := p.s.scan()
+		if tok != WS && tok != COMMENT {
+			return item{tok, pos, lit}
+		}
 	}
-	if start == len(data) {
-		return 0, nil, nil
+}
+
+func (p *parser) unscan(it item) {
+	p.buf = append(p.buf, it)
+}
+
+func (p *parser) peek() item {
+	it := p.scan()
+	p.unscan(it)
+	return it
+}
+
+// scanRegex returns the next token if it is a regex, otherwise it leaves
+// the token for scan.
+func (p *parser) scanRegex() item {
+	if n := len(p.buf); n > 0 {
+		p.s.pos = p.buf[n-1].pos
+		p.buf = p.buf[:0]
+	}
+
+	start := p.s.pos
+	for {
+		tok, _, _ := p.s.scan()
+		if tok != WS && tok != COMMENT {
+			break
+		}
+		start = p.s.pos
+	}
+	p.s.pos = start
+
+	tok, pos, lit := p.s.scanRegex()
+	return item{tok, pos, lit}
+}
+
+func isKeyword(it item, kw string) bool {
+	return it.tok == IDENT && strings.EqualFold(it.lit, kw)
+}
+
+// acceptKeyword consumes the next token if it is one of the keywords.
+func (p *parser) acceptKeyword(kws ...string) (string, bool) {
+	it := p.scan()
+	for _, kw := range kws {
+		if isKeyword(it, kw) {
+			return kw, true
+		}
+	}
+	p.unscan(it)
+	return "", false
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	it := p.scan()
+	if !isKeyword(it, kw) {
+		return p.errorf(it, strings.ToUpper(kw))
 	}
+	return nil
+}
 
-	switch data[start] {
-	case '"':
-		advance, token, err = FindEndWithQuote(data, start, '"')
+func (p *parser) expect(tok Token) (item, error) {
+	it := p.scan()
+	if it.tok != tok {
+		return it, p.errorf(it, tok.String())
+	}
+	return it, nil
+}
+
+func (p *parser) errorf(it item, expected ...string) error {
+	found := it.lit
+	switch it.tok {
+	case EOF:
+		found = "EOF"
+	case STRING:
+		found = quoteString(it.lit)
+	case QIDENT:
+		found = quoteIdent(it.lit)
+	case BADSTRING:
+		return fmt.Errorf("error parsing query: bad string at char %d", it.pos+1)
+	case BADREGEX:
+		return fmt.Errorf("error parsing query: bad regex at char %d", it.pos+1)
+	default:
+		if found == "" {
+			found = it.tok.String()
+		}
+	}
+	return fmt.Errorf("error parsing query: found %s, expected %s at char %d", found, strings.Join(expected, ", "), it.pos+1)
+}
+
+func (p *parser) parseStatement() (*Statement, error) {
+	it := p.scan()
+	if it.tok != IDENT {
+		return nil, p.errorf(it, "SELECT", "DELETE", "SHOW", "CREATE", "DROP", "GRANT", "REVOKE", "ALTER", "KILL", "EXPLAIN")
+	}
+
+	switch strings.ToLower(it.lit) {
+	case "select":
+		return p.parseSelect()
+	case "explain":
+		_, analyze := p.acceptKeyword("analyze")
+		if err := p.expectKeyword("select"); err != nil {
+			return nil, err
+		}
+		st, err := p.parseSelect()
 		if err != nil {
-			log.Printf("scan token error: %s\n", err)
+			return nil, err
+		}
+		st.Explain = true
+		st.Analyze = analyze
+		return st, nil
+	case "show":
+		return p.parseShow()
+	case "delete":
+		return p.parseDelete()
+	case "drop":
+		return p.parseDrop()
+	case "create":
+		return p.skipStatement(&Statement{Type: StatementCreate})
+	case "alter":
+		return p.skipStatement(&Statement{Type: StatementAlter})
+	case "grant":
+		return p.skipStatement(&Statement{Type: StatementGrant})
+	case "revoke":
+		return p.skipStatement(&Statement{Type: StatementRevoke})
+	case "kill":
+		return p.skipStatement(&Statement{Type: StatementKill})
+	}
+
+	return nil, p.errorf(it, "SELECT", "DELETE", "SHOW", "CREATE", "DROP", "GRANT", "REVOKE", "ALTER", "KILL", "EXPLAIN")
+}
+
+// skipStatement consumes the rest of a statement the relay doesn't need
+// to understand.
+func (p *parser) skipStatement(st *Statement) (*Statement, error) {
+	depth := 0
+	var last Token
+	for {
+		if last == EQREGEX || last == NEQREGEX {
+			if it := p.scanRegex(); it.tok == REGEX {
+				last = REGEX
+				continue
+			}
+		}
+
+		it := p.scan()
+		switch it.tok {
+		case EOF:
+			p.unscan(it)
+			return st, nil
+		case SEMICOLON:
+			if depth == 0 {
+				p.unscan(it)
+				return st, nil
+			}
+		case LPAREN:
+			depth++
+		case RPAREN:
+			depth--
+		case BADSTRING, BADREGEX, ILLEGAL:
+			return nil, p.errorf(it, "identifier", "string", "number")
+		}
+		last = it.tok
+	}
+}
+
+func (p *parser) parseSelect() (*Statement, error) {
+	st := &Statement{Type: StatementSelect}
+
+	var err error
+	if st.Fields, err = p.parseFields(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := p.acceptKeyword("into"); ok {
+		if st.Into, err = p.parseMeasurement(true); err != nil {
+			return nil, err
 		}
-		return
-	case '\'':
-		advance, token, err = FindEndWithQuote(data, start, '\'')
+	}
+
+	if err = p.expectKeyword("from"); err != nil {
+		return nil, err
+	}
+	if st.Sources, err = p.parseSources(); err != nil {
+		return nil, err
+	}
+
+	if err = p.parseCondition(st); err != nil {
+		return nil, err
+	}
+
+	if _, ok := p.acceptKeyword("group"); ok {
+		if err = p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		if st.Dimensions, err = p.parseDimensions(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := p.acceptKeyword("fill"); ok {
+		if st.Fill, err = p.parseFill(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := p.acceptKeyword("order"); ok {
+		if err = p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		if st.Descending, err = p.parseOrder(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = p.parseLimits(st); err != nil {
+		return nil, err
+	}
+
+	if _, ok := p.acceptKeyword("tz"); ok {
+		if _, err = p.expect(LPAREN); err != nil {
+			return nil, err
+		}
+		loc, err := p.expect(STRING)
 		if err != nil {
-			log.Printf("scan token error: %s\n", err)
+			return nil, err
 		}
-		return
-	case '(':
-		advance = bytes.IndexByte(data[start:], ')')
-		if advance == -1 {
-			err = ErrUnclosed
-		} else {
-			advance += start + 1
+		st.Location = loc.lit
+		if _, err = p.expect(RPAREN); err != nil {
+			return nil, err
 		}
-	case '[':
-		advance = bytes.IndexByte(data[start:], ']')
-		if advance == -1 {
-			err = ErrUnclosed
+	}
+
+	return st, nil
+}
+
+func (p *parser) parseFields() ([]*Field, error) {
+	var fields []*Field
+	for {
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+
+		f := &Field{Expr: expr}
+		if _, ok := p.acceptKeyword("as"); ok {
+			if f.Alias, err = p.parseIdent(); err != nil {
+				return nil, err
+			}
+		}
+		fields = append(fields, f)
+
+		if it := p.scan(); it.tok != COMMA {
+			p.unscan(it)
+			return fields, nil
+		}
+	}
+}
+
+func (p *parser) parseIdent() (string, error) {
+	it := p.scan()
+	if it.tok != IDENT && it.tok != QIDENT {
+		return "", p.errorf(it, "identifier")
+	}
+	return it.lit, nil
+}
+
+func (p *parser) parseSources() ([]Source, error) {
+	var sources []Source
+	for {
+		if it := p.scan(); it.tok == LPAREN {
+			if err := p.expectKeyword("select"); err != nil {
+				return nil, err
+			}
+			st, err := p.parseSelect()
+			if err != nil {
+				return nil, err
+			}
+			if _, err = p.expect(RPAREN); err != nil {
+				return nil, err
+			}
+			sources = append(sources, &SubQuery{Statement: st})
 		} else {
-			advance += start + 1
+			p.unscan(it)
+			m, err := p.parseMeasurement(false)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, m)
+		}
+
+		if it := p.scan(); it.tok != COMMA {
+			p.unscan(it)
+			return sources, nil
+		}
+	}
+}
+
+// parseMeasurement parses [db.][rp.]name where name may be a regex, or
+// :MEASUREMENT for INTO targets.
+func (p *parser) parseMeasurement(target bool) (*Measurement, error) {
+	m := &Measurement{IsTarget: target}
+
+	var segments []string
+	for {
+		if it := p.scanRegex(); it.tok == REGEX {
+			m.Regex = it.lit
+			break
+		} else if it.tok == BADREGEX {
+			return nil, p.errorf(it)
+		}
+
+		it := p.scan()
+		switch {
+		case it.tok == IDENT || it.tok == QIDENT:
+			segments = append(segments, it.lit)
+		// unquoted names such as 1h.cpu
+		case it.tok == INTEGER || it.tok == DURATION:
+			segments = append(segments, it.lit)
+		case it.tok == DOT:
+			// empty segment, as in db..cpu
+			p.unscan(it)
+			segments = append(segments, "")
+		case it.tok == COLON && target:
+			if err := p.expectKeyword("measurement"); err != nil {
+				return nil, err
+			}
+			segments = append(segments, "")
+		default:
+			return nil, p.errorf(it, "identifier")
+		}
+
+		if it := p.scan(); it.tok != DOT {
+			p.unscan(it)
+			break
+		}
+		if len(segments) == 3 {
+			return nil, p.errorf(p.peek(), "end of measurement")
 		}
-	case '{':
-		advance = bytes.IndexByte(data[start:], '}')
-		if advance == -1 {
-			err = ErrUnclosed
+	}
+
+	n := len(segments)
+	if m.Regex != "" {
+		n++
+		segments = append(segments, "")
+	}
+	switch n {
+	case 3:
+		m.Database = segments[0]
+		m.RetentionPolicy = segments[1]
+	case 2:
+		m.RetentionPolicy = segments[0]
+	}
+	if m.Regex == "" {
+		m.Name = segments[n-1]
+	}
+
+	return m, nil
+}
+
+func (p *parser) parseCondition(st *Statement) (err error) {
+	if _, ok := p.acceptKeyword("where"); ok {
+		st.Condition, err = p.parseExpr()
+	}
+	return
+}
+
+func (p *parser) parseDimensions() ([]*Dimension, error) {
+	var dims []*Dimension
+	for {
+		var expr Expr
+		if it := p.scanRegex(); it.tok == REGEX {
+			expr = &RegexLiteral{Val: it.lit}
 		} else {
-			advance += start + 1
+			var err error
+			if expr, err = p.parseExpr(); err != nil {
+				return nil, err
+			}
+		}
+		dims = append(dims, &Dimension{Expr: expr})
+
+		if it := p.scan(); it.tok != COMMA {
+			p.unscan(it)
+			return dims, nil
+		}
+	}
+}
+
+func (p *parser) parseFill() (string, error) {
+	if _, err := p.expect(LPAREN); err != nil {
+		return "", err
+	}
+
+	var fill string
+	it := p.scan()
+	switch {
+	case it.tok == IDENT:
+		switch strings.ToLower(it.lit) {
+		case "null", "none", "previous", "linear":
+			fill = strings.ToLower(it.lit)
+		default:
+			return "", p.errorf(it, "null", "none", "previous", "linear", "number")
+		}
+	case it.tok == INTEGER || it.tok == NUMBER:
+		fill = it.lit
+	case it.tok == SUB:
+		n := p.scan()
+		if n.tok != INTEGER && n.tok != NUMBER {
+			return "", p.errorf(n, "number")
 		}
+		fill = "-" + n.lit
 	default:
-		advance = bytes.IndexFunc(data[start:], func(r rune) bool {
-			return r == ' '
-		})
-		if advance == -1 {
-			advance = len(data)
-		} else {
-			advance += start
+		return "", p.errorf(it, "null", "none", "previous", "linear", "number")
+	}
+
+	if _, err := p.expect(RPAREN); err != nil {
+		return "", err
+	}
+	return fill, nil
+}
+
+// parseOrder parses the ORDER BY list and reports whether time is descending.
+func (p *parser) parseOrder() (desc bool, err error) {
+	for {
+		if _, err = p.parseIdent(); err != nil {
+			return
+		}
+		if kw, ok := p.acceptKeyword("asc", "desc"); ok {
+			desc = kw == "desc"
+		}
+		if it := p.scan(); it.tok != COMMA {
+			p.unscan(it)
+			return
+		}
+	}
+}
+
+func (p *parser) parseLimits(st *Statement) error {
+	for {
+		kw, ok := p.acceptKeyword("limit", "offset", "slimit", "soffset")
+		if !ok {
+			return nil
+		}
+
+		it, err := p.expect(INTEGER)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(it.lit)
+		if err != nil {
+			return p.errorf(it, "integer")
 		}
 
+		switch kw {
+		case "limit":
+			st.Limit = n
+		case "offset":
+			st.Offset = n
+		case "slimit":
+			st.SLimit = n
+		case "soffset":
+			st.SOffset = n
+		}
 	}
-	if err != nil {
-		log.Printf("scan token error: %s\n", err)
-		return
+}
+
+func (p *parser) parseOn(st *Statement) (err error) {
+	if _, ok := p.acceptKeyword("on"); ok {
+		st.Database, err = p.parseIdent()
 	}
+	return
+}
 
-	token = data[start:advance]
-	// fmt.Printf("%s (%d, %d) = %s\n", data, start, advance, token)
+func (p *parser) parseFrom(st *Statement) (err error) {
+	if _, ok := p.acceptKeyword("from"); ok {
+		st.Sources, err = p.parseSources()
+	}
 	return
 }
 
-func GetMeasurementFromInfluxQL(q string) (m string, err error) {
-	buf := bytes.NewBuffer([]byte(q))
-	scanner := bufio.NewScanner(buf)
-	scanner.Buffer([]byte(q), len(q))
-	scanner.Split(ScanToken)
-	var tokens []string
-	for scanner.Scan() {
-		tokens = append(tokens, scanner.Text())
-	}
-	//fmt.Printf("%v\n", tokens)
-
-	for i := 0; i < len(tokens); i++ {
-		// fmt.Printf("%v\n", tokens[i])
-		if strings.ToLower(tokens[i]) == "from" {
-			if i+1 < len(tokens) {
-				m = getMeasurement(tokens[i+1:])
-				return
+func (p *parser) parseShow() (*Statement, error) {
+	st := new(Statement)
+
+	it := p.scan()
+	if it.tok != IDENT {
+		return nil, p.errorf(it, "MEASUREMENTS", "TAG", "FIELD", "SERIES", "DATABASES", "RETENTION")
+	}
+
+	kw := strings.ToLower(it.lit)
+	switch kw {
+	case "measurements":
+		st.Type = StatementShowMeasurements
+		if err := p.parseOn(st); err != nil {
+			return nil, err
+		}
+		if _, ok := p.acceptKeyword("with"); ok {
+			if err := p.expectKeyword("measurement"); err != nil {
+				return nil, err
+			}
+			op := p.scan()
+			switch op.tok {
+			case EQ:
+				name, err := p.parseIdent()
+				if err != nil {
+					return nil, err
+				}
+				st.Sources = []Source{&Measurement{Name: name}}
+			case EQREGEX:
+				re := p.scanRegex()
+				if re.tok != REGEX {
+					return nil, p.errorf(p.peek(), "regex")
+				}
+				st.Sources = []Source{&Measurement{Regex: re.lit}}
+			default:
+				return nil, p.errorf(op, "=", "=~")
+			}
+		}
+		if err := p.parseCondition(st); err != nil {
+			return nil, err
+		}
+		return st, p.parseLimits(st)
+
+	case "tag", "field", "measurement", "series":
+		next := p.peek()
+		if isKeyword(next, "cardinality") || isKeyword(next, "exact") {
+			st.Type = StatementShowCardinality
+			return p.parseShowCardinality(st)
+		}
+
+		switch {
+		case kw == "series":
+			st.Type = StatementShowSeries
+		case kw == "measurement":
+			return nil, p.errorf(next, "CARDINALITY")
+		case isKeyword(next, "keys") && kw == "tag":
+			st.Type = StatementShowTagKeys
+		case isKeyword(next, "keys") && kw == "field":
+			st.Type = StatementShowFieldKeys
+		case isKeyword(next, "values") && kw == "tag":
+			st.Type = StatementShowTagValues
+		case isKeyword(next, "key"):
+			p.scan()
+			st.Type = StatementShowCardinality
+			return p.parseShowCardinality(st)
+		default:
+			return nil, p.errorf(next, "KEYS", "VALUES")
+		}
+		if kw != "series" {
+			p.scan()
+		}
+
+		if err := p.parseOn(st); err != nil {
+			return nil, err
+		}
+		if err := p.parseFrom(st); err != nil {
+			return nil, err
+		}
+		if st.Type == StatementShowTagValues {
+			if err := p.parseWithKey(); err != nil {
+				return nil, err
 			}
 		}
+		if err := p.parseCondition(st); err != nil {
+			return nil, err
+		}
+		return st, p.parseLimits(st)
+
+	case "databases":
+		st.Type = StatementShowDatabases
+		return p.skipStatement(st)
+
+	case "retention":
+		if err := p.expectKeyword("policies"); err != nil {
+			return nil, err
+		}
+		st.Type = StatementShowRetentionPolicies
+		if err := p.parseOn(st); err != nil {
+			return nil, err
+		}
+		return p.skipStatement(st)
 	}
 
-	return "", ErrIllegalQL
+	st.Type = StatementShow
+	return p.skipStatement(st)
+}
+
+func (p *parser) parseShowCardinality(st *Statement) (*Statement, error) {
+	p.acceptKeyword("exact")
+	if err := p.expectKeyword("cardinality"); err != nil {
+		return nil, err
+	}
+	if err := p.parseOn(st); err != nil {
+		return nil, err
+	}
+	if err := p.parseFrom(st); err != nil {
+		return nil, err
+	}
+	return p.skipStatement(st)
+}
+
+// parseWithKey parses the WITH KEY clause of SHOW TAG VALUES.
+func (p *parser) parseWithKey() error {
+	if err := p.expectKeyword("with"); err != nil {
+		return err
+	}
+	if err := p.expectKeyword("key"); err != nil {
+		return err
+	}
+
+	if _, ok := p.acceptKeyword("in"); ok {
+		if _, err := p.expect(LPAREN); err != nil {
+			return err
+		}
+		for {
+			if _, err := p.parseIdent(); err != nil {
+				return err
+			}
+			it := p.scan()
+			if it.tok == RPAREN {
+				return nil
+			}
+			if it.tok != COMMA {
+				return p.errorf(it, ",", ")")
+			}
+		}
+	}
+
+	op := p.scan()
+	switch op.tok {
+	case EQ, NEQ:
+		_, err := p.parseIdent()
+		return err
+	case EQREGEX, NEQREGEX:
+		if it := p.scanRegex(); it.tok != REGEX {
+			return p.errorf(p.peek(), "regex")
+		}
+		return nil
+	}
+	return p.errorf(op, "=", "!=", "=~", "!~", "IN")
+}
+
+func (p *parser) parseDelete() (*Statement, error) {
+	st := &Statement{Type: StatementDelete}
+	if err := p.parseFrom(st); err != nil {
+		return nil, err
+	}
+	if err := p.parseCondition(st); err != nil {
+		return nil, err
+	}
+	return st, nil
 }
 
-func getMeasurement(tokens []string) (m string) {
-	if len(tokens) >= 2 && strings.HasPrefix(tokens[1], ".") {
-		m = tokens[1]
-		m = m[1:]
-		if m[0] == '"' || m[0] == '\'' {
-			m = m[1 : len(m)-1]
+func (p *parser) parseDrop() (*Statement, error) {
+	st := &Statement{Type: StatementDrop}
+
+	kw, _ := p.acceptKeyword("series", "measurement")
+	switch kw {
+	case "series":
+		st.Type = StatementDropSeries
+		if err := p.parseFrom(st); err != nil {
+			return nil, err
+		}
+		if err := p.parseCondition(st); err != nil {
+			return nil, err
 		}
-		return
+		return st, nil
+	case "measurement":
+		st.Type = StatementDropMeasurement
+		name, err := p.parseIdent()
+		if err != nil {
+			return nil, err
+		}
+		st.Sources = []Source{&Measurement{Name: name}}
+		return st, nil
 	}
 
-	m = tokens[0]
-	if m[0] == '/' {
-		return m
+	return p.skipStatement(st)
+}
+
+func (p *parser) parseExpr() (Expr, error) {
+	return p.parseBinary(1)
+}
+
+// parseBinary parses operators of at least the given precedence.
+func (p *parser) parseBinary(prec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
 	}
 
-	if m[0] == '"' || m[0] == '\'' {
-		m = m[1 : len(m)-1]
-		return
+	for {
+		op := p.scan()
+		if op.tok.Precedence() < prec || op.tok.Precedence() == 0 {
+			p.unscan(op)
+			return lhs, nil
+		}
+
+		var rhs Expr
+		if op.tok == EQREGEX || op.tok == NEQREGEX {
+			if it := p.scanRegex(); it.tok == REGEX {
+				rhs = &RegexLiteral{Val: it.lit}
+			} else if it.tok == BADREGEX {
+				return nil, p.errorf(it)
+			}
+		}
+		if rhs == nil {
+			if rhs, err = p.parseBinary(op.tok.Precedence() + 1); err != nil {
+				return nil, err
+			}
+		}
+
+		lhs = &BinaryExpr{Op: op.tok, LHS: lhs, RHS: rhs}
 	}
+}
 
-	index := strings.IndexByte(m, '.')
-	if index == -1 {
-		return
+func (p *parser) parseUnary() (Expr, error) {
+	it := p.scan()
+	if it.tok != SUB && it.tok != ADD {
+		p.unscan(it)
+		return p.parsePrimary()
 	}
 
-	m = m[index+1:]
-	if m[0] == '"' || m[0] == '\'' {
-		m = m[1 : len(m)-1]
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
 	}
-	return
+	if it.tok == ADD {
+		return expr, nil
+	}
+
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		e.Val = -e.Val
+	case *IntegerLiteral:
+		e.Val = -e.Val
+	case *DurationLiteral:
+		e.Val = -e.Val
+	default:
+		return &BinaryExpr{Op: MUL, LHS: &IntegerLiteral{Val: -1}, RHS: expr}, nil
+	}
+	return expr, nil
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	it := p.scan()
+	switch it.tok {
+	case LPAREN:
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = p.expect(RPAREN); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: expr}, nil
+
+	case IDENT:
+		switch strings.ToLower(it.lit) {
+		case "true":
+			return &BooleanLiteral{Val: true}, nil
+		case "false":
+			return &BooleanLiteral{Val: false}, nil
+		case "distinct":
+			if p.peek().tok != LPAREN {
+				name, err := p.parseIdent()
+				if err != nil {
+					return nil, err
+				}
+				return &Call{Name: "distinct", Args: []Expr{&VarRef{Val: name}}}, nil
+			}
+		}
+		if next := p.scan(); next.tok == LPAREN {
+			return p.parseCall(it.lit)
+		} else {
+			p.unscan(next)
+		}
+		return p.parseVarRef(it.lit)
+
+	case QIDENT:
+		return p.parseVarRef(it.lit)
+
+	case MUL:
+		w := new(Wildcard)
+		if next := p.scan(); next.tok == DOUBLECOLON {
+			t, err := p.expect(IDENT)
+			if err != nil {
+				return nil, err
+			}
+			w.Type = strings.ToLower(t.lit)
+		} else {
+			p.unscan(next)
+		}
+		return w, nil
+
+	case STRING:
+		return &StringLiteral{Val: it.lit}, nil
+
+	case INTEGER:
+		n, err := strconv.ParseInt(it.lit, 10, 64)
+		if err != nil {
+			return nil, p.errorf(it, "integer")
+		}
+		return &IntegerLiteral{Val: n}, nil
+
+	case NUMBER:
+		f, err := strconv.ParseFloat(it.lit, 64)
+		if err != nil {
+			return nil, p.errorf(it, "number")
+		}
+		return &NumberLiteral{Val: f}, nil
+
+	case DURATION:
+		d, err := parseDuration(it.lit)
+		if err != nil {
+			return nil, p.errorf(it, "duration")
+		}
+		return &DurationLiteral{Val: d}, nil
+
+	case PARAM:
+		return &BoundParameter{Name: it.lit}, nil
+	}
+
+	return nil, p.errorf(it, "identifier", "string", "number", "bool")
+}
+
+func (p *parser) parseVarRef(name string) (Expr, error) {
+	ref := &VarRef{Val: name}
+	if next := p.scan(); next.tok == DOUBLECOLON {
+		t, err := p.expect(IDENT)
+		if err != nil {
+			return nil, err
+		}
+		ref.Type = strings.ToLower(t.lit)
+	} else {
+		p.unscan(next)
+	}
+	return ref, nil
+}
+
+func (p *parser) parseCall(name string) (Expr, error) {
+	call := &Call{Name: strings.ToLower(name)}
+
+	if it := p.scan(); it.tok == RPAREN {
+		return call, nil
+	} else {
+		p.unscan(it)
+	}
+
+	for {
+		var arg Expr
+		if it := p.scanRegex(); it.tok == REGEX {
+			arg = &RegexLiteral{Val: it.lit}
+		} else {
+			var err error
+			if arg, err = p.parseExpr(); err != nil {
+				return nil, err
+			}
+		}
+		call.Args = append(call.Args, arg)
+
+		it := p.scan()
+		if it.tok == RPAREN {
+			return call, nil
+		}
+		if it.tok != COMMA {
+			return nil, p.errorf(it, ",", ")")
+		}
+	}
+}
+
+// parseDuration parses InfluxQL durations such as 10m, 1h30m or 2w.
+func parseDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	for i := 0; i < len(s); {
+		j := i
+		for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+			j++
+		}
+		if j == i {
+			return 0, ErrIllegalQL
+		}
+		n, err := strconv.ParseInt(s[i:j], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		k := j
+		for k < len(s) && (s[k] < '0' || s[k] > '9') {
+			k++
+		}
+
+		var unit time.Duration
+		switch s[j:k] {
+		case "ns":
+			unit = time.Nanosecond
+		case "u", "µ":
+			unit = time.Microsecond
+		case "ms":
+			unit = time.Millisecond
+		case "s":
+			unit = time.Second
+		case "m":
+			unit = time.Minute
+		case "h":
+			unit = time.Hour
+		case "d":
+			unit = 24 * time.Hour
+		case "w":
+			unit = 7 * 24 * time.Hour
+		default:
+			return 0, ErrIllegalQL
+		}
+
+		d += time.Duration(n) * unit
+		i = k
+	}
+	return d, nil
+}
+
+// Measurements returns every source measurement of the statement,
+// including those of subqueries.
+func (st *Statement) Measurements() []*Measurement {
+	var ms []*Measurement
+	for _, s := range st.Sources {
+		switch s := s.(type) {
+		case *Measurement:
+			ms = append(ms, s)
+		case *SubQuery:
+			ms = append(ms, s.Statement.Measurements()...)
+		}
+	}
+	return ms
+}
+
+// AllMeasurements reports whether the statement may touch measurements
+// that can't be named up front: regex sources, or statements reading data
+// without a FROM clause.
+func (st *Statement) AllMeasurements() bool {
+	switch st.Type {
+	case StatementSelect, StatementDelete, StatementDropSeries, StatementDropMeasurement,
+		StatementShowMeasurements, StatementShowTagKeys, StatementShowTagValues,
+		StatementShowFieldKeys, StatementShowSeries, StatementShowCardinality:
+	default:
+		return false
+	}
+
+	ms := st.Measurements()
+	if len(ms) == 0 {
+		return true
+	}
+	for _, m := range ms {
+		if m.Regex != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// IsShow reports whether the statement is a SHOW statement.
+func (st *Statement) IsShow() bool {
+	switch st.Type {
+	case StatementShowMeasurements, StatementShowTagKeys, StatementShowTagValues,
+		StatementShowFieldKeys, StatementShowSeries, StatementShowCardinality,
+		StatementShowDatabases, StatementShowRetentionPolicies, StatementShow:
+		return true
+	}
+	return false
+}
+
+// HasWildcard reports whether a SELECT, or one of its subqueries, selects *.
+func (st *Statement) HasWildcard() bool {
+	for _, f := range st.Fields {
+		if _, ok := f.Expr.(*Wildcard); ok {
+			return true
+		}
+	}
+	for _, s := range st.Sources {
+		if sq, ok := s.(*SubQuery); ok && sq.Statement.HasWildcard() {
+			return true
+		}
+	}
+	return false
+}
+
+// TagValues returns the tags the WHERE clause pins to a single value.
+// A condition containing OR pins nothing.
+func (st *Statement) TagValues() map[string]string {
+	values := make(map[string]string)
+	conflicts := make(map[string]bool)
+
+	var or bool
+	walk(st.Condition, func(e Expr) {
+		be, ok := e.(*BinaryExpr)
+		if !ok {
+			return
+		}
+		if be.Op == OR {
+			or = true
+			return
+		}
+		if be.Op != EQ {
+			return
+		}
+
+		ref, ok := be.LHS.(*VarRef)
+		lit, ok2 := be.RHS.(*StringLiteral)
+		if !ok || !ok2 {
+			ref, ok = be.RHS.(*VarRef)
+			lit, ok2 = be.LHS.(*StringLiteral)
+			if !ok || !ok2 {
+				return
+			}
+		}
+
+		if v, dup := values[ref.Val]; dup && v != lit.Val {
+			conflicts[ref.Val] = true
+		}
+		values[ref.Val] = lit.Val
+	})
+
+	if or {
+		return nil
+	}
+	for k := range conflicts {
+		delete(values, k)
+	}
+	return values
+}
+
+// GetMeasurementFromInfluxQL returns the first source measurement of the
+// query, regex sources are returned as /regex/.
+func GetMeasurementFromInfluxQL(q string) (m string, err error) {
+	stmts, err := ParseInfluxQL(q)
+	if err != nil {
+		return "", err
+	}
+
+	for _, st := range stmts {
+		for _, ms := range st.Measurements() {
+			if ms.Regex != "" {
+				return (&RegexLiteral{Val: ms.Regex}).String(), nil
+			}
+			return ms.Name, nil
+		}
+	}
+
+	return "", ErrIllegalQL
 }
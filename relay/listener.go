@@ -0,0 +1,256 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// Points a listener writes at once (Default of batch-size)
+const DefaultListenerBatchSize = 1000
+
+var ErrListenerClosed = errors.New("listener closed")
+
+// listener is what the Graphite and OpenTSDB relays share: they read
+// lines from TCP connections or UDP datagrams, turn every line into a
+// point and write the points in batches through the cluster of an HTTP
+// relay, with consistency any.
+type listener struct {
+	kind string
+	name string
+	addr string
+
+	query     string
+	batchSize int
+
+	// parse turns a line into a point, nil points are skipped
+	parse func(line string) (models.Point, error)
+	// serveConn reads a TCP connection (Default readLines)
+	serveConn func(conn net.Conn)
+
+	ln net.Listener
+	pc net.PacketConn
+
+	closing int64
+	started int32
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	lock  sync.Mutex
+	conns map[net.Conn]struct{}
+
+	ic    *InfluxCluster
+	stats *listenerCounters
+}
+
+// newListener binds a listener of kind on network, "tcp" or "udp".
+func newListener(kind, name, network, addr, db, rp string, batchSize int, ic *InfluxCluster) (*listener, error) {
+	l := &listener{
+		kind:      kind,
+		name:      name,
+		addr:      addr,
+		batchSize: batchSize,
+		done:      make(chan struct{}),
+		conns:     make(map[net.Conn]struct{}),
+		ic:        ic,
+	}
+	if l.batchSize <= 0 {
+		l.batchSize = DefaultListenerBatchSize
+	}
+	if db == "" {
+		return nil, errors.New(l.Name() + ": missing database")
+	}
+
+	params := url.Values{"db": {db}}
+	if rp != "" {
+		params.Set("rp", rp)
+	}
+	l.query = params.Encode()
+
+	var local net.Addr
+	switch network {
+	case "", "tcp":
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		l.ln, local = ln, ln.Addr()
+	case "udp":
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		l.pc, local = pc, pc.LocalAddr()
+	default:
+		return nil, errors.New(l.Name() + ": invalid protocol " + network)
+	}
+
+	l.serveConn = func(conn net.Conn) { l.readLines(bufio.NewReader(conn)) }
+	l.stats = ic.addListener(l.Name(), kind, local.String())
+	return l, nil
+}
+
+func (l *listener) Name() string {
+	if l.name == "" {
+		return l.kind + "://" + l.addr
+	}
+	return l.name
+}
+
+func (l *listener) Run() error {
+	atomic.StoreInt32(&l.started, 1)
+	defer close(l.done)
+
+	if l.pc != nil {
+		log.Printf("Starting %s relay %q on udp %v", l.kind, l.Name(), l.pc.LocalAddr())
+		return l.readPackets()
+	}
+
+	log.Printf("Starting %s relay %q on %v", l.kind, l.Name(), l.ln.Addr())
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if atomic.LoadInt64(&l.closing) == 1 {
+				return nil
+			}
+			log.Printf("Error accepting connection in relay %q: %v\n", l.Name(), err)
+			continue
+		}
+
+		l.lock.Lock()
+		l.conns[conn] = struct{}{}
+		l.lock.Unlock()
+
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			defer l.closeConn(conn)
+			l.serveConn(conn)
+		}()
+	}
+}
+
+func (l *listener) closeConn(conn net.Conn) {
+	l.lock.Lock()
+	delete(l.conns, conn)
+	l.lock.Unlock()
+	conn.Close()
+}
+
+// readLines writes the lines of r in batches. A batch is written once it
+// is full or nothing more is buffered, so idle senders aren't held back.
+func (l *listener) readLines(r *bufio.Reader) {
+	var points []models.Point
+	for {
+		line, err := r.ReadString('\n')
+		points = l.add(points, line)
+		if err != nil {
+			break
+		}
+		if len(points) >= l.batchSize || r.Buffered() == 0 {
+			l.write(points)
+			points = nil
+		}
+	}
+	l.write(points)
+}
+
+func (l *listener) readPackets() error {
+	buf := make([]byte, UDPBufferSize)
+	for {
+		n, _, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			if atomic.LoadInt64(&l.closing) == 1 {
+				return nil
+			}
+			log.Printf("Error reading packet in relay %q: %v\n", l.Name(), err)
+			continue
+		}
+
+		var points []models.Point
+		for _, line := range bytes.Split(buf[:n], []byte{'\n'}) {
+			points = l.add(points, string(line))
+			if len(points) >= l.batchSize {
+				l.write(points)
+				points = nil
+			}
+		}
+		l.write(points)
+	}
+}
+
+// add parses a line and appends its point to points.
+func (l *listener) add(points []models.Point, line string) []models.Point {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return points
+	}
+	atomic.AddInt64(&l.stats.received, 1)
+	atomic.AddInt64(&l.stats.bytes, int64(len(line)+1))
+
+	p, err := l.parse(line)
+	if err != nil {
+		atomic.AddInt64(&l.stats.parseFail, 1)
+		log.Printf("unable to parse line in relay %q: %v\n", l.Name(), err)
+		return points
+	}
+	if p == nil {
+		return points
+	}
+	return append(points, p)
+}
+
+// write routes points, the writes to the backends run in the background.
+func (l *listener) write(points []models.Point) {
+	if len(points) == 0 {
+		return
+	}
+	atomic.AddInt64(&l.stats.points, int64(len(points)))
+
+	rw := l.ic.routePoints(points, "")
+	l.ic.async(func() {
+		if err := l.ic.writeRouted(rw, l.query, "", models.ConsistencyLevelAny); err != nil {
+			atomic.AddInt64(&l.stats.writeFail, 1)
+		}
+	})
+}
+
+// Stop closes the socket and the open connections.
+func (l *listener) Stop() error {
+	atomic.StoreInt64(&l.closing, 1)
+
+	var err error
+	if l.ln != nil {
+		err = l.ln.Close()
+	} else {
+		err = l.pc.Close()
+	}
+
+	l.lock.Lock()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.lock.Unlock()
+	return err
+}
+
+// Shutdown stops the listener once the lines already read are routed,
+// their writes are left to the shutdown of the HTTP relay.
+func (l *listener) Shutdown() error {
+	if err := l.Stop(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&l.started) == 1 {
+		<-l.done
+	}
+	l.wg.Wait()
+	return nil
+}
@@ -1,81 +1,405 @@
 package relay
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
 )
 
 type Result struct {
 	Results []*data `json:"results"`
+	Error   string  `json:"error,omitempty"`
 }
 
 type data struct {
-	StatementID int `json:"statement_id"`
-	Series      []*series
+	StatementID int       `json:"statement_id"`
+	Series      []*series `json:"series,omitempty"`
+	Partial     bool      `json:"partial,omitempty"`
+	Error       string    `json:"error,omitempty"`
 }
 
 type series struct {
-	Name    string          `json:"name"`
-	Columns []string        `json:"columns"`
-	Values  [][]interface{} `json:"values"`
+	Name    string            `json:"name"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Columns []string          `json:"columns"`
+	Values  [][]interface{}   `json:"values"`
+	Partial bool              `json:"partial,omitempty"`
 }
 
-// 合并查询结果
-func merge(n, o []byte) ([]byte, error) {
-	if len(n) == 0 {
-		return o, nil
+// decodeResult decodes the answer of a query keeping numbers as
+// json.Number, float64 can't hold nanosecond timestamps or integers above
+// 2^53 exactly.
+func decodeResult(p []byte, r *Result) error {
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.UseNumber()
+	return dec.Decode(r)
+}
+
+// id identifies a series by name and tags.
+func (s *series) id() string {
+	keys := make([]string, 0, len(s.Tags))
+	for k := range s.Tags {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
 
-	if len(o) == 0 {
-		return n, nil
+	id := s.Name
+	for _, k := range keys {
+		id += "," + k + "=" + s.Tags[k]
 	}
+	return id
+}
 
-	r1 := new(Result)
-	r2 := new(Result)
+// merge combines the results of the same query run on the current and the
+// former ring. Series are matched by name and tags and rows by time: cells
+// one side is missing are filled from the other, points only one side has
+// are added in time order. Errors and partial flags are kept.
+func merge(results ...[]byte) ([]byte, error) {
+	var r *Result
+	for _, p := range results {
+		if len(p) == 0 {
+			continue
+		}
 
-	err := json.Unmarshal(n, r1)
-	if err != nil {
-		return nil, err
+		ri := new(Result)
+		if err := decodeResult(p, ri); err != nil {
+			return nil, err
+		}
+		if r == nil {
+			r = ri
+			continue
+		}
+		mergeResult(r, ri)
 	}
 
-	err = json.Unmarshal(o, r2)
-	if err != nil {
-		return nil, err
+	if r == nil {
+		return nil, nil
+	}
+
+	sort.SliceStable(r.Results, func(i, j int) bool { return r.Results[i].StatementID < r.Results[j].StatementID })
+	return json.Marshal(r)
+}
+
+func mergeResult(r, o *Result) {
+	if r.Error == "" {
+		r.Error = o.Error
 	}
 
-	for _, v1 := range r1.Results {
-		for _, v2 := range r2.Results {
-			if v1.StatementID == v2.StatementID {
-				if len(v1.Series) == 0 || len(v2.Series) == 0 {
-					v1.Series = append(v1.Series, v2.Series...)
-				} else {
-					v1.Series[0].Values = mergeSlice(v1.Series[0].Values, v2.Series[0].Values)
+	for _, d := range o.Results {
+		var cur *data
+		for _, c := range r.Results {
+			if c.StatementID == d.StatementID {
+				cur = c
+				break
+			}
+		}
+		if cur == nil {
+			r.Results = append(r.Results, d)
+			continue
+		}
+
+		cur.Partial = cur.Partial || d.Partial
+		if cur.Error == "" {
+			cur.Error = d.Error
+		}
+
+		for _, s := range d.Series {
+			var cs *series
+			for _, c := range cur.Series {
+				if c.id() == s.id() {
+					cs = c
+					break
 				}
 			}
+			if cs == nil {
+				cur.Series = append(cur.Series, s)
+				continue
+			}
+			mergeSeries(cs, s)
 		}
 	}
+}
 
-	c, err := json.Marshal(r1)
-	if err != nil {
-		return nil, err
+// mergeSeries merges the rows of o into s. Rows sharing a timestamp are
+// paired in the order they appear, since a raw query can return several
+// points with the same time.
+func mergeSeries(s, o *series) {
+	s.Partial = s.Partial || o.Partial
+
+	idx := alignColumns(s, o.Columns)
+	rows := make([][]interface{}, len(o.Values))
+	for i, v := range o.Values {
+		rows[i] = alignRow(v, idx, len(s.Columns))
+	}
+
+	ti := columnIndex(s.Columns, "time")
+	if ti < 0 {
+		// no time to align on, keep the distinct rows
+		seen := make(map[string]bool)
+		for _, v := range s.Values {
+			seen[rowKey(v)] = true
+		}
+		for _, v := range rows {
+			if k := rowKey(v); !seen[k] {
+				seen[k] = true
+				s.Values = append(s.Values, v)
+			}
+		}
+		return
+	}
+
+	desc, ok := descending(s.Values, ti)
+	if !ok {
+		desc, _ = descending(rows, ti)
+	}
+
+	at := make(map[string][]int)
+	for i, v := range s.Values {
+		k := rowKey(v[ti : ti+1])
+		at[k] = append(at[k], i)
+	}
+
+	matched := make(map[string]int)
+	for _, v := range rows {
+		k := rowKey(v[ti : ti+1])
+		n := matched[k]
+		matched[k]++
+
+		if n < len(at[k]) {
+			row := s.Values[at[k][n]]
+			for j, x := range v {
+				if row[j] == nil {
+					row[j] = x
+				}
+			}
+			continue
+		}
+		s.Values = append(s.Values, v)
+	}
+
+	sort.SliceStable(s.Values, func(i, j int) bool {
+		if desc {
+			return timeLess(s.Values[j][ti], s.Values[i][ti])
+		}
+		return timeLess(s.Values[i][ti], s.Values[j][ti])
+	})
+}
+
+// alignColumns returns the position of each of columns in s, adding the
+// columns s lacks. The rows of s are padded to the new width.
+func alignColumns(s *series, columns []string) []int {
+	idx := make([]int, len(columns))
+	for i, c := range columns {
+		j := columnIndex(s.Columns, c)
+		if j < 0 {
+			s.Columns = append(s.Columns, c)
+			j = len(s.Columns) - 1
+		}
+		idx[i] = j
 	}
 
-	return c, nil
+	width := len(s.Columns)
+	for i, v := range s.Values {
+		for len(v) < width {
+			v = append(v, nil)
+		}
+		s.Values[i] = v
+	}
+	return idx
 }
 
-func mergeSlice(a, b [][]interface{}) [][]interface{} {
-	if len(a) != len(b) {
-		return a
+// alignRow moves the cells of a row to the positions returned by
+// alignColumns.
+func alignRow(v []interface{}, idx []int, width int) []interface{} {
+	row := make([]interface{}, width)
+	for j, x := range v {
+		if j < len(idx) {
+			row[idx[j]] = x
+		}
 	}
+	return row
+}
 
-	for ai, av := range a {
-		for bi, bv := range b {
-			if ai == bi && av[0] == bv[0] {
-				if av[1] == nil && bv[1] != nil {
-					av[1] = bv[1]
+func columnIndex(columns []string, c string) int {
+	for i, v := range columns {
+		if v == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// descending reports whether rows are in descending time order. ok is
+// false when the rows don't tell, e.g. with less than two timestamps.
+func descending(rows [][]interface{}, ti int) (desc, ok bool) {
+	for i := 1; i < len(rows); i++ {
+		a, b := rows[i-1][ti], rows[i][ti]
+		if timeLess(a, b) {
+			return false, true
+		}
+		if timeLess(b, a) {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// union combines the results of the same query run on several shards.
+// Series are matched by name and tags, their columns are aligned and
+// identical rows are dropped. Rows are sorted by time in the order of st,
+// or by value for SHOW results which have no time column, and the limits
+// of st are applied again since every shard applied them on its own. st
+// may be nil when there is nothing to apply.
+func union(st *Statement, results ...[]byte) ([]byte, error) {
+	r := new(Result)
+	statements := make(map[int]*data)
+	byID := make(map[int]map[string]*series)
+
+	for _, p := range results {
+		if len(p) == 0 {
+			continue
+		}
+
+		ri := new(Result)
+		if err := decodeResult(p, ri); err != nil {
+			return nil, err
+		}
+		if r.Error == "" {
+			r.Error = ri.Error
+		}
+
+		for _, d := range ri.Results {
+			cur, ok := statements[d.StatementID]
+			if !ok {
+				cur = &data{StatementID: d.StatementID}
+				statements[d.StatementID] = cur
+				byID[d.StatementID] = make(map[string]*series)
+				r.Results = append(r.Results, cur)
+			}
+			cur.Partial = cur.Partial || d.Partial
+			if cur.Error == "" {
+				cur.Error = d.Error
+			}
+
+			for _, s := range d.Series {
+				id := s.id()
+				cs, ok := byID[d.StatementID][id]
+				if !ok {
+					cs = &series{Name: s.Name, Tags: s.Tags}
+					byID[d.StatementID][id] = cs
+					cur.Series = append(cur.Series, cs)
+				}
+				cs.Partial = cs.Partial || s.Partial
+
+				idx := alignColumns(cs, s.Columns)
+				for _, v := range s.Values {
+					cs.Values = append(cs.Values, alignRow(v, idx, len(cs.Columns)))
 				}
 			}
 		}
 	}
 
-	return a
+	var desc bool
+	var limit, offset, slimit, soffset int
+	if st != nil {
+		desc = st.Descending
+		limit, offset = st.Limit, st.Offset
+		slimit, soffset = st.SLimit, st.SOffset
+	}
+
+	sort.Slice(r.Results, func(i, j int) bool { return r.Results[i].StatementID < r.Results[j].StatementID })
+	for _, d := range r.Results {
+		sort.SliceStable(d.Series, func(i, j int) bool { return d.Series[i].id() < d.Series[j].id() })
+		lo, hi := window(len(d.Series), soffset, slimit)
+		d.Series = d.Series[lo:hi]
+
+		for _, s := range d.Series {
+			s.Values = distinctRows(s.Values)
+			if ti := columnIndex(s.Columns, "time"); ti >= 0 {
+				sort.SliceStable(s.Values, func(i, j int) bool {
+					if desc {
+						return timeLess(s.Values[j][ti], s.Values[i][ti])
+					}
+					return timeLess(s.Values[i][ti], s.Values[j][ti])
+				})
+			} else {
+				sort.SliceStable(s.Values, func(i, j int) bool {
+					return rowKey(s.Values[i]) < rowKey(s.Values[j])
+				})
+			}
+			lo, hi := window(len(s.Values), offset, limit)
+			s.Values = s.Values[lo:hi]
+		}
+	}
+
+	return json.Marshal(r)
+}
+
+// distinctRows drops the rows identical to an earlier one.
+func distinctRows(rows [][]interface{}) [][]interface{} {
+	seen := make(map[string]bool)
+	var list [][]interface{}
+	for _, v := range rows {
+		if k := rowKey(v); !seen[k] {
+			seen[k] = true
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func rowKey(v []interface{}) string {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(p)
+}
+
+// timeLess compares two values of a time column, which are either
+// RFC3339 strings or epoch numbers depending on the query.
+func timeLess(a, b interface{}) bool {
+	switch at := a.(type) {
+	case json.Number, float64:
+		an, _ := number(at)
+		if bn, ok := number(b); ok {
+			return numberLess(an, bn)
+		}
+	case string:
+		if bt, ok := b.(string); ok {
+			ta, erra := time.Parse(time.RFC3339Nano, at)
+			tb, errb := time.Parse(time.RFC3339Nano, bt)
+			if erra == nil && errb == nil {
+				return ta.Before(tb)
+			}
+			return at < bt
+		}
+	}
+	return false
+}
+
+// number returns a number of a result as a json.Number.
+func number(v interface{}) (json.Number, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		return n, true
+	case float64:
+		return json.Number(strconv.FormatFloat(n, 'f', -1, 64)), true
+	}
+	return "", false
+}
+
+// numberLess compares two numbers, exactly when both are integers.
+func numberLess(a, b json.Number) bool {
+	if ai, err := a.Int64(); err == nil {
+		if bi, err := b.Int64(); err == nil {
+			return ai < bi
+		}
+	}
+	af, _ := a.Float64()
+	bf, _ := b.Float64()
+	return af < bf
 }
@@ -1,7 +1,9 @@
 package relay
 
 import (
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -109,3 +111,145 @@ func TestMerge(t *testing.T) {
 	fmt.Println(string(da))
 
 }
+
+func TestMergeSeries(t *testing.T) {
+	// current ring has host a and half of the fields, the former ring the
+	// rest of the points from before the expansion
+	cur := `{"results":[{"statement_id":0,"series":[` +
+		`{"name":"cpu","tags":{"host":"a"},"columns":["time","user","system"],"values":[["2018-01-01T00:00:02Z",2,null],["2018-01-01T00:00:03Z",3,30]]}` +
+		`]}]}`
+	old := `{"results":[{"statement_id":0,"series":[` +
+		`{"name":"cpu","tags":{"host":"a"},"columns":["time","system","user"],"values":[["2018-01-01T00:00:01Z",10,1],["2018-01-01T00:00:02Z",20,null]]},` +
+		`{"name":"cpu","tags":{"host":"b"},"columns":["time","user","system"],"values":[["2018-01-01T00:00:01Z",5,50]],"partial":true}` +
+		`],"partial":true}]}`
+
+	p, err := merge([]byte(cur), []byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := new(Result)
+	if err := json.Unmarshal(p, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Results) != 1 || !r.Results[0].Partial {
+		t.Fatalf("partial flag lost: %s", p)
+	}
+
+	s := r.Results[0].Series
+	if len(s) != 2 || s[0].Tags["host"] != "a" || s[1].Tags["host"] != "b" || !s[1].Partial {
+		t.Fatalf("series not matched by tags: %s", p)
+	}
+
+	expected := [][]interface{}{
+		{"2018-01-01T00:00:01Z", float64(1), float64(10)},
+		{"2018-01-01T00:00:02Z", float64(2), float64(20)},
+		{"2018-01-01T00:00:03Z", float64(3), float64(30)},
+	}
+	if !reflect.DeepEqual(s[0].Values, expected) {
+		t.Errorf("rows not aligned by time: %s", p)
+	}
+
+	// descending results stay descending
+	desc := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","v"],"values":[[3,3],[1,1]]}]}]}`
+	more := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","v"],"values":[[2,2]]}]}]}`
+	p, err = merge([]byte(desc), []byte(more))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = new(Result)
+	if err := json.Unmarshal(p, r); err != nil {
+		t.Fatal(err)
+	}
+	expected = [][]interface{}{{float64(3), float64(3)}, {float64(2), float64(2)}, {float64(1), float64(1)}}
+	if !reflect.DeepEqual(r.Results[0].Series[0].Values, expected) {
+		t.Errorf("order not kept: %s", p)
+	}
+
+	// errors are reported
+	failed := `{"results":[{"statement_id":0,"error":"database not found: test"}]}`
+	p, err = merge([]byte(failed), []byte(more))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = new(Result)
+	if err := json.Unmarshal(p, r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Results[0].Error == "" {
+		t.Errorf("error dropped: %s", p)
+	}
+}
+
+func TestUnion(t *testing.T) {
+	a := `{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["mem"],["cpu"]]}]}]}`
+	b := `{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"],["disk"]]}]}]}`
+
+	p, err := union(nil, []byte(a), []byte(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := new(Result)
+	if err := json.Unmarshal(p, r); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]interface{}{{"cpu"}, {"disk"}, {"mem"}}
+	if len(r.Results) != 1 || len(r.Results[0].Series) != 1 || !reflect.DeepEqual(r.Results[0].Series[0].Values, expected) {
+		t.Errorf("show results not deduplicated: %s", p)
+	}
+
+	c := `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[["2018-01-01T00:00:02Z",2]]}]}]}`
+	d := `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[["2018-01-01T00:00:01.5Z",1]]},{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[["2018-01-01T00:00:01Z",3]]}]}]}`
+
+	p, err = union(nil, []byte(c), []byte(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = new(Result)
+	if err := json.Unmarshal(p, r); err != nil {
+		t.Fatal(err)
+	}
+	s := r.Results[0].Series
+	if len(s) != 2 || s[0].Tags["host"] != "a" || len(s[0].Values) != 2 || s[0].Values[0][1] != float64(1) {
+		t.Errorf("series not combined by tags: %s", p)
+	}
+
+	// a field only some shards have is a column of its own
+	e := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","a"],"values":[[1,1]]}]}]}`
+	f := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","b"],"values":[[2,2]]}]}]}`
+
+	p, err = union(nil, []byte(e), []byte(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aligned := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","a","b"],"values":[[1,1,null],[2,null,2]]}]}]}`
+	if string(p) != aligned {
+		t.Errorf("columns not aligned:\n%s\n%s", p, aligned)
+	}
+}
+
+func TestMergeExactNumbers(t *testing.T) {
+	// epoch=ns times 1ns apart and integers above 2^53 don't fit a float64
+	cur := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","v"],"values":[[1514764800000000001,9007199254740993]]}]}]}`
+	old := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","v"],"values":[[1514764800000000000,1],[1514764800000000002,9007199254740995]]}]}]}`
+
+	expected := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","v"],"values":[[1514764800000000000,1],[1514764800000000001,9007199254740993],[1514764800000000002,9007199254740995]]}]}]}`
+
+	p, err := merge([]byte(cur), []byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != expected {
+		t.Errorf("merge changed the rows:\n%s\n%s", p, expected)
+	}
+
+	p, err = union(nil, []byte(cur), []byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != expected {
+		t.Errorf("union changed the rows:\n%s\n%s", p, expected)
+	}
+}
@@ -0,0 +1,326 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are exposed on /metrics in the Prometheus text format. The
+// handful of counters and histograms the relay needs are kept here rather
+// than pulling in the Prometheus client.
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metrics struct {
+	relay string
+
+	requests        *counterVec
+	requestDuration *histogramVec
+	backendRequests *counterVec
+	backendDuration *histogramVec
+	backendPoints   *counterVec
+}
+
+func newMetrics(relay string) *metrics {
+	backend := []string{"ring", "shard", "backend"}
+	return &metrics{
+		relay: relay,
+
+		requests: newCounterVec("influxdb_relay_requests_total",
+			"HTTP requests handled by the relay.", "endpoint", "code"),
+		requestDuration: newHistogramVec("influxdb_relay_request_duration_seconds",
+			"Time taken to handle HTTP requests.", "endpoint"),
+		backendRequests: newCounterVec("influxdb_relay_backend_requests_total",
+			"Requests sent to the backends, code is \"error\" when no response was received.",
+			append(backend, "op", "code")...),
+		backendDuration: newHistogramVec("influxdb_relay_backend_request_duration_seconds",
+			"Time taken by the backends to answer.", append(backend, "op")...),
+		backendPoints: newCounterVec("influxdb_relay_backend_points_total",
+			"Points written to the backends by result, ok or fail.", append(backend, "result")...),
+	}
+}
+
+// backend returns the metrics of a backend of a shard.
+func (m *metrics) backend(ring, shard, name string) *backendMetrics {
+	if m == nil {
+		return nil
+	}
+	if ring == "" {
+		ring = "current"
+	}
+	return &backendMetrics{m: m, labels: []string{ring, shard, name}}
+}
+
+// backendMetrics records the requests of one backend.
+type backendMetrics struct {
+	m      *metrics
+	labels []string
+}
+
+func (bm *backendMetrics) request(op string, start time.Time, code int, err error) {
+	if bm == nil {
+		return
+	}
+	c := "error"
+	if err == nil {
+		c = strconv.Itoa(code)
+	}
+	bm.m.backendRequests.add(1, append(bm.labels[:3:3], op, c)...)
+	bm.m.backendDuration.observe(time.Since(start).Seconds(), append(bm.labels[:3:3], op)...)
+}
+
+func (bm *backendMetrics) points(n int, ok bool) {
+	if bm == nil {
+		return
+	}
+	result := "ok"
+	if !ok {
+		result = "fail"
+	}
+	bm.m.backendPoints.add(int64(n), append(bm.labels[:3:3], result)...)
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	lock   sync.Mutex
+	series map[string]*counter
+}
+
+type counter struct {
+	values []string
+	n      int64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, series: make(map[string]*counter)}
+}
+
+func (c *counterVec) add(n int64, values ...string) {
+	key := strings.Join(values, "\xff")
+	c.lock.Lock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counter{values: values}
+		c.series[key] = s
+	}
+	s.n += n
+	c.lock.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer, relay string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	keys := make([]string, 0, len(c.series))
+	for k := range c.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range keys {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %d\n", c.name, labelString(relay, c.labels, s.values), s.n)
+	}
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	values []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: defaultBuckets,
+		series:  make(map[string]*histogram),
+	}
+}
+
+func (hv *histogramVec) observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	hv.lock.Lock()
+	h, ok := hv.series[key]
+	if !ok {
+		h = &histogram{values: values, counts: make([]uint64, len(hv.buckets))}
+		hv.series[key] = h
+	}
+	for i, b := range hv.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+	hv.lock.Unlock()
+}
+
+func (hv *histogramVec) write(w io.Writer, relay string) {
+	hv.lock.Lock()
+	defer hv.lock.Unlock()
+
+	keys := make([]string, 0, len(hv.series))
+	for k := range hv.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	writeHeader(w, hv.name, hv.help, "histogram")
+	labels := append(hv.labels[:len(hv.labels):len(hv.labels)], "le")
+	for _, key := range keys {
+		h := hv.series[key]
+		values := append(h.values[:len(h.values):len(h.values)], "")
+		for i, b := range hv.buckets {
+			values[len(values)-1] = strconv.FormatFloat(b, 'g', -1, 64)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, labelString(relay, labels, values), h.counts[i])
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, labelString(relay, labels, values), h.count)
+
+		ls := labelString(relay, hv.labels, h.values)
+		fmt.Fprintf(w, "%s_sum%s %s\n", hv.name, ls, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.name, ls, h.count)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func labelString(relay string, names, values []string) string {
+	var buf bytes.Buffer
+	buf.WriteString(`{relay="`)
+	buf.WriteString(escapeLabel(relay))
+	buf.WriteByte('"')
+	for i, n := range names {
+		buf.WriteByte(',')
+		buf.WriteString(n)
+		buf.WriteString(`="`)
+		buf.WriteString(escapeLabel(values[i]))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// statusRecorder keeps the status code a handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// ServeHTTP serves the relay's endpoints, counting requests by endpoint
+// and status code.
+func (h *HTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+
+	handler, endpoint := h.mux.Handler(req)
+	if endpoint == "" {
+		endpoint = "other"
+	}
+	handler.ServeHTTP(rec, req)
+
+	m := h.ic.metrics
+	m.requests.add(1, endpoint, strconv.Itoa(rec.code))
+	m.requestDuration.observe(time.Since(start).Seconds(), endpoint)
+}
+
+// HandlerMetrics exposes the metrics in the Prometheus text format, with
+// gauges for the health and retry buffers of every backend.
+func (h *HTTP) HandlerMetrics(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid method")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	m := h.ic.metrics
+	m.requests.write(bw, m.relay)
+	m.requestDuration.write(bw, m.relay)
+	m.backendRequests.write(bw, m.relay)
+	m.backendDuration.write(bw, m.relay)
+	m.backendPoints.write(bw, m.relay)
+
+	type gauge struct {
+		labels   []string
+		up       int
+		state    int
+		bytes    int64
+		dropped  int64
+		rejected int64
+	}
+	var gauges []gauge
+	for _, s := range h.ic.backendStatistics() {
+		g := gauge{labels: []string{s.Ring, s.Shard, s.Backend}, bytes: s.BufferedBytes, dropped: s.DroppedBytes, rejected: s.Rejected}
+		if s.Active {
+			g.up = 1
+		}
+		if s.Buffering {
+			g.state = 1
+		}
+		gauges = append(gauges, g)
+	}
+
+	labels := []string{"ring", "shard", "backend"}
+	writeHeader(bw, "influxdb_relay_backend_up", "Whether the backend answered its last ping.", "gauge")
+	for _, g := range gauges {
+		fmt.Fprintf(bw, "influxdb_relay_backend_up%s %d\n", labelString(m.relay, labels, g.labels), g.up)
+	}
+	writeHeader(bw, "influxdb_relay_backend_buffering", "Whether writes to the backend go through its retry buffer.", "gauge")
+	for _, g := range gauges {
+		fmt.Fprintf(bw, "influxdb_relay_backend_buffering%s %d\n", labelString(m.relay, labels, g.labels), g.state)
+	}
+	writeHeader(bw, "influxdb_relay_backend_buffer_bytes", "Size of the writes waiting in the retry buffer or wal of the backend.", "gauge")
+	for _, g := range gauges {
+		fmt.Fprintf(bw, "influxdb_relay_backend_buffer_bytes%s %d\n", labelString(m.relay, labels, g.labels), g.bytes)
+	}
+	writeHeader(bw, "influxdb_relay_backend_dropped_bytes_total", "Writes the retry buffer of the backend had to drop.", "counter")
+	for _, g := range gauges {
+		fmt.Fprintf(bw, "influxdb_relay_backend_dropped_bytes_total%s %d\n", labelString(m.relay, labels, g.labels), g.dropped)
+	}
+	writeHeader(bw, "influxdb_relay_backend_rejected_lines_total", "Lines the backend rejected for good, see dead-letter-file.", "counter")
+	for _, g := range gauges {
+		fmt.Fprintf(bw, "influxdb_relay_backend_rejected_lines_total%s %d\n", labelString(m.relay, labels, g.labels), g.rejected)
+	}
+}
@@ -0,0 +1,57 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	r, err := NewHTTP(HTTPConfig{
+		Name:             "test",
+		Replicas:         10,
+		WriteConsistency: "all",
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {
+				{Name: "a1", Location: ts.URL},
+				{Name: "a2", Location: "http://127.0.0.1:1", Timeout: "100ms"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := r.(*HTTP)
+	defer h.ic.Close()
+
+	req := httptest.NewRequest("POST", "/write?db=test", strings.NewReader("cpu value=1\ncpu value=2\n"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	code := strconv.Itoa(w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	for _, want := range []string{
+		`influxdb_relay_requests_total{relay="test",endpoint="/write",code="` + code + `"} 1`,
+		`influxdb_relay_backend_requests_total{relay="test",ring="current",shard="a",backend="a1",op="write",code="204"} 1`,
+		`influxdb_relay_backend_requests_total{relay="test",ring="current",shard="a",backend="a2",op="write",code="error"} 1`,
+		`influxdb_relay_backend_points_total{relay="test",ring="current",shard="a",backend="a1",result="ok"} 2`,
+		`influxdb_relay_backend_points_total{relay="test",ring="current",shard="a",backend="a2",result="fail"} 2`,
+		`influxdb_relay_backend_request_duration_seconds_bucket{relay="test",ring="current",shard="a",backend="a1",op="write",le="+Inf"} 1`,
+		`influxdb_relay_backend_up{relay="test",ring="current",shard="a",backend="a1"} 1`,
+		`# TYPE influxdb_relay_backend_buffer_bytes gauge`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
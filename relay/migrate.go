@@ -0,0 +1,707 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	DefaultMigrateChunk      = time.Hour
+	DefaultMigrateCheckpoint = "migrate.json"
+
+	// lines per write request of a migration
+	migrateBatchLines = 5000
+	// rows per series read by one query of a chunk
+	migratePageRows = 10000
+)
+
+var (
+	ErrNoFormer         = errors.New("no former ring configured")
+	ErrMigrationRunning = errors.New("migration already running")
+	ErrMigrationStopped = errors.New("migration stopped")
+)
+
+// Migration states.
+const (
+	MigrationPending = "pending"
+	MigrationRunning = "running"
+	MigrationDone    = "done"
+	MigrationFailed  = "failed"
+)
+
+// MigrationStatus is the progress of one measurement of a former shard.
+// Points before Next have been copied to the current ring. To is "*" when
+// the points are routed by a shard key with tags.
+type MigrationStatus struct {
+	Database        string `json:"database"`
+	RetentionPolicy string `json:"retention_policy"`
+	Measurement     string `json:"measurement"`
+	From            string `json:"from"`
+	To              string `json:"to"`
+	State           string `json:"state"`
+	Start           int64  `json:"start"`
+	End             int64  `json:"end"`
+	Next            int64  `json:"next"`
+	Points          int64  `json:"points"`
+	Error           string `json:"error,omitempty"`
+}
+
+func (s *MigrationStatus) key() string {
+	return s.From + ":" + s.Database + "." + s.RetentionPolicy + "." + s.Measurement
+}
+
+// Migrator copies the measurements whose owner changed with an expansion
+// from the former ring to the current one, so the former backends can be
+// retired. Data is read in time chunks and progress is kept in a
+// checkpoint file, a restarted migration resumes where it stopped.
+type Migrator struct {
+	ic         *InfluxCluster
+	chunk      time.Duration
+	checkpoint string
+	databases  []string
+	username   string
+	password   string
+
+	lock    sync.Mutex
+	running bool
+	status  map[string]*MigrationStatus
+
+	// closed by Stop, a new one is made for every run
+	stop chan struct{}
+}
+
+func NewMigrator(ic *InfluxCluster, cfg HTTPConfig) (*Migrator, error) {
+	m := &Migrator{
+		ic:         ic,
+		chunk:      DefaultMigrateChunk,
+		checkpoint: DefaultMigrateCheckpoint,
+		databases:  cfg.MigrateDatabases,
+		username:   cfg.MigrateUsername,
+		password:   cfg.MigratePassword,
+		status:     make(map[string]*MigrationStatus),
+	}
+
+	if cfg.MigrateChunk != "" {
+		d, err := time.ParseDuration(cfg.MigrateChunk)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing migrate chunk '%v'", err)
+		}
+		m.chunk = d
+	}
+	if cfg.MigrateCheckpoint != "" {
+		m.checkpoint = cfg.MigrateCheckpoint
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Migrate runs the migration of every HTTP relay with a former ring in the
+// foreground, as done by the migrate subcommand. Writes are not buffered,
+// so the checkpoint only covers points the new owners accepted.
+func Migrate(config Config, stop <-chan struct{}) error {
+	var failed error
+	for _, cfg := range config.HTTPRelays {
+		if cfg.Former == nil {
+			continue
+		}
+
+		for _, outputs := range []map[string][]HTTPOutputConfig{cfg.Outputs, cfg.Former} {
+			for _, list := range outputs {
+				for i := range list {
+					list[i].BufferSizeMB = 0
+					list[i].WALDir = ""
+				}
+			}
+		}
+
+		ic, err := NewInfluxCluster(cfg)
+		if err != nil {
+			return err
+		}
+		m, err := NewMigrator(ic, cfg)
+		if err != nil {
+			ic.Close()
+			return err
+		}
+
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-stop:
+				m.Stop()
+			case <-done:
+			}
+		}()
+
+		err = m.Run()
+		close(done)
+		ic.Close()
+
+		if err == ErrMigrationStopped {
+			return err
+		}
+		if err != nil {
+			log.Printf("migrate relay %q: %s\n", cfg.Name, err)
+			failed = err
+		}
+	}
+	return failed
+}
+
+// load reads the checkpoint file, a missing file is an empty checkpoint.
+func (m *Migrator) load() error {
+	p, err := ioutil.ReadFile(m.checkpoint)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []*MigrationStatus
+	if err := json.Unmarshal(p, &list); err != nil {
+		return fmt.Errorf("error parsing migrate checkpoint '%v'", err)
+	}
+	for _, s := range list {
+		// interrupted while running
+		if s.State == MigrationRunning {
+			s.State = MigrationPending
+		}
+		m.status[s.key()] = s
+	}
+	return nil
+}
+
+// save writes the checkpoint file, replacing it atomically.
+func (m *Migrator) save() error {
+	p, err := json.MarshalIndent(m.Status(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.checkpoint), 0755); err != nil {
+		return err
+	}
+
+	tmp := m.checkpoint + ".tmp"
+	if err := ioutil.WriteFile(tmp, p, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.checkpoint)
+}
+
+// Status returns the progress of every known measurement.
+func (m *Migrator) Status() []*MigrationStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	list := make([]*MigrationStatus, 0, len(m.status))
+	for _, s := range m.status {
+		c := *s
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].key() < list[j].key() })
+	return list
+}
+
+func (m *Migrator) Running() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.running
+}
+
+// Start runs the migration in the background.
+func (m *Migrator) Start() error {
+	if m.ic.routing().former == nil {
+		return ErrNoFormer
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.running {
+		return ErrMigrationRunning
+	}
+	m.running = true
+	stop := make(chan struct{})
+	m.stop = stop
+
+	go func() {
+		if err := m.run(stop); err != nil {
+			log.Printf("migration failed: %s\n", err)
+		}
+	}()
+	return nil
+}
+
+// Run migrates every measurement and returns when done. It returns an
+// error if a measurement couldn't be migrated.
+func (m *Migrator) Run() error {
+	if m.ic.routing().former == nil {
+		return ErrNoFormer
+	}
+
+	m.lock.Lock()
+	if m.running {
+		m.lock.Unlock()
+		return ErrMigrationRunning
+	}
+	m.running = true
+	stop := make(chan struct{})
+	m.stop = stop
+	m.lock.Unlock()
+
+	return m.run(stop)
+}
+
+// Stop interrupts a running migration after the current chunk.
+func (m *Migrator) Stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.stop != nil && !stopped(m.stop) {
+		close(m.stop)
+	}
+}
+
+func stopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *Migrator) run(stop chan struct{}) error {
+	defer func() {
+		m.lock.Lock()
+		m.running = false
+		m.lock.Unlock()
+	}()
+
+	if err := m.discover(); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, s := range m.Status() {
+		if stopped(stop) {
+			return ErrMigrationStopped
+		}
+		if s.State == MigrationDone {
+			continue
+		}
+
+		err := m.migrate(s.key(), stop)
+		if err == ErrMigrationStopped {
+			return err
+		}
+		if err != nil {
+			log.Printf("migrate %s error: %s\n", s.key(), err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d measurements failed to migrate", failed)
+	}
+	return nil
+}
+
+// discover adds the measurements of the former ring that have a new owner.
+func (m *Migrator) discover() error {
+	for _, shard := range m.ic.shardNames(true) {
+		dbs := m.databases
+		if len(dbs) == 0 {
+			r, err := m.query(shard, "", "SHOW DATABASES")
+			if err != nil {
+				return err
+			}
+			for _, v := range firstColumn(r) {
+				if v != "_internal" {
+					dbs = append(dbs, v)
+				}
+			}
+		}
+
+		rt := m.ic.routing()
+		for _, db := range dbs {
+			r, err := m.query(shard, db, "SHOW RETENTION POLICIES ON "+quoteIdent(db))
+			if err != nil {
+				return err
+			}
+			rps := firstColumn(r)
+
+			r, err = m.query(shard, db, "SHOW MEASUREMENTS")
+			if err != nil {
+				return err
+			}
+
+			for _, name := range firstColumn(r) {
+				// with tags in the shard key the points of a measurement
+				// are spread over the shards and routed one by one
+				to := "*"
+				if rt.key.MeasurementOnly() {
+					to = rt.ring.Get(name)
+					if rt.former.Get(name) != shard || to == shard {
+						continue
+					}
+				}
+
+				for _, rp := range rps {
+					s := &MigrationStatus{
+						Database:        db,
+						RetentionPolicy: rp,
+						Measurement:     name,
+						From:            shard,
+						To:              to,
+						State:           MigrationPending,
+					}
+					m.lock.Lock()
+					if _, ok := m.status[s.key()]; !ok {
+						m.status[s.key()] = s
+					}
+					m.lock.Unlock()
+				}
+			}
+		}
+	}
+
+	return m.save()
+}
+
+// update changes the status of a measurement and saves the checkpoint.
+func (m *Migrator) update(key string, fn func(s *MigrationStatus)) {
+	m.lock.Lock()
+	fn(m.status[key])
+	m.lock.Unlock()
+
+	if err := m.save(); err != nil {
+		log.Printf("save migrate checkpoint error: %s\n", err)
+	}
+}
+
+func (m *Migrator) migrate(key string, stop chan struct{}) error {
+	m.lock.Lock()
+	s := *m.status[key]
+	m.lock.Unlock()
+
+	fail := func(err error) error {
+		m.update(key, func(s *MigrationStatus) {
+			s.State = MigrationFailed
+			s.Error = err.Error()
+		})
+		return err
+	}
+
+	from := quoteIdent(s.Database) + "." + quoteIdent(s.RetentionPolicy) + "." + quoteIdent(s.Measurement)
+
+	if s.Start == 0 && s.End == 0 {
+		start, err := m.pointTime(s.From, s.Database, "SELECT * FROM "+from+" ORDER BY time ASC LIMIT 1")
+		if err != nil {
+			return fail(err)
+		}
+		end, err := m.pointTime(s.From, s.Database, "SELECT * FROM "+from+" ORDER BY time DESC LIMIT 1")
+		if err != nil {
+			return fail(err)
+		}
+		s.Start, s.End, s.Next = start, end, start
+	}
+
+	types, err := m.fieldTypes(s.From, s.Database, from)
+	if err != nil {
+		return fail(err)
+	}
+
+	m.update(key, func(st *MigrationStatus) {
+		st.Start, st.End, st.Next = s.Start, s.End, s.Next
+		st.State = MigrationRunning
+		st.Error = ""
+	})
+
+	query := url.Values{"db": {s.Database}, "rp": {s.RetentionPolicy}, "precision": {"ns"}}.Encode()
+	auth := m.auth()
+
+	for next := s.Next; next <= s.End; next += int64(m.chunk) {
+		if stopped(stop) {
+			m.update(key, func(s *MigrationStatus) { s.State = MigrationPending })
+			return ErrMigrationStopped
+		}
+
+		points, err := m.copyChunk(s.From, s.Database, from, next, next+int64(m.chunk), types, query, auth)
+		if err != nil {
+			return fail(err)
+		}
+
+		done := next + int64(m.chunk)
+		m.update(key, func(s *MigrationStatus) {
+			s.Next = done
+			s.Points += points
+		})
+	}
+
+	m.update(key, func(s *MigrationStatus) { s.State = MigrationDone })
+	log.Printf("migrated %s from %s to %s\n", key, s.From, s.To)
+	return nil
+}
+
+// copyChunk copies the points of a measurement in [start, end) page by
+// page, LIMIT and OFFSET apply to each series. A chunk that fails part way
+// is copied again from its start, rewriting a point is harmless.
+func (m *Migrator) copyChunk(shard, db, from string, start, end int64, types map[string]string, query, auth string) (int64, error) {
+	var points int64
+	for offset := 0; ; offset += migratePageRows {
+		q := fmt.Sprintf("SELECT * FROM %s WHERE time >= %d AND time < %d GROUP BY * LIMIT %d OFFSET %d",
+			from, start, end, migratePageRows, offset)
+		r, err := m.query(shard, db, q)
+		if err != nil {
+			return points, err
+		}
+
+		lines, err := toLines(r, types)
+		if err != nil {
+			return points, err
+		}
+
+		for i := 0; i < len(lines); i += migrateBatchLines {
+			j := i + migrateBatchLines
+			if j > len(lines) {
+				j = len(lines)
+			}
+			p := bytes.Join(lines[i:j], nil)
+			if err := m.ic.Write(p, query, auth, models.ConsistencyLevelAll); err != nil {
+				return points, err
+			}
+		}
+		points += int64(len(lines))
+
+		more := false
+		for _, d := range r.Results {
+			for _, s := range d.Series {
+				more = more || len(s.Values) >= migratePageRows
+			}
+		}
+		if !more {
+			return points, nil
+		}
+	}
+}
+
+func (m *Migrator) auth() string {
+	if m.username == "" {
+		return ""
+	}
+	req := &http.Request{Header: make(http.Header)}
+	req.SetBasicAuth(m.username, m.password)
+	return req.Header.Get("Authorization")
+}
+
+// query runs q against the first active backend of a former shard that
+// answers it.
+func (m *Migrator) query(shard, db, q string) (*Result, error) {
+	backends := m.ic.formerBackends(shard)
+
+	var lastErr = ErrBackendInactive
+	for _, hb := range backends {
+		if !hb.queryable() {
+			continue
+		}
+
+		req, err := http.NewRequest("GET", hb.Location+"/query", nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Form = url.Values{"q": {q}, "epoch": {"ns"}}
+		if db != "" {
+			req.Form.Set("db", db)
+		}
+		if auth := m.auth(); auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+
+		resp, err := hb.Query(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		p, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("%s: status %d: %s", hb.name, resp.StatusCode, bytes.TrimSpace(p))
+			continue
+		}
+
+		r := new(Result)
+		dec := json.NewDecoder(bytes.NewReader(p))
+		dec.UseNumber()
+		if err := dec.Decode(r); err != nil {
+			return nil, err
+		}
+		if r.Error != "" {
+			return nil, errors.New(r.Error)
+		}
+		for _, d := range r.Results {
+			if d.Error != "" {
+				return nil, errors.New(d.Error)
+			}
+			// the backend cut the answer short, e.g. at max-row-limit
+			partial := d.Partial
+			for _, s := range d.Series {
+				partial = partial || s.Partial
+			}
+			if partial {
+				return nil, fmt.Errorf("%s: partial result for %s", hb.name, q)
+			}
+		}
+		return r, nil
+	}
+
+	return nil, lastErr
+}
+
+// pointTime returns the time of the point selected by q.
+func (m *Migrator) pointTime(shard, db, q string) (int64, error) {
+	r, err := m.query(shard, db, q)
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range r.Results {
+		for _, s := range d.Series {
+			for _, v := range s.Values {
+				if n, ok := v[0].(json.Number); ok {
+					return n.Int64()
+				}
+			}
+		}
+	}
+	return 0, nil
+}
+
+// fieldTypes returns the type of every field of a measurement.
+func (m *Migrator) fieldTypes(shard, db, from string) (map[string]string, error) {
+	r, err := m.query(shard, db, "SHOW FIELD KEYS FROM "+from)
+	if err != nil {
+		return nil, err
+	}
+
+	types := make(map[string]string)
+	for _, d := range r.Results {
+		for _, s := range d.Series {
+			for _, v := range s.Values {
+				if len(v) < 2 {
+					continue
+				}
+				k, _ := v[0].(string)
+				t, _ := v[1].(string)
+				types[k] = t
+			}
+		}
+	}
+	return types, nil
+}
+
+// firstColumn returns the first column of every row of a SHOW result.
+func firstColumn(r *Result) []string {
+	var list []string
+	for _, d := range r.Results {
+		for _, s := range d.Series {
+			for _, v := range s.Values {
+				if len(v) > 0 {
+					if name, ok := v[0].(string); ok {
+						list = append(list, name)
+					}
+				}
+			}
+		}
+	}
+	return list
+}
+
+// toLines converts a SELECT * ... GROUP BY * result with epoch=ns back
+// to line protocol, using the field types to keep integers integers.
+func toLines(r *Result, types map[string]string) ([][]byte, error) {
+	var lines [][]byte
+	for _, d := range r.Results {
+		for _, s := range d.Series {
+			// GROUP BY * reports tags a series doesn't have as empty
+			tm := make(map[string]string, len(s.Tags))
+			for k, v := range s.Tags {
+				if v != "" {
+					tm[k] = v
+				}
+			}
+			tags := models.NewTags(tm)
+			for _, v := range s.Values {
+				var t int64
+				fields := make(models.Fields)
+				for i, c := range s.Columns {
+					if i >= len(v) || v[i] == nil {
+						continue
+					}
+					if c == "time" {
+						n, ok := v[i].(json.Number)
+						if !ok {
+							return nil, fmt.Errorf("bad time %v", v[i])
+						}
+						var err error
+						if t, err = n.Int64(); err != nil {
+							return nil, err
+						}
+						continue
+					}
+
+					f, err := fieldValue(v[i], types[c])
+					if err != nil {
+						return nil, fmt.Errorf("field %s: %s", c, err)
+					}
+					fields[c] = f
+				}
+				if len(fields) == 0 {
+					continue
+				}
+
+				pt, err := models.NewPoint(s.Name, tags, fields, time.Unix(0, t))
+				if err != nil {
+					return nil, err
+				}
+				lines = append(lines, []byte(pt.PrecisionString("ns")+"\n"))
+			}
+		}
+	}
+	return lines, nil
+}
+
+func fieldValue(v interface{}, typ string) (interface{}, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return v, nil
+	}
+	switch typ {
+	case "integer":
+		return strconv.ParseInt(string(n), 10, 64)
+	case "unsigned":
+		return strconv.ParseUint(string(n), 10, 64)
+	}
+	return n.Float64()
+}
@@ -0,0 +1,215 @@
+package relay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMigrate(t *testing.T) {
+	points := []int64{0, int64(90 * time.Minute)}
+
+	former := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.FormValue("q")
+		switch {
+		case q == "SHOW DATABASES":
+			fmt.Fprint(w, `{"results":[{"statement_id":0,"series":[{"name":"databases","columns":["name"],"values":[["_internal"],["test"]]}]}]}`)
+		case strings.HasPrefix(q, "SHOW RETENTION POLICIES"):
+			fmt.Fprint(w, `{"results":[{"statement_id":0,"series":[{"columns":["name","duration"],"values":[["autogen","0s"]]}]}]}`)
+		case q == "SHOW MEASUREMENTS":
+			fmt.Fprint(w, `{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"]]}]}]}`)
+		case strings.HasPrefix(q, "SHOW FIELD KEYS"):
+			fmt.Fprint(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["fieldKey","fieldType"],"values":[["value","integer"],["f","float"]]}]}]}`)
+		case strings.HasSuffix(q, "ASC LIMIT 1"):
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[%d,1]]}]}]}`, points[0])
+		case strings.HasSuffix(q, "DESC LIMIT 1"):
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[%d,2]]}]}]}`, points[1])
+		case strings.HasPrefix(q, "SELECT * FROM"):
+			var lo, hi int64
+			fmt.Sscanf(q[strings.Index(q, "time >="):], "time >= %d AND time < %d", &lo, &hi)
+			var rows []string
+			for i, p := range points {
+				if p >= lo && p < hi {
+					rows = append(rows, fmt.Sprintf("[%d,1.5,%d]", p, i+1))
+				}
+			}
+			if len(rows) == 0 {
+				fmt.Fprint(w, `{"results":[{"statement_id":0}]}`)
+				return
+			}
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a","dc":""},"columns":["time","f","value"],"values":[%s]}]}]}`, strings.Join(rows, ","))
+		default:
+			t.Errorf("unexpected query %s", q)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer former.Close()
+
+	var lock sync.Mutex
+	var written []string
+	current := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		written = append(written, strings.Split(strings.TrimSpace(string(p)), "\n")...)
+		lock.Unlock()
+		if r.FormValue("db") != "test" || r.FormValue("rp") != "autogen" {
+			t.Errorf("unexpected write params %s", r.URL.RawQuery)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer current.Close()
+
+	dir, err := ioutil.TempDir("", "relay-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := HTTPConfig{
+		Replicas:          10,
+		MigrateCheckpoint: filepath.Join(dir, "checkpoint.json"),
+		Outputs:           map[string][]HTTPOutputConfig{"new": {{Name: "new1", Location: current.URL}}},
+		Former:            map[string][]HTTPOutputConfig{"old": {{Name: "old1", Location: former.URL}}},
+	}
+	ic, err := NewInfluxCluster(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	m, err := NewMigrator(ic, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"cpu,host=a f=1.5,value=1i 0",
+		fmt.Sprintf("cpu,host=a f=1.5,value=2i %d", points[1]),
+	}
+	if strings.Join(written, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected lines written:\n%s", strings.Join(written, "\n"))
+	}
+
+	status := m.Status()
+	if len(status) != 1 || status[0].State != MigrationDone || status[0].Points != 2 || status[0].To != "new" {
+		t.Fatalf("unexpected status %+v", status[0])
+	}
+
+	// a new migrator resumes from the checkpoint and has nothing to do
+	written = nil
+	m, err = NewMigrator(ic, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 0 {
+		t.Errorf("migrated again: %v", written)
+	}
+}
+
+func TestMigratePages(t *testing.T) {
+	// one more point than a page, all in the first chunk
+	n := migratePageRows + 1
+	var partial bool
+
+	former := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.FormValue("q")
+		switch {
+		case q == "SHOW DATABASES":
+			fmt.Fprint(w, `{"results":[{"statement_id":0,"series":[{"name":"databases","columns":["name"],"values":[["test"]]}]}]}`)
+		case strings.HasPrefix(q, "SHOW RETENTION POLICIES"):
+			fmt.Fprint(w, `{"results":[{"statement_id":0,"series":[{"columns":["name","duration"],"values":[["autogen","0s"]]}]}]}`)
+		case q == "SHOW MEASUREMENTS":
+			fmt.Fprint(w, `{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"]]}]}]}`)
+		case strings.HasPrefix(q, "SHOW FIELD KEYS"):
+			fmt.Fprint(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["fieldKey","fieldType"],"values":[["value","float"]]}]}]}`)
+		case strings.HasSuffix(q, "ASC LIMIT 1"):
+			fmt.Fprint(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[0,1]]}]}]}`)
+		case strings.HasSuffix(q, "DESC LIMIT 1"):
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[%d,1]]}]}]}`, n-1)
+		case strings.HasPrefix(q, "SELECT * FROM"):
+			var limit, offset int
+			fmt.Sscanf(q[strings.Index(q, "LIMIT"):], "LIMIT %d OFFSET %d", &limit, &offset)
+			var rows []string
+			for i := offset; i < n && i < offset+limit; i++ {
+				rows = append(rows, fmt.Sprintf("[%d,1]", i))
+			}
+			if len(rows) == 0 {
+				fmt.Fprint(w, `{"results":[{"statement_id":0}]}`)
+				return
+			}
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[%s],"partial":%v}]}]}`, strings.Join(rows, ","), partial)
+		default:
+			t.Errorf("unexpected query %s", q)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer former.Close()
+
+	var lock sync.Mutex
+	var written int
+	current := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		written += strings.Count(string(p), "\n")
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer current.Close()
+
+	dir, err := ioutil.TempDir("", "relay-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := HTTPConfig{
+		Replicas:          10,
+		MigrateCheckpoint: filepath.Join(dir, "checkpoint.json"),
+		Outputs:           map[string][]HTTPOutputConfig{"new": {{Name: "new1", Location: current.URL}}},
+		Former:            map[string][]HTTPOutputConfig{"old": {{Name: "old1", Location: former.URL}}},
+	}
+	ic, err := NewInfluxCluster(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	// a truncated answer fails the chunk instead of checkpointing it
+	partial = true
+	m, err := NewMigrator(ic, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(); err == nil {
+		t.Fatal("partial result should fail the migration")
+	}
+	if status := m.Status(); status[0].State != MigrationFailed || status[0].Next != 0 {
+		t.Fatalf("unexpected status %+v", status[0])
+	}
+
+	partial = false
+	written = 0
+	m, err = NewMigrator(ic, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if status := m.Status(); status[0].State != MigrationDone || status[0].Points != int64(n) || written != n {
+		t.Fatalf("expected %d points, wrote %d: %+v", n, written, status[0])
+	}
+}
@@ -0,0 +1,175 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+const DefaultMonitorInterval = 10 * time.Second
+
+// monitor writes the statistics of the relay into the monitor database at
+// every tick of ic.ticker, through the relay's own routing.
+func (ic *InfluxCluster) monitor() {
+	var created string
+	for {
+		select {
+		case <-ic.done:
+			return
+		case <-ic.ticker.C:
+		}
+
+		ic.lock.RLock()
+		db, rp := ic.cfg.MonitorDatabase, ic.cfg.MonitorRetentionPolicy
+		ic.lock.RUnlock()
+		if db == "" {
+			continue
+		}
+
+		if created != db {
+			if err := ic.createDatabase(db); err != nil {
+				log.Printf("create monitor database %s error: %s\n", db, err)
+				continue
+			}
+			created = db
+		}
+
+		var buf bytes.Buffer
+		now := time.Now()
+		for _, m := range append([]*Metric{ic.statsMetric(now)}, ic.backendStats(now)...) {
+			line, err := m.ParseToLine()
+			if err != nil {
+				log.Printf("monitor point %s error: %s\n", m.Name, err)
+				continue
+			}
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+
+		query := url.Values{"db": {db}, "precision": {"ns"}}
+		if rp != "" {
+			query.Set("rp", rp)
+		}
+		if err := ic.Write(buf.Bytes(), query.Encode(), "", models.ConsistencyLevelAny); err != nil {
+			log.Printf("monitor write error: %s\n", err)
+		}
+	}
+}
+
+// createDatabase creates db on every backend of the current ring.
+func (ic *InfluxCluster) createDatabase(db string) error {
+	ic.lock.RLock()
+	var backends []*HttpBackend
+	for _, list := range ic.nodes {
+		backends = append(backends, list...)
+	}
+	ic.lock.RUnlock()
+
+	for _, hb := range backends {
+		// a UDP listener writes to the database it was configured with
+		if hb.udp != nil {
+			continue
+		}
+		req, err := http.NewRequest("POST", hb.Location+"/query", nil)
+		if err != nil {
+			return err
+		}
+		req.Form = url.Values{"q": {"CREATE DATABASE " + quoteIdent(db)}}
+
+		resp, err := hb.Query(req)
+		if err != nil {
+			return err
+		}
+		p, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("backend %s: status %d: %s", hb.name, resp.StatusCode, bytes.TrimSpace(p))
+		}
+	}
+	return nil
+}
+
+// statsMetric returns the cluster statistics as the influx.relay point.
+func (ic *InfluxCluster) statsMetric(now time.Time) *Metric {
+	ic.lock.RLock()
+	tags := ic.tags(nil)
+	ic.lock.RUnlock()
+
+	ic.stats.Lock()
+	defer ic.stats.Unlock()
+	return &Metric{
+		Name: "influx.relay",
+		Tags: tags,
+		Fields: map[string]interface{}{
+			"statQueryRequest":         atomic.LoadInt64(&ic.stats.QueryRequests),
+			"statQueryRequestFail":     atomic.LoadInt64(&ic.stats.QueryRequestsFail),
+			"statWriteRequest":         atomic.LoadInt64(&ic.stats.WriteRequests),
+			"statWriteRequestFail":     atomic.LoadInt64(&ic.stats.WriteRequestsFail),
+			"statPingRequest":          atomic.LoadInt64(&ic.stats.PingRequests),
+			"statPingRequestFail":      atomic.LoadInt64(&ic.stats.PingRequestsFail),
+			"statPointsWritten":        atomic.LoadInt64(&ic.stats.PointsWritten),
+			"statPointsWrittenFail":    atomic.LoadInt64(&ic.stats.PointsWrittenFail),
+			"statFormerPointsWritten":  atomic.LoadInt64(&ic.stats.FormerPointsWritten),
+			"statFormerPointsFail":     atomic.LoadInt64(&ic.stats.FormerPointsFail),
+			"statQueryRequestDuration": atomic.LoadInt64(&ic.stats.QueryRequestDuration),
+			"statWriteRequestDuration": atomic.LoadInt64(&ic.stats.WriteRequestDuration),
+		},
+		Time: now,
+	}
+}
+
+// backendStats returns an influx.relay.backend point per backend.
+func (ic *InfluxCluster) backendStats(now time.Time) []*Metric {
+	stats := ic.backendStatistics()
+
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+
+	list := make([]*Metric, 0, len(stats))
+	for _, s := range stats {
+		list = append(list, &Metric{
+			Name: "influx.relay.backend",
+			Tags: ic.tags(map[string]string{
+				"ring":    s.Ring,
+				"shard":   s.Shard,
+				"backend": s.Backend,
+			}),
+			Fields: s.fields(),
+			Time:   now,
+		})
+	}
+	return list
+}
+
+// tags returns the default tags merged with extra, callers hold ic.lock.
+func (ic *InfluxCluster) tags(extra map[string]string) map[string]string {
+	tags := make(map[string]string, len(ic.defaultTags)+len(extra))
+	for k, v := range ic.defaultTags {
+		tags[k] = v
+	}
+	for k, v := range extra {
+		tags[k] = v
+	}
+	return tags
+}
+
+// defaultTagsFor returns the tags of the points the relay writes about
+// itself: the hostname, the relay name and the configured monitor-tags.
+func defaultTagsFor(cfg HTTPConfig) map[string]string {
+	tags := map[string]string{"relay": httpRelayName(cfg)}
+	if host, err := os.Hostname(); err == nil {
+		tags["host"] = host
+	}
+	for k, v := range cfg.MonitorTags {
+		tags[k] = v
+	}
+	return tags
+}
@@ -0,0 +1,74 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	created := make(chan string, 10)
+	written := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/query":
+			created <- r.FormValue("q")
+			w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+		case "/write":
+			p, _ := ioutil.ReadAll(r.Body)
+			written <- r.URL.Query().Get("db") + " " + string(p)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Name:            "r1",
+		Replicas:        10,
+		MonitorDatabase: "_relay",
+		MonitorInterval: "20ms",
+		MonitorTags:     map[string]string{"dc": "east"},
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: ts.URL}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	select {
+	case q := <-created:
+		if q != `CREATE DATABASE "_relay"` {
+			t.Errorf("unexpected query %s", q)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("monitor database not created")
+	}
+
+	// the lines can be spread over several writes, one per measurement
+	var got string
+	deadline := time.After(time.Second)
+	for !strings.Contains(got, "influx.relay,") || !strings.Contains(got, "influx.relay.backend,") {
+		select {
+		case w := <-written:
+			if !strings.HasPrefix(w, "_relay ") {
+				t.Fatalf("write to the wrong database: %s", w)
+			}
+			got += w
+		case <-deadline:
+			t.Fatalf("statistics not written, got %q", got)
+		}
+	}
+
+	for _, want := range []string{"dc=east", "relay=r1", "host=", "backend=a1", "statPointsWritten="} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %s in %s", want, got)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+const opentsdbField = "value"
+
+// OpenTSDB is a relay for the OpenTSDB telnet "put" protocol and the HTTP
+// /api/put endpoint, both served on the same port. The metric is the
+// measurement, the value the field "value".
+type OpenTSDB struct {
+	*listener
+	cfg OpenTSDBConfig
+
+	httpLn *connListener
+	server *http.Server
+}
+
+// NewOpenTSDB binds an OpenTSDB relay that writes to the cluster ic.
+func NewOpenTSDB(cfg OpenTSDBConfig, ic *InfluxCluster) (Relay, error) {
+	l, err := newListener("opentsdb", cfg.Name, "tcp", cfg.Addr, cfg.Database, cfg.RetentionPolicy, cfg.BatchSize, ic)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &OpenTSDB{listener: l, cfg: cfg}
+	o.httpLn = newConnListener(l.ln.Addr())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/put", o.HandlerPut)
+	o.server = &http.Server{Handler: mux}
+
+	l.parse = parseOpenTSDB
+	l.serveConn = o.serveConn
+	return o, nil
+}
+
+// opentsdbRelayName returns the name an OpenTSDB relay with cfg gets.
+func opentsdbRelayName(cfg OpenTSDBConfig) string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return "opentsdb://" + cfg.Addr
+}
+
+func (o *OpenTSDB) Run() error {
+	go o.server.Serve(o.httpLn)
+	return o.listener.Run()
+}
+
+// serveConn reads telnet connections itself and hands the others to the
+// HTTP server, until it is done with them.
+func (o *OpenTSDB) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	if b, err := r.Peek(4); err != nil || string(b) == "put " {
+		o.readLines(r)
+		return
+	}
+
+	c := &bufConn{Conn: conn, r: r, done: make(chan struct{})}
+	select {
+	case o.httpLn.conns <- c:
+		<-c.done
+	case <-o.httpLn.closed:
+	}
+}
+
+func (o *OpenTSDB) Stop() error {
+	o.httpLn.Close()
+	return o.listener.Stop()
+}
+
+func (o *OpenTSDB) Shutdown() error {
+	o.httpLn.Close()
+	return o.listener.Shutdown()
+}
+
+// parseOpenTSDB parses a "put metric timestamp value tag=value ..." line.
+func parseOpenTSDB(line string) (models.Point, error) {
+	fields := strings.Fields(line)
+	if fields[0] != "put" {
+		return nil, fmt.Errorf("unknown command %q", fields[0])
+	}
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("malformed put %q", line)
+	}
+
+	ts, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed time %q: %v", fields[2], err)
+	}
+	value, err := strconv.ParseFloat(fields[3], 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed value %q: %v", fields[3], err)
+	}
+
+	tags := make(map[string]string, len(fields)-4)
+	for _, kv := range fields[4:] {
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 || i == len(kv)-1 {
+			return nil, fmt.Errorf("malformed tag %q", kv)
+		}
+		tags[kv[:i]] = kv[i+1:]
+	}
+
+	return models.NewPoint(fields[1], models.NewTags(tags), models.Fields{opentsdbField: value}, opentsdbTime(ts))
+}
+
+// opentsdbTime reads a timestamp in seconds, or in milliseconds when it
+// has more than 10 digits, as OpenTSDB does.
+func opentsdbTime(ts int64) time.Time {
+	if ts < 1e10 {
+		return time.Unix(ts, 0).UTC()
+	}
+	return time.Unix(0, ts*int64(time.Millisecond)).UTC()
+}
+
+type opentsdbPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     json.Number       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// HandlerPut takes a data point, or an array of them, as JSON.
+func (o *OpenTSDB) HandlerPut(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid method")
+		return
+	}
+
+	body := req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		b, err := gzip.NewReader(req.Body)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, "unable to decode gzip body")
+			return
+		}
+		defer b.Close()
+		body = b
+	}
+
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, "problem reading request body")
+		return
+	}
+	atomic.AddInt64(&o.stats.bytes, int64(len(buf)))
+
+	var dps []opentsdbPoint
+	buf = bytes.TrimSpace(buf)
+	if len(buf) > 0 && buf[0] == '[' {
+		err = json.Unmarshal(buf, &dps)
+	} else {
+		dps = make([]opentsdbPoint, 1)
+		err = json.Unmarshal(buf, &dps[0])
+	}
+	if err != nil {
+		atomic.AddInt64(&o.stats.parseFail, 1)
+		jsonError(w, http.StatusBadRequest, fmt.Sprintf("unable to parse body: %v", err))
+		return
+	}
+	atomic.AddInt64(&o.stats.received, int64(len(dps)))
+
+	points := make([]models.Point, 0, len(dps))
+	for _, dp := range dps {
+		p, err := dp.point()
+		if err != nil {
+			atomic.AddInt64(&o.stats.parseFail, 1)
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		points = append(points, p)
+	}
+
+	for len(points) > 0 {
+		n := o.batchSize
+		if n > len(points) {
+			n = len(points)
+		}
+		o.write(points[:n])
+		points = points[n:]
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (dp *opentsdbPoint) point() (models.Point, error) {
+	if dp.Metric == "" {
+		return nil, errors.New("data point without metric")
+	}
+	value, err := dp.Value.Float64()
+	if err != nil {
+		return nil, fmt.Errorf("malformed value %q of metric %q", dp.Value, dp.Metric)
+	}
+	return models.NewPoint(dp.Metric, models.NewTags(dp.Tags), models.Fields{opentsdbField: value}, opentsdbTime(dp.Timestamp))
+}
+
+// bufConn is a connection whose first bytes were already read into r.
+// done is closed once the HTTP server closes it.
+type bufConn struct {
+	net.Conn
+	r    *bufio.Reader
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *bufConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *bufConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// connListener is a net.Listener accepting the connections sent to conns.
+type connListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr { return l.addr }
@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOpenTSDB(t *testing.T) {
+	var lock sync.Mutex
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		body = append(body, p...)
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas: 10,
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: ts.URL, Interval: "1h"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	r, err := NewOpenTSDB(OpenTSDBConfig{Name: "tsdb", Addr: "127.0.0.1:0", Database: "test"}, ic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := r.(*OpenTSDB)
+	go o.Run()
+	addr := o.ln.Addr().String()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("put cpu 1500000000 1 host=a\nput cpu x 1\nput mem 1500000000000 2\n"))
+	conn.Close()
+
+	resp, err := http.Post("http://"+addr+"/api/put", "application/json",
+		bytes.NewBufferString(`[{"metric":"disk","timestamp":1500000000,"value":3,"tags":{"host":"b"}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post("http://"+addr+"/api/put", "application/json", bytes.NewBufferString(`{"metric":"disk","value":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	want := []string{
+		"cpu,host=a value=1 1500000000000000000\n",
+		"mem value=2 1500000000000000000\n",
+		"disk,host=b value=3 1500000000000000000\n",
+	}
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		n := len(body)
+		lock.Unlock()
+		if n == len(want[0])+len(want[1])+len(want[2]) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := o.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, w := range want {
+		if !bytes.Contains(body, []byte(w)) {
+			t.Errorf("missing %q in %q", w, body)
+		}
+	}
+
+	s := ic.listenerStatistics()
+	if len(s) != 1 || s[0].Listener != "tsdb" || s[0].Received != 4 || s[0].Points != 3 || s[0].ParseFail != 2 {
+		t.Errorf("unexpected listener stats %+v", s)
+	}
+}
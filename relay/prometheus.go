@@ -0,0 +1,358 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/influxdata/influxdb/models"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Prometheus remote storage. Samples are stored the way InfluxDB stores
+// them itself: the metric name is the measurement, the other labels are
+// tags and the sample is the field "value".
+const (
+	promNameLabel = "__name__"
+	promField     = "value"
+)
+
+// Largest decoded request body accepted, so a short request can't make
+// the relay allocate an arbitrary amount of memory.
+const promMaxDecoded = 256 * MB
+
+// HandlerPromWrite takes a snappy compressed remote write request and
+// writes its samples to the shards of their metric names.
+func (h *HTTP) HandlerPromWrite(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid method")
+		atomic.AddInt64(&h.ic.stats.WriteRequestsFail, 1)
+		return
+	}
+
+	params := req.URL.Query()
+	if params.Get("db") == "" {
+		jsonError(w, http.StatusBadRequest, "missing parameter: db")
+		atomic.AddInt64(&h.ic.stats.WriteRequestsFail, 1)
+		return
+	}
+	level, err := h.writeParams(params)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		atomic.AddInt64(&h.ic.stats.WriteRequestsFail, 1)
+		return
+	}
+	params.Set("precision", "ms")
+
+	buf, err := readPromBody(req)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		atomic.AddInt64(&h.ic.stats.WriteRequestsFail, 1)
+		return
+	}
+	var wr prompb.WriteRequest
+	if err := proto.Unmarshal(buf, &wr); err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		atomic.AddInt64(&h.ic.stats.WriteRequestsFail, 1)
+		return
+	}
+
+	points, err := promPoints(wr.Timeseries)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		atomic.AddInt64(&h.ic.stats.WriteRequestsFail, 1)
+		return
+	}
+
+	rw := h.ic.routePoints(points, "ms")
+	if err := h.send(rw, params, req.Header.Get("Authorization"), level); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readPromBody reads and decompresses the body of a remote read or write
+// request.
+func readPromBody(req *http.Request) ([]byte, error) {
+	compressed, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, errors.New("problem reading request body")
+	}
+	n, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, err
+	}
+	if n > promMaxDecoded {
+		return nil, snappy.ErrTooLarge
+	}
+	return snappy.Decode(nil, compressed)
+}
+
+// promPoints converts remote write time series to points. InfluxDB can't
+// store NaN and infinities, those samples are skipped.
+func promPoints(list []*prompb.TimeSeries) ([]models.Point, error) {
+	var points []models.Point
+	for _, ts := range list {
+		var name string
+		tags := make(map[string]string, len(ts.Labels))
+		for _, l := range ts.Labels {
+			if l.Name == promNameLabel {
+				name = l.Value
+			} else if l.Value != "" {
+				tags[l.Name] = l.Value
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("time series without %s label", promNameLabel)
+		}
+
+		for _, s := range ts.Samples {
+			if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+				continue
+			}
+			p, err := models.NewPoint(name, models.NewTags(tags), models.Fields{promField: s.Value},
+				time.Unix(0, s.Timestamp*int64(time.Millisecond)))
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, p)
+		}
+	}
+	return points, nil
+}
+
+// HandlerPromRead answers a snappy compressed remote read request. Every
+// query is translated to InfluxQL and runs through the regular query path.
+func (h *HTTP) HandlerPromRead(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid method")
+		atomic.AddInt64(&h.ic.stats.QueryRequestsFail, 1)
+		return
+	}
+
+	params := req.URL.Query()
+	if params.Get("db") == "" {
+		jsonError(w, http.StatusBadRequest, "missing parameter: db")
+		atomic.AddInt64(&h.ic.stats.QueryRequestsFail, 1)
+		return
+	}
+
+	buf, err := readPromBody(req)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		atomic.AddInt64(&h.ic.stats.QueryRequestsFail, 1)
+		return
+	}
+	var rr prompb.ReadRequest
+	if err := proto.Unmarshal(buf, &rr); err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		atomic.AddInt64(&h.ic.stats.QueryRequestsFail, 1)
+		return
+	}
+
+	resp := new(prompb.ReadResponse)
+	for _, q := range rr.Queries {
+		list, err := h.promQuery(req, params, q)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			atomic.AddInt64(&h.ic.stats.QueryRequestsFail, 1)
+			return
+		}
+		resp.Results = append(resp.Results, &prompb.QueryResult{Timeseries: list})
+	}
+
+	data, err := proto.Marshal(resp)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		atomic.AddInt64(&h.ic.stats.QueryRequestsFail, 1)
+		return
+	}
+	atomic.AddInt64(&h.ic.stats.QueryRequests, 1)
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	w.Write(snappy.Encode(nil, data))
+}
+
+// promQuery runs a remote read query and returns its time series.
+func (h *HTTP) promQuery(req *http.Request, params url.Values, q *prompb.Query) ([]*prompb.TimeSeries, error) {
+	stmt, err := promStatement(params.Get("rp"), q)
+	if err != nil {
+		return nil, err
+	}
+	stmts, err := ParseInfluxQL(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	r := req.WithContext(req.Context())
+	r.Form = url.Values{"db": {params.Get("db")}, "q": {stmt}, "epoch": {"ms"}}
+	for _, k := range []string{"u", "p"} {
+		if v := params.Get(k); v != "" {
+			r.Form.Set(k, v)
+		}
+	}
+	r.Header = make(http.Header)
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+
+	res := h.ic.execute(r, stmts)
+	if res.status != http.StatusOK {
+		return nil, fmt.Errorf("query failed: status %d: %s", res.status, strings.TrimSpace(string(res.body)))
+	}
+
+	result := new(Result)
+	if err := json.Unmarshal(res.body, result); err != nil {
+		return nil, err
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("query failed: %s", result.Error)
+	}
+
+	names, err := nameMatchers(q.Matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*prompb.TimeSeries
+	for _, d := range result.Results {
+		if d.Error != "" {
+			return nil, fmt.Errorf("query failed: %s", d.Error)
+		}
+		for _, s := range d.Series {
+			if !names(s.Name) {
+				continue
+			}
+			list = append(list, promSeries(s))
+		}
+	}
+	return list, nil
+}
+
+// promStatement translates a remote read query to a SELECT statement. A
+// metric name matched for equality or by a regex is the FROM clause, the
+// name matchers are applied to the results as well.
+func promStatement(rp string, q *prompb.Query) (string, error) {
+	from := "/.+/"
+
+	conds := []string{
+		"time >= " + quoteString(time.Unix(0, q.StartTimestampMs*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)),
+		"time <= " + quoteString(time.Unix(0, q.EndTimestampMs*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)),
+	}
+
+	fromSet := false
+	for _, m := range q.Matchers {
+		if m.Name == promNameLabel {
+			if fromSet {
+				continue
+			}
+			switch m.Type {
+			case prompb.LabelMatcher_EQ:
+				from, fromSet = quoteIdent(m.Value), true
+			case prompb.LabelMatcher_RE:
+				from, fromSet = promRegex(m.Value), true
+			}
+			continue
+		}
+
+		var op, v string
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			op, v = "=", quoteString(m.Value)
+		case prompb.LabelMatcher_NEQ:
+			op, v = "!=", quoteString(m.Value)
+		case prompb.LabelMatcher_RE:
+			op, v = "=~", promRegex(m.Value)
+		case prompb.LabelMatcher_NRE:
+			op, v = "!~", promRegex(m.Value)
+		default:
+			return "", fmt.Errorf("unknown matcher type %d", m.Type)
+		}
+		conds = append(conds, quoteIdent(m.Name)+" "+op+" "+v)
+	}
+
+	if rp != "" {
+		from = quoteIdent(rp) + "." + from
+	}
+	return fmt.Sprintf("SELECT %s FROM %s WHERE %s GROUP BY *", quoteIdent(promField), from, strings.Join(conds, " AND ")), nil
+}
+
+// promRegex returns the InfluxQL literal of a Prometheus regex, which is
+// anchored at both ends.
+func promRegex(re string) string {
+	return "/^(?:" + strings.Replace(re, "/", `\/`, -1) + ")$/"
+}
+
+// nameMatchers returns a filter of the metric names matched by ms.
+func nameMatchers(ms []*prompb.LabelMatcher) (func(string) bool, error) {
+	var filters []func(string) bool
+	for _, m := range ms {
+		if m.Name != promNameLabel {
+			continue
+		}
+		m := m
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			filters = append(filters, func(s string) bool { return s == m.Value })
+		case prompb.LabelMatcher_NEQ:
+			filters = append(filters, func(s string) bool { return s != m.Value })
+		case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return nil, err
+			}
+			match := m.Type == prompb.LabelMatcher_RE
+			filters = append(filters, func(s string) bool { return re.MatchString(s) == match })
+		}
+	}
+
+	return func(name string) bool {
+		for _, f := range filters {
+			if !f(name) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// promSeries converts a series of a SELECT with epoch=ms to a time series
+// with sorted labels.
+func promSeries(s *series) *prompb.TimeSeries {
+	ts := &prompb.TimeSeries{Labels: []*prompb.Label{{Name: promNameLabel, Value: s.Name}}}
+	for k, v := range s.Tags {
+		if v != "" {
+			ts.Labels = append(ts.Labels, &prompb.Label{Name: k, Value: v})
+		}
+	}
+	sort.Slice(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+
+	ti, vi := columnIndex(s.Columns, "time"), columnIndex(s.Columns, promField)
+	if ti < 0 || vi < 0 {
+		return ts
+	}
+	for _, row := range s.Values {
+		t, ok := row[ti].(float64)
+		v, ok2 := row[vi].(float64)
+		if !ok || !ok2 {
+			continue
+		}
+		ts.Samples = append(ts.Samples, prompb.Sample{Value: v, Timestamp: int64(t)})
+	}
+	return ts
+}
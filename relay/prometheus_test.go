@@ -0,0 +1,144 @@
+package relay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// promBody returns the snappy compressed encoding of m.
+func promBody(t *testing.T, m proto.Message) []byte {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snappy.Encode(nil, data)
+}
+
+func TestPrometheus(t *testing.T) {
+	var lock sync.Mutex
+	var writes, queries []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.URL.Path {
+		case "/write":
+			p, _ := ioutil.ReadAll(r.Body)
+			writes = append(writes, r.URL.Query().Get("precision")+r.URL.Query().Get("consistency")+" "+string(p))
+			w.WriteHeader(http.StatusNoContent)
+		case "/query":
+			queries = append(queries, r.FormValue("epoch")+" "+r.FormValue("q"))
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"results":[{"statement_id":0,"series":[` +
+				`{"name":"up","tags":{"job":"a","zone":""},"columns":["time","value"],"values":[[1000,1],[2000,0]]}]}]}`))
+		}
+	}))
+	defer ts.Close()
+
+	r, err := NewHTTP(HTTPConfig{
+		Replicas:         10,
+		WriteConsistency: "all",
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: ts.URL, Interval: "1h"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := r.(*HTTP)
+	defer h.ic.Close()
+
+	body := promBody(t, &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}, {Name: "zone"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1500000000000}, {Value: math.NaN(), Timestamp: 1500000001000}},
+	}}})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/prom/write?db=prom", bytes.NewReader(body)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("write failed: %d %s", w.Code, w.Body)
+	}
+	if len(writes) != 1 || writes[0] != "ms up,job=a value=1 1500000000000\n" {
+		t.Errorf("unexpected writes %q", writes)
+	}
+
+	// the consistency is enforced by the relay, not passed on
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/prom/write?db=prom&consistency=one", bytes.NewReader(body)))
+	if w.Code != http.StatusNoContent || len(writes) != 2 || writes[1] != writes[0] {
+		t.Errorf("unexpected write %d %q", w.Code, writes)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/prom/write?db=prom&consistency=some", bytes.NewReader(body)))
+	if w.Code != http.StatusBadRequest || len(writes) != 2 {
+		t.Errorf("expected invalid consistency, got %d %q", w.Code, writes)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/prom/write?db=prom", bytes.NewReader([]byte("garbage"))))
+	if w.Code != http.StatusBadRequest || len(writes) != 2 {
+		t.Errorf("expected corrupt input, got %d %q", w.Code, writes)
+	}
+
+	body = promBody(t, &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+			{Type: prompb.LabelMatcher_RE, Name: "job", Value: "a|b"},
+		},
+	}}})
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/prom/read?db=prom", bytes.NewReader(body)))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "snappy" {
+		t.Fatalf("read failed: %d %s", w.Code, w.Body)
+	}
+	expected := `ms SELECT "value" FROM "up" WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:02Z' AND "job" =~ /^(?:a|b)$/ GROUP BY *`
+	if len(queries) != 1 || queries[0] != expected {
+		t.Errorf("unexpected queries %q", queries)
+	}
+
+	// other name matchers read every measurement and filter the results
+	for _, m := range []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "u.*"},
+		{Type: prompb.LabelMatcher_NEQ, Name: "__name__", Value: "down"},
+	} {
+		q := &prompb.Query{StartTimestampMs: 1000, EndTimestampMs: 2000, Matchers: []*prompb.LabelMatcher{m}}
+		stmt, err := promStatement("autogen", q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmts, err := ParseInfluxQL(stmt)
+		if err != nil {
+			t.Fatalf("%s: %s", stmt, err)
+		}
+		if ms := stmts[0].Measurements(); len(ms) != 1 || ms[0].RetentionPolicy != "autogen" || ms[0].Regex == "" {
+			t.Errorf("%s: unexpected sources %+v", stmt, ms)
+		}
+	}
+
+	data, err := snappy.Decode(nil, w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp prompb.ReadResponse
+	if err := proto.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	expectedSeries := []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 0, Timestamp: 2000}},
+	}}
+	if len(resp.Results) != 1 || !reflect.DeepEqual(resp.Results[0].Timeseries, expectedSeries) {
+		t.Errorf("unexpected read response %+v", resp.Results)
+	}
+}
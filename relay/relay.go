@@ -1,13 +1,19 @@
 package relay
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"reflect"
+	"strings"
 	"sync"
 )
 
 type Service struct {
 	relays map[string]Relay
+
+	lock       sync.Mutex
+	configFile string
 }
 
 func New(config Config) (*Service, error) {
@@ -22,12 +28,77 @@ func New(config Config) (*Service, error) {
 		if s.relays[h.Name()] != nil {
 			return nil, fmt.Errorf("duplicate relay: %q", h.Name())
 		}
+		h.(*HTTP).reload = s.ReloadFile
 		s.relays[h.Name()] = h
 	}
 
+	for _, cfg := range config.UDPRelays {
+		h, err := s.clusterRelay(config, cfg.Relay)
+		if err != nil {
+			return nil, fmt.Errorf("udp relay %q: %v", udpRelayName(cfg), err)
+		}
+		u, err := NewUDP(cfg, h.ic)
+		if err != nil {
+			return nil, err
+		}
+		if s.relays[u.Name()] != nil {
+			u.Stop()
+			return nil, fmt.Errorf("duplicate relay: %q", u.Name())
+		}
+		s.relays[u.Name()] = u
+	}
+
+	for _, cfg := range config.GraphiteRelays {
+		h, err := s.clusterRelay(config, cfg.Relay)
+		if err != nil {
+			return nil, fmt.Errorf("graphite relay %q: %v", graphiteRelayName(cfg), err)
+		}
+		g, err := NewGraphite(cfg, h.ic)
+		if err != nil {
+			return nil, err
+		}
+		if s.relays[g.Name()] != nil {
+			g.Stop()
+			return nil, fmt.Errorf("duplicate relay: %q", g.Name())
+		}
+		s.relays[g.Name()] = g
+	}
+
+	for _, cfg := range config.OpenTSDBRelays {
+		h, err := s.clusterRelay(config, cfg.Relay)
+		if err != nil {
+			return nil, fmt.Errorf("opentsdb relay %q: %v", opentsdbRelayName(cfg), err)
+		}
+		o, err := NewOpenTSDB(cfg, h.ic)
+		if err != nil {
+			return nil, err
+		}
+		if s.relays[o.Name()] != nil {
+			o.Stop()
+			return nil, fmt.Errorf("duplicate relay: %q", o.Name())
+		}
+		s.relays[o.Name()] = o
+	}
+
 	return s, nil
 }
 
+// clusterRelay returns the HTTP relay named name, whose cluster a listener
+// writes to. The name can be left out when there is a single HTTP relay.
+func (s *Service) clusterRelay(config Config, name string) (*HTTP, error) {
+	if name == "" {
+		if len(config.HTTPRelays) != 1 {
+			return nil, errors.New("relay must name one of the http relays")
+		}
+		name = httpRelayName(config.HTTPRelays[0])
+	}
+	h, ok := s.relays[name].(*HTTP)
+	if !ok {
+		return nil, fmt.Errorf("no http relay %q", name)
+	}
+	return h, nil
+}
+
 func (s *Service) Run() {
 	var wg sync.WaitGroup
 	wg.Add(len(s.relays))
@@ -52,8 +123,138 @@ func (s *Service) Stop() {
 	}
 }
 
+// Shutdown stops all relays gracefully, the error lists what each relay
+// had to drop. Listeners write to the clusters of the HTTP relays, they
+// are stopped first, then the HTTP relays all at once.
+func (s *Service) Shutdown() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	errs := make(chan error, len(s.relays))
+	shutdown := func(isHTTP bool) {
+		var wg sync.WaitGroup
+		for _, v := range s.relays {
+			if _, ok := v.(*HTTP); ok != isHTTP {
+				continue
+			}
+			wg.Add(1)
+			go func(r Relay) {
+				defer wg.Done()
+				if err := r.Shutdown(); err != nil {
+					errs <- fmt.Errorf("relay %q: %v", r.Name(), err)
+				}
+			}(v)
+		}
+		wg.Wait()
+	}
+	shutdown(false)
+	shutdown(true)
+	close(errs)
+
+	var list []string
+	for err := range errs {
+		list = append(list, err.Error())
+	}
+	if len(list) > 0 {
+		return errors.New(strings.Join(list, "; "))
+	}
+	return nil
+}
+
+// SetConfigFile sets the file ReloadFile reads.
+func (s *Service) SetConfigFile(path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.configFile = path
+}
+
+// ReloadFile reads the configuration file again and applies it.
+func (s *Service) ReloadFile() error {
+	s.lock.Lock()
+	path := s.configFile
+	s.lock.Unlock()
+
+	if path == "" {
+		return errors.New("no configuration file")
+	}
+
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		return fmt.Errorf("error loading config file '%v'", err)
+	}
+	return s.Reload(cfg)
+}
+
+// Reload applies a new configuration to the running relays. Relays are
+// matched by name, adding or removing relays needs a restart. Every
+// relay checks its configuration before any of them is changed.
+func (s *Service) Reload(config Config) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var reloads []*httpReload
+	abort := func() {
+		for _, r := range reloads {
+			r.abort()
+		}
+	}
+	seen := make(map[string]bool)
+	for _, cfg := range config.HTTPRelays {
+		name := httpRelayName(cfg)
+		if seen[name] {
+			abort()
+			return fmt.Errorf("duplicate relay: %q", name)
+		}
+		seen[name] = true
+
+		h, ok := s.relays[name].(*HTTP)
+		if !ok {
+			log.Printf("relay %q is new, it needs a restart to start\n", name)
+			continue
+		}
+		r, err := h.prepareReload(cfg)
+		if err != nil {
+			abort()
+			return fmt.Errorf("relay %q: %v", name, err)
+		}
+		reloads = append(reloads, r)
+	}
+
+	// only a WAL that can't be opened fails now, that relay keeps its
+	// configuration
+	var failed error
+	for _, r := range reloads {
+		if err := r.apply(); err != nil && failed == nil {
+			failed = fmt.Errorf("relay %q: %v", r.h.Name(), err)
+		}
+	}
+
+	for _, cfg := range config.UDPRelays {
+		name := udpRelayName(cfg)
+		if u, ok := s.relays[name].(*UDP); !ok || u.cfg != cfg {
+			log.Printf("relay %q changed, it needs a restart to apply\n", name)
+		}
+	}
+
+	for _, cfg := range config.GraphiteRelays {
+		name := graphiteRelayName(cfg)
+		if g, ok := s.relays[name].(*Graphite); !ok || !reflect.DeepEqual(g.cfg, cfg) {
+			log.Printf("relay %q changed, it needs a restart to apply\n", name)
+		}
+	}
+
+	for _, cfg := range config.OpenTSDBRelays {
+		name := opentsdbRelayName(cfg)
+		if o, ok := s.relays[name].(*OpenTSDB); !ok || o.cfg != cfg {
+			log.Printf("relay %q changed, it needs a restart to apply\n", name)
+		}
+	}
+	return failed
+}
+
 type Relay interface {
 	Name() string
 	Run() error
 	Stop() error
+	Shutdown() error
 }
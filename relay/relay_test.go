@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestServiceReload(t *testing.T) {
+	outputs := func(shards ...string) map[string][]HTTPOutputConfig {
+		m := make(map[string][]HTTPOutputConfig)
+		for _, k := range shards {
+			m[k] = []HTTPOutputConfig{{Name: k + "1", Location: "http://127.0.0.1:1"}}
+		}
+		return m
+	}
+
+	config := Config{HTTPRelays: []HTTPConfig{
+		{Name: "one", Addr: "127.0.0.1:0", Replicas: 10, Outputs: outputs("a")},
+		{Name: "two", Addr: "127.0.0.1:0", Replicas: 10, Outputs: outputs("a")},
+	}}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	one := s.relays["one"].(*HTTP)
+	two := s.relays["two"].(*HTTP)
+
+	// the second relay is checked before the first one changes
+	bad := Config{HTTPRelays: []HTTPConfig{
+		{Name: "one", Addr: "127.0.0.1:0", Replicas: 10, Outputs: outputs("a", "b")},
+		{Name: "two", Addr: "127.0.0.1:0", Replicas: 10, Outputs: outputs("a"), WriteConsistency: "bogus"},
+	}}
+	if err := s.Reload(bad); err == nil {
+		t.Fatal("expected an error")
+	}
+	if one.ic.backends("b") != nil {
+		t.Error("first relay reloaded although the second one failed")
+	}
+
+	bad.HTTPRelays[1] = bad.HTTPRelays[0]
+	if err := s.Reload(bad); err == nil {
+		t.Fatal("expected an error for a duplicate relay")
+	}
+
+	good := Config{HTTPRelays: []HTTPConfig{
+		{Name: "one", Addr: "127.0.0.1:0", Replicas: 10, Outputs: outputs("a", "b")},
+		{Name: "two", Addr: "127.0.0.1:0", Replicas: 10, Outputs: outputs("a", "c"), WriteConsistency: "all"},
+	}}
+	if err := s.Reload(good); err != nil {
+		t.Fatal(err)
+	}
+	if one.ic.backends("b") == nil || two.ic.backends("c") == nil {
+		t.Error("new shards not added")
+	}
+	if _, level := two.writeDefaults(); level != models.ConsistencyLevelAll {
+		t.Errorf("write consistency not reloaded: %v", level)
+	}
+}
@@ -2,6 +2,7 @@ package relay
 
 import (
 	"bytes"
+	"log"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,9 +19,14 @@ type Operation func() error
 // Only tries one operation at a time, the next operation is not attempted
 // until success or timeout of the previous operation.
 // There is no delay between attempts of different operations.
+// The worker pauses while the backend is down and resumes once it is
+// healthy again, it only stops when the buffer is closed.
 type retryBuffer struct {
 	buffering int32
 
+	// size of the batch being retried
+	retrying int64
+
 	initialInterval time.Duration
 	multiplier      time.Duration
 	maxInterval     time.Duration
@@ -30,73 +36,258 @@ type retryBuffer struct {
 
 	list *bufferList
 
+	// wal, if set, replaces list: failed writes are persisted to disk
+	// and acknowledged as soon as they are durable. Writes go to the
+	// backend first and only reach the wal once that failed, writes
+	// answered before being sent (consistency any) are not covered.
+	wal *diskQueue
+
+	// how long callers wait for a buffered write to be delivered
+	wait time.Duration
+
 	hb *HttpBackend
+
+	// wake cuts the backoff short once the backend is healthy again,
+	// done stops the worker
+	wake      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-func newRetryBuffer(size, batch int, max time.Duration, hb *HttpBackend) *retryBuffer {
+func newRetryBuffer(size, batch int, max, wait time.Duration, wal *diskQueue, hb *HttpBackend) *retryBuffer {
 	r := &retryBuffer{
 		initialInterval: retryInitial,
 		multiplier:      retryMultiplier,
 		maxInterval:     max,
 		maxBuffered:     size,
 		maxBatch:        batch,
-		list:            newBufferList(size, batch),
+		wait:            wait,
 		hb:              hb,
+		wake:            make(chan struct{}, 1),
+		done:            make(chan struct{}),
+	}
+
+	if wal != nil {
+		r.wal = wal
+		// replay whatever was left over from the last run before
+		// letting new writes bypass the queue
+		if !wal.empty() {
+			r.buffering = 1
+		}
+		go r.runWAL()
+		return r
 	}
+
+	r.list = newBufferList(size, batch)
 	go r.run()
 	return r
 }
 
+// Write sends buf to the backend, buffering it when the backend fails or
+// earlier writes are still buffered. Writes to a backend that is down are
+// buffered and fail right away, other callers wait up to r.wait for the
+// buffered write to be delivered. Writes kept in the wal return
+// ErrBufferedWAL at once.
 func (r *retryBuffer) Write(buf []byte, query string, auth string) (*responseData, error) {
-	if atomic.LoadInt32(&r.buffering) == 0 {
+	if atomic.LoadInt32(&r.buffering) == 0 && r.hb.IsActive() {
 		resp, err := r.hb.Write(buf, query, auth)
-		// TODO A 5xx caused by the point data could cause the relay to buffer forever
-		if err == nil && resp.StatusCode/100 != 5 {
+		// rejected points went to the dead letter, only buffer what
+		// may still get through
+		if !retryable(resp, err) {
 			return resp, err
 		}
 		atomic.StoreInt32(&r.buffering, 1)
 	}
 
+	if r.wal != nil {
+		if err := r.wal.append(buf, query, auth); err != nil {
+			r.hb.counters.drop(len(buf))
+			return nil, err
+		}
+		atomic.StoreInt32(&r.buffering, 1)
+		// durable but not delivered, it doesn't count as an ack
+		return nil, ErrBufferedWAL
+	}
+
 	// already buffering or failed request
 	batch, err := r.list.add(buf, query, auth)
 	if err != nil {
+		r.hb.counters.drop(len(buf))
+		log.Printf("retry buffer of %s: %s, %d bytes dropped\n", r.hb.name, err, len(buf))
 		return nil, err
 	}
+	atomic.StoreInt32(&r.buffering, 1)
 
-	batch.wg.Wait()
-	return batch.resp, nil
+	if !r.hb.IsActive() {
+		return nil, ErrBackendInactive
+	}
+
+	timer := time.NewTimer(r.wait)
+	defer timer.Stop()
+	select {
+	case <-batch.done:
+		return batch.resp, batch.err
+	case <-timer.C:
+		return nil, ErrBufferTimeout
+	}
 }
 
 func (r *retryBuffer) run() {
 	buf := bytes.NewBuffer(make([]byte, 0, r.maxBatch))
-	for r.hb.IsActive() {
-		buf.Reset()
+	for {
 		batch := r.list.pop()
+		if batch == nil {
+			return
+		}
+		atomic.StoreInt64(&r.retrying, int64(batch.size))
 
+		buf.Reset()
 		for _, b := range batch.bufs {
 			buf.Write(b)
 		}
 
 		interval := r.initialInterval
 		for {
+			if !r.waitUsable() {
+				atomic.StoreInt64(&r.retrying, 0)
+				r.hb.counters.drop(batch.size)
+				batch.finish(nil, ErrBufferClosed)
+				return
+			}
+
 			resp, err := r.hb.Write(buf.Bytes(), batch.query, batch.auth)
-			if err == nil && resp.StatusCode/100 != 5 {
-				batch.resp = resp
-				atomic.StoreInt32(&r.buffering, 0)
-				batch.wg.Done()
+			if !retryable(resp, err) {
+				atomic.StoreInt64(&r.retrying, 0)
+				if r.list.empty() {
+					atomic.StoreInt32(&r.buffering, 0)
+				}
+				batch.finish(resp, nil)
 				break
 			}
 
-			if interval != r.maxInterval {
-				interval *= r.multiplier
-				if interval > r.maxInterval {
-					interval = r.maxInterval
+			atomic.AddInt64(&r.hb.counters.retries, 1)
+			interval = r.backoff(interval)
+			r.sleep(interval)
+		}
+	}
+}
+
+// runWAL replays the disk queue in order, removing each record once the
+// backend has accepted it.
+func (r *retryBuffer) runWAL() {
+	for {
+		rec, err := r.wal.next()
+		if err == ErrWALClosed {
+			return
+		}
+		if err != nil {
+			log.Printf("wal read error on %s: %s\n", r.hb.name, err)
+			if !r.sleep(r.maxInterval) {
+				return
+			}
+			continue
+		}
+
+		interval := r.initialInterval
+		for {
+			// the record stays in the wal when the buffer is closed
+			if !r.waitUsable() {
+				return
+			}
+
+			resp, err := r.hb.Write(rec.buf, rec.query, rec.auth)
+			if !retryable(resp, err) {
+				if r.wal.ack() {
+					atomic.StoreInt32(&r.buffering, 0)
 				}
+				break
 			}
 
-			time.Sleep(interval)
+			atomic.AddInt64(&r.hb.counters.retries, 1)
+			interval = r.backoff(interval)
+			r.sleep(interval)
+		}
+	}
+}
+
+func (r *retryBuffer) backoff(interval time.Duration) time.Duration {
+	if interval != r.maxInterval {
+		interval *= r.multiplier
+		if interval > r.maxInterval {
+			interval = r.maxInterval
 		}
 	}
+	return interval
+}
+
+// waitUsable pauses while the backend is down. It returns false once the
+// buffer is closed.
+func (r *retryBuffer) waitUsable() bool {
+	for !r.hb.State().Usable() {
+		if !r.sleep(r.maxInterval) {
+			return false
+		}
+	}
+	select {
+	case <-r.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// sleep waits for d or a wake up, it returns false once the buffer is
+// closed.
+func (r *retryBuffer) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.wake:
+	case <-r.done:
+		return false
+	}
+	return true
+}
+
+func (r *retryBuffer) wakeUp() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pending reports whether writes are waiting to be retried.
+func (r *retryBuffer) pending() bool {
+	return atomic.LoadInt32(&r.buffering) != 0 || r.buffered() > 0
+}
+
+// buffered returns the size of the writes held in memory.
+func (r *retryBuffer) buffered() int {
+	if r.list == nil {
+		return 0
+	}
+	r.list.cond.L.Lock()
+	n := r.list.size
+	r.list.cond.L.Unlock()
+	return n + int(atomic.LoadInt64(&r.retrying))
+}
+
+// close stops the worker. Writes still held in memory are dropped and
+// their callers released, the wal keeps its records for the next run.
+func (r *retryBuffer) close() error {
+	r.closeOnce.Do(func() { close(r.done) })
+	atomic.StoreInt32(&r.buffering, 0)
+
+	if r.wal != nil {
+		return r.wal.close()
+	}
+
+	if n := r.list.close(); n > 0 {
+		r.hb.counters.drop(n)
+		log.Printf("retry buffer of %s closed, %d bytes dropped\n", r.hb.name, n)
+	}
+	return nil
 }
 
 type batch struct {
@@ -106,8 +297,10 @@ type batch struct {
 	size  int
 	full  bool
 
-	wg   sync.WaitGroup
+	// closed once the batch was delivered or dropped
+	done chan struct{}
 	resp *responseData
+	err  error
 
 	next *batch
 }
@@ -118,16 +311,22 @@ func newBatch(buf []byte, query string, auth string) *batch {
 	b.size = len(buf)
 	b.query = query
 	b.auth = auth
-	b.wg.Add(1)
+	b.done = make(chan struct{})
 	return b
 }
 
+func (b *batch) finish(resp *responseData, err error) {
+	b.resp, b.err = resp, err
+	close(b.done)
+}
+
 type bufferList struct {
 	cond     *sync.Cond
 	head     *batch
 	size     int
 	maxSize  int
 	maxBatch int
+	closed   bool
 }
 
 func newBufferList(maxSize, maxBatch int) *bufferList {
@@ -138,13 +337,18 @@ func newBufferList(maxSize, maxBatch int) *bufferList {
 	}
 }
 
-// pop will remove and return the first element of the list, blocking if necessary
+// pop will remove and return the first element of the list, blocking if
+// necessary. It returns nil once the list is closed.
 func (l *bufferList) pop() *batch {
 	l.cond.L.Lock()
 
-	for l.size == 0 {
+	for l.size == 0 && !l.closed {
 		l.cond.Wait()
 	}
+	if l.closed {
+		l.cond.L.Unlock()
+		return nil
+	}
 
 	b := l.head
 	l.head = l.head.next
@@ -155,9 +359,20 @@ func (l *bufferList) pop() *batch {
 	return b
 }
 
+func (l *bufferList) empty() bool {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+	return l.size == 0
+}
+
 func (l *bufferList) add(buf []byte, query string, auth string) (*batch, error) {
 	l.cond.L.Lock()
 
+	if l.closed {
+		l.cond.L.Unlock()
+		return nil, ErrBufferClosed
+	}
+
 	if l.size+len(buf) > l.maxSize {
 		l.cond.L.Unlock()
 		return nil, ErrBufferFull
@@ -195,6 +410,28 @@ func (l *bufferList) add(buf []byte, query string, auth string) (*batch, error)
 		b.bufs = append(b.bufs, buf)
 	}
 
+	b := *cur
 	l.cond.L.Unlock()
-	return *cur, nil
+	return b, nil
+}
+
+// close releases the callers of the batches left in the list and returns
+// their size.
+func (l *bufferList) close() int {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	if l.closed {
+		return 0
+	}
+	l.closed = true
+	l.cond.Broadcast()
+
+	n := l.size
+	for b := l.head; b != nil; b = b.next {
+		b.finish(nil, ErrBufferClosed)
+	}
+	l.head = nil
+	l.size = 0
+	return n
 }
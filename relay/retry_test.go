@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBuffer(t *testing.T) {
+	var failing, received int32
+	atomic.StoreInt32(&failing, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		p, _ := ioutil.ReadAll(r.Body)
+		atomic.AddInt32(&received, int32(len(p)))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	hb, err := NewHttpBackend(&HTTPOutputConfig{
+		Name:             "b",
+		Location:         ts.URL,
+		Interval:         "1h",
+		BufferSizeMB:     1,
+		BufferWait:       "50ms",
+		MaxDelayInterval: "20ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hb.Close()
+	rb := hb.rb
+
+	// callers only wait for a bounded time
+	if _, err := rb.Write([]byte("cpu value=1\n"), "", ""); err != ErrBufferTimeout {
+		t.Fatalf("expected %s, got %v", ErrBufferTimeout, err)
+	}
+
+	// the worker pauses while the backend is down and writes fail fast
+	for i := 0; i < DefaultFailThreshold; i++ {
+		hb.health.observe(false)
+	}
+	start := time.Now()
+	if _, err := rb.Write([]byte("cpu value=2\n"), "", ""); err != ErrBackendInactive {
+		t.Fatalf("expected %s, got %v", ErrBackendInactive, err)
+	}
+	if time.Since(start) > 40*time.Millisecond {
+		t.Error("write to a down backend waited")
+	}
+
+	// and resumes once it recovers
+	atomic.StoreInt32(&failing, 0)
+	for i := 0; i < DefaultSuccessThreshold; i++ {
+		hb.health.observe(true)
+	}
+	for i := 0; i < 100 && rb.pending(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rb.pending() || atomic.LoadInt32(&received) != int32(len("cpu value=1\ncpu value=2\n")) {
+		t.Fatalf("buffer not delivered after recovery, got %d bytes", atomic.LoadInt32(&received))
+	}
+
+	// writes that don't fit are dropped and counted
+	atomic.StoreInt32(&failing, 1)
+	if _, err := rb.Write(make([]byte, 2*MB), "", ""); err != ErrBufferFull {
+		t.Fatalf("expected %s, got %v", ErrBufferFull, err)
+	}
+	if s := hb.statistics(); s.Dropped != 1 || s.DroppedBytes != 2*MB {
+		t.Errorf("drop not counted: %+v", s)
+	}
+
+	// closing releases the callers still waiting
+	rb.wait = time.Hour
+	done := make(chan error)
+	go func() {
+		_, err := rb.Write([]byte("cpu value=3\n"), "", "")
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	hb.Close()
+	select {
+	case err := <-done:
+		if err != ErrBufferClosed {
+			t.Errorf("expected %s, got %v", ErrBufferClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("caller not released on close")
+	}
+}
@@ -0,0 +1,423 @@
+package relay
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Token is a lexical token of InfluxQL.
+type Token int
+
+const (
+	ILLEGAL Token = iota
+	EOF
+	WS
+	COMMENT
+
+	IDENT    // main
+	QIDENT   // "main"
+	PARAM    // $param
+	NUMBER   // 12.5
+	INTEGER  // 12
+	DURATION // 13h
+	STRING   // 'abc'
+	BADSTRING
+	REGEX // /re/
+	BADREGEX
+
+	ADD // +
+	SUB // -
+	MUL // *
+	DIV // /
+	MOD // %
+	BITWISE_AND
+	BITWISE_OR
+	BITWISE_XOR
+
+	AND // AND
+	OR  // OR
+
+	EQ       // =
+	NEQ      // != or <>
+	EQREGEX  // =~
+	NEQREGEX // !~
+	LT       // <
+	LTE      // <=
+	GT       // >
+	GTE      // >=
+
+	LPAREN      // (
+	RPAREN      // )
+	COMMA       // ,
+	COLON       // :
+	DOUBLECOLON // ::
+	SEMICOLON   // ;
+	DOT         // .
+)
+
+var tokens = map[Token]string{
+	ADD:         "+",
+	SUB:         "-",
+	MUL:         "*",
+	DIV:         "/",
+	MOD:         "%",
+	BITWISE_AND: "&",
+	BITWISE_OR:  "|",
+	BITWISE_XOR: "^",
+	AND:         "AND",
+	OR:          "OR",
+	EQ:          "=",
+	NEQ:         "!=",
+	EQREGEX:     "=~",
+	NEQREGEX:    "!~",
+	LT:          "<",
+	LTE:         "<=",
+	GT:          ">",
+	GTE:         ">=",
+	LPAREN:      "(",
+	RPAREN:      ")",
+	COMMA:       ",",
+	COLON:       ":",
+	DOUBLECOLON: "::",
+	SEMICOLON:   ";",
+	DOT:         ".",
+}
+
+func (t Token) String() string {
+	if s, ok := tokens[t]; ok {
+		return s
+	}
+	return "token"
+}
+
+// Precedence returns the precedence of a binary operator, 0 for others.
+func (t Token) Precedence() int {
+	switch t {
+	case OR:
+		return 1
+	case AND:
+		return 2
+	case EQ, NEQ, EQREGEX, NEQREGEX, LT, LTE, GT, GTE:
+		return 3
+	case ADD, SUB, BITWISE_OR, BITWISE_XOR:
+		return 4
+	case MUL, DIV, MOD, BITWISE_AND:
+		return 5
+	}
+	return 0
+}
+
+const eof = rune(0)
+
+// scanner splits an InfluxQL query into tokens. Regular expressions can't
+// be told apart from division by the scanner alone, so the parser asks for
+// them explicitly with scanRegex.
+type scanner struct {
+	src []byte
+	pos int
+}
+
+func newScanner(q string) *scanner {
+	return &scanner{src: []byte(q)}
+}
+
+func (s *scanner) read() rune {
+	if s.pos >= len(s.src) {
+		s.pos++
+		return eof
+	}
+	r, n := utf8.DecodeRune(s.src[s.pos:])
+	s.pos += n
+	return r
+}
+
+func (s *scanner) unread(r rune) {
+	if r == eof {
+		s.pos--
+		return
+	}
+	s.pos -= utf8.RuneLen(r)
+}
+
+func (s *scanner) peek() rune {
+	r := s.read()
+	s.unread(r)
+	return r
+}
+
+// scan returns the next token, its start offset and literal value.
+func (s *scanner) scan() (tok Token, pos int, lit string) {
+	pos = s.pos
+	ch := s.read()
+
+	switch {
+	case isWhitespace(ch):
+		for isWhitespace(s.peek()) {
+			s.read()
+		}
+		return WS, pos, ""
+	case isIdentFirst(ch):
+		s.unread(ch)
+		return s.scanIdent(pos)
+	case isDigit(ch):
+		s.unread(ch)
+		return s.scanNumber(pos)
+	}
+
+	switch ch {
+	case eof:
+		s.pos = len(s.src)
+		return EOF, pos, ""
+	case '"':
+		lit, ok := s.scanQuoted('"')
+		if !ok {
+			return BADSTRING, pos, lit
+		}
+		return QIDENT, pos, lit
+	case '\'':
+		lit, ok := s.scanQuoted('\'')
+		if !ok {
+			return BADSTRING, pos, lit
+		}
+		return STRING, pos, lit
+	case '.':
+		if isDigit(s.peek()) {
+			s.unread(ch)
+			return s.scanNumber(pos)
+		}
+		return DOT, pos, ""
+	case '$':
+		tok, _, lit = s.scanIdent(s.pos)
+		if tok != IDENT {
+			return ILLEGAL, pos, "$"
+		}
+		return PARAM, pos, lit
+	case '+':
+		return ADD, pos, ""
+	case '-':
+		if s.peek() == '-' {
+			for ch := s.read(); ch != '\n' && ch != eof; ch = s.read() {
+			}
+			return COMMENT, pos, ""
+		}
+		return SUB, pos, ""
+	case '*':
+		return MUL, pos, ""
+	case '/':
+		if s.peek() == '*' {
+			s.read()
+			for {
+				ch := s.read()
+				if ch == eof {
+					return ILLEGAL, pos, ""
+				}
+				if ch == '*' && s.peek() == '/' {
+					s.read()
+					return COMMENT, pos, ""
+				}
+			}
+		}
+		return DIV, pos, ""
+	case '%':
+		return MOD, pos, ""
+	case '&':
+		return BITWISE_AND, pos, ""
+	case '|':
+		return BITWISE_OR, pos, ""
+	case '^':
+		return BITWISE_XOR, pos, ""
+	case '=':
+		if s.peek() == '~' {
+			s.read()
+			return EQREGEX, pos, ""
+		}
+		return EQ, pos, ""
+	case '!':
+		switch next := s.read(); next {
+		case '=':
+			return NEQ, pos, ""
+		case '~':
+			return NEQREGEX, pos, ""
+		default:
+			s.unread(next)
+		}
+		return ILLEGAL, pos, "!"
+	case '<':
+		switch next := s.read(); next {
+		case '=':
+			return LTE, pos, ""
+		case '>':
+			return NEQ, pos, ""
+		default:
+			s.unread(next)
+		}
+		return LT, pos, ""
+	case '>':
+		if s.peek() == '=' {
+			s.read()
+			return GTE, pos, ""
+		}
+		return GT, pos, ""
+	case '(':
+		return LPAREN, pos, ""
+	case ')':
+		return RPAREN, pos, ""
+	case ',':
+		return COMMA, pos, ""
+	case ':':
+		if s.peek() == ':' {
+			s.read()
+			return DOUBLECOLON, pos, ""
+		}
+		return COLON, pos, ""
+	case ';':
+		return SEMICOLON, pos, ""
+	}
+
+	return ILLEGAL, pos, string(ch)
+}
+
+func (s *scanner) scanIdent(pos int) (Token, int, string) {
+	var buf bytes.Buffer
+	for {
+		ch := s.read()
+		if !isIdentChar(ch) {
+			s.unread(ch)
+			break
+		}
+		buf.WriteRune(ch)
+	}
+
+	lit := buf.String()
+	switch strings.ToLower(lit) {
+	case "and":
+		return AND, pos, lit
+	case "or":
+		return OR, pos, lit
+	}
+	return IDENT, pos, lit
+}
+
+// scanNumber scans an integer, a decimal number or a duration.
+func (s *scanner) scanNumber(pos int) (Token, int, string) {
+	var buf bytes.Buffer
+	tok := INTEGER
+
+	for isDigit(s.peek()) {
+		buf.WriteRune(s.read())
+	}
+	if s.peek() == '.' {
+		s.read()
+		if !isDigit(s.peek()) {
+			s.unread('.')
+		} else {
+			tok = NUMBER
+			buf.WriteRune('.')
+			for isDigit(s.peek()) {
+				buf.WriteRune(s.read())
+			}
+		}
+	}
+
+	// duration units, possibly chained as in 1h30m
+	if tok == INTEGER && isDurationUnit(s.peek()) {
+		for {
+			for isDigit(s.peek()) {
+				buf.WriteRune(s.read())
+			}
+			if !isDurationUnit(s.peek()) {
+				break
+			}
+			for isDurationUnit(s.peek()) {
+				buf.WriteRune(s.read())
+			}
+		}
+		return DURATION, pos, buf.String()
+	}
+
+	return tok, pos, buf.String()
+}
+
+// scanQuoted scans a string or quoted identifier after the opening quote.
+func (s *scanner) scanQuoted(quote rune) (string, bool) {
+	var buf bytes.Buffer
+	for {
+		ch := s.read()
+		switch ch {
+		case quote:
+			return buf.String(), true
+		case eof, '\n':
+			return buf.String(), false
+		case '\\':
+			next := s.read()
+			switch next {
+			case 'n':
+				buf.WriteRune('\n')
+			case '\\':
+				buf.WriteRune('\\')
+			case '"', '\'':
+				buf.WriteRune(next)
+			default:
+				return buf.String(), false
+			}
+		default:
+			buf.WriteRune(ch)
+		}
+	}
+}
+
+// scanRegex scans a regular expression, skipping leading whitespace. If
+// the next token isn't a regex the scanner is left untouched.
+func (s *scanner) scanRegex() (tok Token, pos int, lit string) {
+	start := s.pos
+	for isWhitespace(s.peek()) {
+		s.read()
+	}
+
+	pos = s.pos
+	if s.read() != '/' {
+		s.pos = start
+		return ILLEGAL, pos, ""
+	}
+
+	var buf bytes.Buffer
+	for {
+		ch := s.read()
+		switch ch {
+		case '/':
+			return REGEX, pos, buf.String()
+		case eof, '\n':
+			return BADREGEX, pos, buf.String()
+		case '\\':
+			if s.peek() == '/' {
+				buf.WriteRune(s.read())
+				continue
+			}
+			buf.WriteRune(ch)
+		default:
+			buf.WriteRune(ch)
+		}
+	}
+}
+
+func isWhitespace(ch rune) bool { return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' }
+
+func isDigit(ch rune) bool { return ch >= '0' && ch <= '9' }
+
+func isIdentFirst(ch rune) bool {
+	return unicode.IsLetter(ch) || ch == '_'
+}
+
+func isIdentChar(ch rune) bool {
+	return isIdentFirst(ch) || isDigit(ch)
+}
+
+func isDurationUnit(ch rune) bool {
+	switch ch {
+	case 'n', 's', 'u', 'µ', 'm', 'h', 'd', 'w':
+		return true
+	}
+	return false
+}
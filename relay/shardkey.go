@@ -0,0 +1,121 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+var ErrInvalidShardKey = errors.New("invalid shard key")
+
+// ShardKey decides which part of a point is hashed onto the ring:
+// the measurement name (default), the measurement plus some tag values,
+// or the full series key.
+type ShardKey struct {
+	series bool
+	tags   []string
+}
+
+// ParseShardKey parses the shard-key setting, which is either "measurement",
+// "series" or "measurement" followed by a comma separated list of tag keys,
+// e.g. "measurement,host".
+func ParseShardKey(s string) (*ShardKey, error) {
+	k := new(ShardKey)
+
+	parts := strings.Split(s, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+
+	switch {
+	case s == "" || (len(parts) == 1 && parts[0] == "measurement"):
+	case len(parts) == 1 && parts[0] == "series":
+		k.series = true
+	case parts[0] == "measurement":
+		for _, t := range parts[1:] {
+			if t == "" {
+				return nil, ErrInvalidShardKey
+			}
+			k.tags = append(k.tags, t)
+		}
+	default:
+		return nil, fmt.Errorf("%s: %q", ErrInvalidShardKey, s)
+	}
+
+	return k, nil
+}
+
+// MeasurementOnly reports whether points are routed by measurement name alone.
+func (k *ShardKey) MeasurementOnly() bool {
+	return !k.series && len(k.tags) == 0
+}
+
+// Key returns the routing key of a parsed point.
+func (k *ShardKey) Key(p models.Point) string {
+	if k.series {
+		return string(p.Key())
+	}
+	if len(k.tags) == 0 {
+		return string(p.Name())
+	}
+
+	tags := p.Tags()
+	values := make(map[string]string, len(k.tags))
+	for _, t := range k.tags {
+		if v := tags.GetString(t); v != "" {
+			values[t] = v
+		}
+	}
+	return k.join(string(p.Name()), values)
+}
+
+// join builds the routing key from a measurement and the shard tag values.
+func (k *ShardKey) join(m string, values map[string]string) string {
+	key := m
+	for _, t := range k.tags {
+		if v, ok := values[t]; ok {
+			key += "," + t + "=" + v
+		}
+	}
+	return key
+}
+
+// ScanKey returns the routing key of a line of line protocol.
+func (k *ShardKey) ScanKey(line []byte) (string, error) {
+	if k.MeasurementOnly() {
+		return ScanKey(line)
+	}
+
+	points, err := models.ParsePoints(line)
+	if err != nil {
+		return "", err
+	}
+	if len(points) == 0 {
+		return "", io.EOF
+	}
+	return k.Key(points[0]), nil
+}
+
+// QueryKey returns the routing key of statement st against measurement m
+// when its WHERE clause pins every shard tag to a single value. Otherwise
+// ok is false and the statement has to go to every shard.
+func (k *ShardKey) QueryKey(st *Statement, m string) (key string, ok bool) {
+	if k.MeasurementOnly() {
+		return m, true
+	}
+	if k.series {
+		return "", false
+	}
+
+	values := st.TagValues()
+	for _, t := range k.tags {
+		if _, pinned := values[t]; !pinned {
+			return "", false
+		}
+	}
+
+	return k.join(m, values), true
+}
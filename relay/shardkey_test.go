@@ -0,0 +1,68 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestShardKey(t *testing.T) {
+	points, err := models.ParsePointsString("cpu,host=serverA,region=uswest value=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := points[0]
+
+	checkShardKey(t, "", p, "cpu")
+	checkShardKey(t, "measurement", p, "cpu")
+	checkShardKey(t, "measurement,host", p, "cpu,host=serverA")
+	checkShardKey(t, "measurement, region, host", p, "cpu,region=uswest,host=serverA")
+	checkShardKey(t, "measurement,dc", p, "cpu")
+	checkShardKey(t, "series", p, "cpu,host=serverA,region=uswest")
+
+	if _, err := ParseShardKey("host"); err == nil {
+		t.Error("shard key without measurement should be rejected")
+	}
+}
+
+func checkShardKey(t *testing.T, cfg string, p models.Point, expected string) {
+	k, err := ParseShardKey(cfg)
+	if err != nil {
+		t.Errorf("parse %q: %s", cfg, err)
+		return
+	}
+	if key := k.Key(p); key != expected {
+		t.Errorf("shard key %q wrong: %s != %s", cfg, key, expected)
+	}
+
+	line := []byte(p.String())
+	if key, err := k.ScanKey(line); err != nil || key != expected {
+		t.Errorf("scan key %q wrong: %s != %s (%v)", cfg, key, expected, err)
+	}
+}
+
+func TestShardQueryKey(t *testing.T) {
+	k, _ := ParseShardKey("measurement,host")
+
+	checkQueryKey(t, k, "SELECT value FROM cpu WHERE \"host\" = 'serverA'", "cpu,host=serverA", true)
+	checkQueryKey(t, k, "SELECT value FROM cpu WHERE host = 'serverA' AND time > now() - 1h", "cpu,host=serverA", true)
+	checkQueryKey(t, k, "SELECT value FROM cpu", "", false)
+	checkQueryKey(t, k, "SELECT value FROM cpu WHERE region = 'uswest'", "", false)
+	checkQueryKey(t, k, "SELECT value FROM cpu WHERE host = 'serverA' OR host = 'serverB'", "", false)
+	checkQueryKey(t, k, "SELECT value FROM cpu WHERE host =~ /server.*/", "", false)
+
+	k, _ = ParseShardKey("measurement")
+	checkQueryKey(t, k, "SELECT value FROM cpu", "cpu", true)
+}
+
+func checkQueryKey(t *testing.T, k *ShardKey, q, expected string, pinned bool) {
+	stmts, err := ParseInfluxQL(q)
+	if err != nil {
+		t.Errorf("parse %s: %s", q, err)
+		return
+	}
+	key, ok := k.QueryKey(stmts[0], "cpu")
+	if ok != pinned || key != expected {
+		t.Errorf("query key wrong for %s: %q/%v != %q/%v", q, key, ok, expected, pinned)
+	}
+}
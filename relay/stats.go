@@ -0,0 +1,278 @@
+package relay
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backendCounters are the statistics kept by every backend. They survive
+// reloads that keep the backend.
+type backendCounters struct {
+	writes       int64
+	writesFail   int64
+	bytesWritten int64
+	retries      int64
+	up           int64
+	down         int64
+	dropped      int64
+	droppedBytes int64
+	rejected     int64
+
+	lock          sync.Mutex
+	lastError     string
+	lastErrorTime time.Time
+	lastPing      time.Time
+}
+
+func (c *backendCounters) write(n int, err error) {
+	atomic.AddInt64(&c.writes, 1)
+	if err == nil {
+		atomic.AddInt64(&c.bytesWritten, int64(n))
+		return
+	}
+	atomic.AddInt64(&c.writesFail, 1)
+	c.lock.Lock()
+	c.lastError, c.lastErrorTime = err.Error(), time.Now()
+	c.lock.Unlock()
+}
+
+// drop counts a write of n bytes the retry buffer had to drop.
+func (c *backendCounters) drop(n int) {
+	atomic.AddInt64(&c.dropped, 1)
+	atomic.AddInt64(&c.droppedBytes, int64(n))
+}
+
+func (c *backendCounters) pinged() {
+	c.lock.Lock()
+	c.lastPing = time.Now()
+	c.lock.Unlock()
+}
+
+// BackendStats is a snapshot of the statistics of a backend.
+type BackendStats struct {
+	Ring          string     `json:"ring"`
+	Shard         string     `json:"shard"`
+	Backend       string     `json:"backend"`
+	Location      string     `json:"location"`
+	Active        bool       `json:"active"`
+	State         string     `json:"state"`
+	Buffering     bool       `json:"buffering"`
+	BufferedBytes int64      `json:"buffered_bytes"`
+	Writes        int64      `json:"writes"`
+	WritesFail    int64      `json:"writes_fail"`
+	BytesWritten  int64      `json:"bytes_written"`
+	Retries       int64      `json:"retries"`
+	Up            int64      `json:"up"`
+	Down          int64      `json:"down"`
+	Dropped       int64      `json:"dropped"`
+	DroppedBytes  int64      `json:"dropped_bytes"`
+	Rejected      int64      `json:"rejected"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+	LastPing      *time.Time `json:"last_ping,omitempty"`
+}
+
+func (hb *HttpBackend) statistics() *BackendStats {
+	c := &hb.counters
+	s := &BackendStats{
+		Backend:       hb.name,
+		Location:      hb.Location,
+		Active:        hb.IsActive(),
+		State:         hb.State().String(),
+		BufferedBytes: hb.bufferedBytes(),
+		Writes:        atomic.LoadInt64(&c.writes),
+		WritesFail:    atomic.LoadInt64(&c.writesFail),
+		BytesWritten:  atomic.LoadInt64(&c.bytesWritten),
+		Retries:       atomic.LoadInt64(&c.retries),
+		Up:            atomic.LoadInt64(&c.up),
+		Down:          atomic.LoadInt64(&c.down),
+		Dropped:       atomic.LoadInt64(&c.dropped),
+		DroppedBytes:  atomic.LoadInt64(&c.droppedBytes),
+		Rejected:      atomic.LoadInt64(&c.rejected),
+	}
+	if hb.rb != nil {
+		s.Buffering = atomic.LoadInt32(&hb.rb.buffering) != 0
+	}
+
+	c.lock.Lock()
+	s.LastError = c.lastError
+	if !c.lastErrorTime.IsZero() {
+		t := c.lastErrorTime
+		s.LastErrorTime = &t
+	}
+	if !c.lastPing.IsZero() {
+		t := c.lastPing
+		s.LastPing = &t
+	}
+	c.lock.Unlock()
+	return s
+}
+
+// fields returns the statistics as the fields of a point.
+func (s *BackendStats) fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"active":        s.Active,
+		"state":         s.State,
+		"buffering":     s.Buffering,
+		"bufferedBytes": s.BufferedBytes,
+		"writes":        s.Writes,
+		"writesFail":    s.WritesFail,
+		"bytesWritten":  s.BytesWritten,
+		"retries":       s.Retries,
+		"up":            s.Up,
+		"down":          s.Down,
+		"dropped":       s.Dropped,
+		"droppedBytes":  s.DroppedBytes,
+		"rejected":      s.Rejected,
+	}
+	if s.LastError != "" {
+		fields["lastError"] = s.LastError
+	}
+	if s.LastPing != nil {
+		fields["lastPing"] = s.LastPing.UnixNano()
+	}
+	return fields
+}
+
+// listenerCounters are the statistics of a listener writing to the
+// cluster. received counts datagrams or lines, depending on the protocol.
+type listenerCounters struct {
+	name     string
+	protocol string
+	addr     string
+
+	received  int64
+	bytes     int64
+	points    int64
+	parseFail int64
+	writeFail int64
+}
+
+// ListenerStats is a snapshot of the statistics of a listener.
+type ListenerStats struct {
+	Listener  string `json:"listener"`
+	Protocol  string `json:"protocol"`
+	Addr      string `json:"addr"`
+	Received  int64  `json:"received"`
+	Bytes     int64  `json:"bytes"`
+	Points    int64  `json:"points"`
+	ParseFail int64  `json:"parse_fail"`
+	WriteFail int64  `json:"write_fail"`
+}
+
+func (s *ListenerStats) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"received":  s.Received,
+		"bytes":     s.Bytes,
+		"points":    s.Points,
+		"parseFail": s.ParseFail,
+		"writeFail": s.WriteFail,
+	}
+}
+
+// addListener registers the statistics of a listener writing to the
+// cluster.
+func (ic *InfluxCluster) addListener(name, protocol, addr string) *listenerCounters {
+	c := &listenerCounters{name: name, protocol: protocol, addr: addr}
+	ic.lock.Lock()
+	ic.listeners = append(ic.listeners, c)
+	ic.lock.Unlock()
+	return c
+}
+
+func (ic *InfluxCluster) listenerStatistics() []*ListenerStats {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+
+	var list []*ListenerStats
+	for _, c := range ic.listeners {
+		list = append(list, &ListenerStats{
+			Listener:  c.name,
+			Protocol:  c.protocol,
+			Addr:      c.addr,
+			Received:  atomic.LoadInt64(&c.received),
+			Bytes:     atomic.LoadInt64(&c.bytes),
+			Points:    atomic.LoadInt64(&c.points),
+			ParseFail: atomic.LoadInt64(&c.parseFail),
+			WriteFail: atomic.LoadInt64(&c.writeFail),
+		})
+	}
+	return list
+}
+
+// backendStatistics returns the statistics of every backend, ordered by
+// ring and shard.
+func (ic *InfluxCluster) backendStatistics() []*BackendStats {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+
+	var list []*BackendStats
+	for _, ring := range []string{"current", "former"} {
+		nodes := ic.nodes
+		if ring == "former" {
+			nodes = ic.formerNodes
+		}
+
+		shards := make([]string, 0, len(nodes))
+		for k := range nodes {
+			shards = append(shards, k)
+		}
+		sort.Strings(shards)
+
+		for _, shard := range shards {
+			for _, hb := range nodes[shard] {
+				s := hb.statistics()
+				s.Ring, s.Shard = ring, shard
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
+// showStats returns the statistics in the format of a SHOW STATS query,
+// a series per module with the tags identifying it.
+func (ic *InfluxCluster) showStats() *Result {
+	relay := ic.statsMetric(time.Now())
+	d := &data{Series: []*series{statsSeries("relay", relay.Tags, relay.Fields)}}
+
+	ic.lock.RLock()
+	tags := ic.tags(nil)
+	ic.lock.RUnlock()
+
+	for _, s := range ic.backendStatistics() {
+		t := make(map[string]string, len(tags)+4)
+		for k, v := range tags {
+			t[k] = v
+		}
+		t["ring"], t["shard"], t["backend"], t["location"] = s.Ring, s.Shard, s.Backend, s.Location
+		d.Series = append(d.Series, statsSeries("backend", t, s.fields()))
+	}
+
+	for _, s := range ic.listenerStatistics() {
+		t := make(map[string]string, len(tags)+3)
+		for k, v := range tags {
+			t[k] = v
+		}
+		t["listener"], t["protocol"], t["addr"] = s.Listener, s.Protocol, s.Addr
+		d.Series = append(d.Series, statsSeries("listener", t, s.fields()))
+	}
+	return &Result{Results: []*data{d}}
+}
+
+func statsSeries(name string, tags map[string]string, fields map[string]interface{}) *series {
+	s := &series{Name: name, Tags: tags}
+	for k := range fields {
+		s.Columns = append(s.Columns, k)
+	}
+	sort.Strings(s.Columns)
+
+	row := make([]interface{}, len(s.Columns))
+	for i, c := range s.Columns {
+		row[i] = fields[c]
+	}
+	s.Values = [][]interface{}{row}
+	return s
+}
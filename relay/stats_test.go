@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	r, err := NewHTTP(HTTPConfig{
+		Name:             "test",
+		Replicas:         10,
+		WriteConsistency: "one",
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {
+				{Name: "a1", Location: ts.URL},
+				{Name: "a2", Location: "http://127.0.0.1:1", Interval: "10ms"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := r.(*HTTP)
+	defer h.ic.Close()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/write?db=test", strings.NewReader("cpu value=1\n")))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("write answered %d: %s", w.Code, w.Body)
+	}
+
+	// a2 fails its pings and goes down
+	for i := 0; i < 100 && h.ic.backends("a")[1].IsActive(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/stats", nil))
+	var stats struct {
+		Fields   map[string]interface{} `json:"fields"`
+		Backends []*BackendStats        `json:"backends"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Fields["statWriteRequest"] != float64(1) || len(stats.Backends) != 2 {
+		t.Fatalf("unexpected stats %s", w.Body)
+	}
+
+	a1, a2 := stats.Backends[0], stats.Backends[1]
+	if a1.Backend != "a1" || a1.Writes != 1 || a1.WritesFail != 0 || a1.BytesWritten == 0 {
+		t.Errorf("unexpected a1 stats %+v", a1)
+	}
+	if a2.Backend != "a2" || a2.WritesFail != 1 || a2.LastError == "" || a2.LastErrorTime == nil {
+		t.Errorf("unexpected a2 stats %+v", a2)
+	}
+	if a2.Active || a2.Down != 1 || a2.LastPing != nil {
+		t.Errorf("a2 not reported down %+v", a2)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/stats?format=influxql", nil))
+	res := new(Result)
+	if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Results) != 1 || len(res.Results[0].Series) != 3 {
+		t.Fatalf("unexpected SHOW STATS result %s", w.Body)
+	}
+	s := res.Results[0].Series[2]
+	if s.Name != "backend" || s.Tags["backend"] != "a2" || s.Tags["shard"] != "a" {
+		t.Errorf("unexpected series %+v", s)
+	}
+	if i := columnIndex(s.Columns, "writesFail"); i < 0 || s.Values[0][i] != float64(1) {
+		t.Errorf("unexpected series values %+v", s)
+	}
+}
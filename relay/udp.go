@@ -0,0 +1,238 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	// Largest datagram a UDP relay reads, anything longer is truncated by
+	// the socket.
+	UDPBufferSize = 64 * KB
+
+	// Largest datagram sent to a UDP backend, the same default as the
+	// UDP client of InfluxDB.
+	DefaultUDPPayloadSize = 512
+)
+
+var ErrUDPQuery = errors.New("querying via UDP is not supported")
+
+var precisions = map[string]bool{"": true, "n": true, "ns": true, "u": true, "ms": true, "s": true, "m": true, "h": true}
+
+// UDP is a relay for line protocol sent over UDP. Points are routed by the
+// cluster of an HTTP relay, every datagram is written with consistency any.
+type UDP struct {
+	cfg  UDPConfig
+	addr string
+	name string
+
+	query     string
+	precision string
+
+	closing int64
+	started int32
+	conn    *net.UDPConn
+	done    chan struct{}
+
+	ic    *InfluxCluster
+	stats *listenerCounters
+}
+
+// NewUDP binds a UDP relay that writes to the cluster ic.
+func NewUDP(cfg UDPConfig, ic *InfluxCluster) (Relay, error) {
+	u := new(UDP)
+	u.cfg = cfg
+	u.addr = cfg.Addr
+	u.name = cfg.Name
+	u.ic = ic
+	u.done = make(chan struct{})
+
+	if cfg.Database == "" {
+		return nil, fmt.Errorf("udp relay %s: missing database", u.Name())
+	}
+	if !precisions[cfg.Precision] {
+		return nil, fmt.Errorf("udp relay %s: invalid precision %q", u.Name(), cfg.Precision)
+	}
+	u.precision = cfg.Precision
+
+	params := url.Values{}
+	params.Set("db", cfg.Database)
+	if cfg.RetentionPolicy != "" {
+		params.Set("rp", cfg.RetentionPolicy)
+	}
+	if cfg.Precision != "" {
+		params.Set("precision", cfg.Precision)
+	}
+	u.query = params.Encode()
+
+	addr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	u.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ReadBuffer > 0 {
+		if err := u.conn.SetReadBuffer(cfg.ReadBuffer); err != nil {
+			u.conn.Close()
+			return nil, fmt.Errorf("error setting read buffer '%v'", err)
+		}
+	}
+
+	u.stats = ic.addListener(u.Name(), "udp", u.conn.LocalAddr().String())
+	return u, nil
+}
+
+func (u *UDP) Name() string {
+	if u.name == "" {
+		return "udp://" + u.addr
+	}
+	return u.name
+}
+
+// udpRelayName returns the name a UDP relay with cfg gets.
+func udpRelayName(cfg UDPConfig) string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return "udp://" + cfg.Addr
+}
+
+func (u *UDP) Run() error {
+	atomic.StoreInt32(&u.started, 1)
+	defer close(u.done)
+	log.Printf("Starting UDP relay %q on %v", u.Name(), u.conn.LocalAddr())
+
+	buf := make([]byte, UDPBufferSize)
+	for {
+		n, _, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			if atomic.LoadInt64(&u.closing) == 1 {
+				return nil
+			}
+			log.Printf("Error reading packet in relay %q: %v\n", u.Name(), err)
+			continue
+		}
+		u.handle(buf[:n])
+	}
+}
+
+// handle routes the points of a datagram. Routing copies them out of buf,
+// the writes to the backends run in the background.
+func (u *UDP) handle(buf []byte) {
+	atomic.AddInt64(&u.stats.received, 1)
+	atomic.AddInt64(&u.stats.bytes, int64(len(buf)))
+
+	points, err := models.ParsePointsWithPrecision(buf, time.Now().UTC(), u.precision)
+	if err != nil {
+		atomic.AddInt64(&u.stats.parseFail, 1)
+		log.Printf("unable to parse points in relay %q: %v\n", u.Name(), err)
+		if len(points) == 0 {
+			return
+		}
+	}
+	atomic.AddInt64(&u.stats.points, int64(len(points)))
+
+	rw := u.ic.routePoints(points, u.precision)
+	u.ic.async(func() {
+		if err := u.ic.writeRouted(rw, u.query, "", models.ConsistencyLevelAny); err != nil {
+			atomic.AddInt64(&u.stats.writeFail, 1)
+		}
+	})
+}
+
+func (u *UDP) Stop() error {
+	atomic.StoreInt64(&u.closing, 1)
+	return u.conn.Close()
+}
+
+// Shutdown stops reading datagrams. The writes already routed are left to
+// the shutdown of the HTTP relay owning the cluster.
+func (u *UDP) Shutdown() error {
+	if err := u.Stop(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&u.started) == 1 {
+		<-u.done
+	}
+	return nil
+}
+
+// udpWriter sends writes to a UDP listener, such as the UDP service of
+// InfluxDB, which only takes writes.
+type udpWriter struct {
+	conn        net.Conn
+	payloadSize int
+}
+
+func newUDPWriter(addr string, payloadSize int) (*udpWriter, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpWriter{conn: conn, payloadSize: payloadSize}, nil
+}
+
+// write sends the points of buf in datagrams of up to payloadSize bytes,
+// splitting the fields of points too large for one. Timestamps are sent
+// in nanoseconds, UDP listeners have a fixed precision. Lines that don't
+// parse are answered like InfluxDB does, with a 400 partial write.
+func (w *udpWriter) write(buf []byte, query string) (*responseData, error) {
+	var precision string
+	if values, err := url.ParseQuery(query); err == nil {
+		precision = values.Get("precision")
+	}
+	points, perr := models.ParsePointsWithPrecision(buf, time.Now().UTC(), precision)
+
+	b := make([]byte, 0, w.payloadSize)
+	var err error
+	send := func(n int) {
+		if len(b) > 0 && len(b)+n > w.payloadSize {
+			if _, e := w.conn.Write(b); e != nil {
+				err = e
+			}
+			b = b[:0]
+		}
+	}
+
+	for _, p := range points {
+		size := p.StringSize() + 1
+		if size <= w.payloadSize {
+			send(size)
+			b = append(p.AppendString(b), '\n')
+			continue
+		}
+		for _, sp := range p.Split(w.payloadSize - 1) {
+			send(sp.StringSize() + 1)
+			b = append(sp.AppendString(b), '\n')
+		}
+	}
+	send(w.payloadSize + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if perr != nil {
+		body, _ := json.Marshal(map[string]string{"error": "partial write: " + perr.Error()})
+		return &responseData{ContentType: "application/json", StatusCode: http.StatusBadRequest, Body: body}, nil
+	}
+	return &responseData{StatusCode: http.StatusNoContent}, nil
+}
+
+func (w *udpWriter) close() error {
+	return w.conn.Close()
+}
@@ -0,0 +1,178 @@
+package relay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestUDP(t *testing.T) {
+	var lock sync.Mutex
+	var queries []string
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		body = append(body, p...)
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	ic, err := NewInfluxCluster(HTTPConfig{
+		Replicas: 10,
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: ts.URL, Interval: "1h"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+
+	if _, err := NewUDP(UDPConfig{Addr: "127.0.0.1:0", Database: "test", Precision: "us"}, ic); err == nil {
+		t.Error("expected an error for an invalid precision")
+	}
+
+	r, err := NewUDP(UDPConfig{Name: "u", Addr: "127.0.0.1:0", Database: "test", Precision: "s"}, ic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := r.(*UDP)
+	go u.Run()
+
+	conn, err := net.Dial("udp", u.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("cpu value=1 1500000000\n"))
+	conn.Write([]byte("cpu value= 1500000000\nmem value=2 1500000000\n"))
+
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		n := len(queries)
+		lock.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := u.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(queries) != 2 || queries[0] != "db=test&precision=s" {
+		t.Fatalf("unexpected writes %v", queries)
+	}
+	// the datagrams are written in the background, in any order
+	if len(body) != len("cpu value=1 1500000000\nmem value=2 1500000000\n") ||
+		!bytes.Contains(body, []byte("cpu value=1 1500000000\n")) || !bytes.Contains(body, []byte("mem value=2 1500000000\n")) {
+		t.Errorf("unexpected points %q", body)
+	}
+
+	s := ic.listenerStatistics()
+	if len(s) != 1 || s[0].Listener != "u" || s[0].Received != 2 || s[0].Points != 2 || s[0].ParseFail != 1 {
+		t.Errorf("unexpected listener stats %+v", s[0])
+	}
+}
+
+func TestUDPBackend(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	hb, err := NewHttpBackend(&HTTPOutputConfig{
+		Name:           "u1",
+		Location:       "udp://" + conn.LocalAddr().String(),
+		Interval:       "1h",
+		UDPPayloadSize: 64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hb.Close()
+
+	if hb.queryable() {
+		t.Error("udp backend should not take queries")
+	}
+
+	// seconds are sent as nanoseconds, the long point is split by field
+	p := []byte("cpu,host=a value=1 1500000000\nmem,host=a free=1,used=2,total=3,cached=4,buffers=5 1500000000\ncpu value=\n")
+	resp, err := hb.Write(p, "db=test&precision=s", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest || !rejected(resp, nil) {
+		t.Errorf("expected the bad line to be rejected, got %d %s", resp.StatusCode, resp.Body)
+	}
+
+	var got []byte
+	buf := make([]byte, UDPBufferSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		if n > 64 {
+			t.Errorf("datagram of %d bytes is over the payload size", n)
+		}
+		got = append(got, buf[:n]...)
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	}
+
+	points, err := models.ParsePoints(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := 0
+	for _, pt := range points {
+		if pt.UnixNano() != 1500000000*int64(time.Second) {
+			t.Errorf("unexpected timestamp %s", pt)
+		}
+		f, _ := pt.Fields()
+		fields += len(f)
+	}
+	if fields != 6 || len(points) < 3 {
+		t.Errorf("unexpected points sent %q", got)
+	}
+	if s := hb.statistics(); s.Rejected != 1 {
+		t.Errorf("expected 1 rejected line, got %d", s.Rejected)
+	}
+}
+
+func TestUDPBackendClosedOnError(t *testing.T) {
+	openFiles := func() int {
+		fds, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip("no /proc/self/fd")
+		}
+		return len(fds)
+	}
+
+	before := openFiles()
+	for _, cfg := range []HTTPOutputConfig{
+		{Name: "u", Location: "udp://127.0.0.1:8089", BufferSizeMB: 1, MaxDelayInterval: "bogus"},
+		{Name: "u", Location: "udp://127.0.0.1:8089", BufferSizeMB: 1, BufferWait: "bogus"},
+	} {
+		if _, err := newHttpBackend(&cfg, nil, nil); err == nil {
+			t.Fatalf("%+v: expected an error", cfg)
+		}
+	}
+	if n := openFiles(); n != before {
+		t.Errorf("udp socket left open: %d files open, %d before", n, before)
+	}
+}
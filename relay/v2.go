@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Precisions of the InfluxDB 2.x API and their 1.x names
+var v2Precisions = map[string]string{
+	"":   "",
+	"ns": "n",
+	"us": "u",
+	"ms": "ms",
+	"s":  "s",
+}
+
+// Codes of the errors of the InfluxDB 2.x API by status
+var v2Codes = map[int]string{
+	http.StatusBadRequest:            "invalid",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not found",
+	http.StatusMethodNotAllowed:      "method not allowed",
+	http.StatusRequestEntityTooLarge: "request too large",
+	http.StatusInternalServerError:   "internal error",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// HandlerWriteV2 takes writes of the InfluxDB 2.x API and forwards them to
+// the 1.x backends like /write does. The bucket is mapped to a database
+// and retention policy, the org is ignored.
+func (h *HTTP) HandlerWriteV2(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		v2Error(w, http.StatusMethodNotAllowed, "invalid write method")
+		atomic.AddInt64(&h.ic.stats.WriteRequestsFail, 1)
+		return
+	}
+
+	q := req.URL.Query()
+	bucket := q.Get("bucket")
+	if bucket == "" {
+		v2Error(w, http.StatusBadRequest, "bucket not specified")
+		atomic.AddInt64(&h.ic.stats.WriteRequestsFail, 1)
+		return
+	}
+
+	precision, ok := v2Precisions[q.Get("precision")]
+	if !ok {
+		v2Error(w, http.StatusBadRequest, fmt.Sprintf("invalid precision %q, valid values are ns, us, ms and s", q.Get("precision")))
+		atomic.AddInt64(&h.ic.stats.WriteRequestsFail, 1)
+		return
+	}
+
+	db, rp := h.bucket(bucket)
+	defaultRP, level := h.writeDefaults()
+	params := url.Values{"db": {db}}
+	if rp == "" {
+		rp = defaultRP
+	}
+	if rp != "" {
+		params.Set("rp", rp)
+	}
+	if precision != "" {
+		params.Set("precision", precision)
+	}
+
+	err := h.write(req, params, v2Auth(req.Header.Get("Authorization")), level, start)
+	switch e := err.(type) {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case *requestError:
+		v2Error(w, e.code, e.msg)
+	case *WriteError:
+		code := http.StatusServiceUnavailable
+		if e.Partial {
+			code = http.StatusInternalServerError
+		}
+		msg := e.Error()
+		for _, f := range e.Failed {
+			msg += fmt.Sprintf("; %s (shard %s): %s", f.Backend, f.Shard, f.Error)
+		}
+		v2Error(w, code, msg)
+	default:
+		v2Error(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// bucket returns the database and retention policy of a bucket, from the
+// buckets of the configuration or else read as "db/rp".
+func (h *HTTP) bucket(name string) (db, rp string) {
+	h.ic.lock.RLock()
+	m, ok := h.ic.cfg.Buckets[name]
+	h.ic.lock.RUnlock()
+	if !ok {
+		m = name
+	}
+
+	if i := strings.IndexByte(m, '/'); i >= 0 {
+		return m[:i], m[i+1:]
+	}
+	return m, ""
+}
+
+// v2Auth turns a "Token username:password" header, which is how 2.x
+// clients authenticate against 1.x, into basic auth every 1.x backend
+// understands. Other headers are passed as is.
+func v2Auth(auth string) string {
+	token := strings.TrimPrefix(auth, "Token ")
+	if token == auth || !strings.Contains(token, ":") {
+		return auth
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(token))
+}
+
+func v2Error(w http.ResponseWriter, code int, message string) {
+	c, ok := v2Codes[code]
+	if !ok {
+		c = "internal error"
+	}
+	data, _ := json.Marshal(struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}{c, message})
+	data = append(data, '\n')
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.WriteHeader(code)
+	w.Write(data)
+}
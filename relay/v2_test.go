@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteV2(t *testing.T) {
+	var lock sync.Mutex
+	var queries, auths, bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		auths = append(auths, r.Header.Get("Authorization"))
+		bodies = append(bodies, string(p))
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	r, err := NewHTTP(HTTPConfig{
+		Replicas:         10,
+		WriteConsistency: "all",
+		Buckets:          map[string]string{"metrics": "telegraf/weekly"},
+		Outputs: map[string][]HTTPOutputConfig{
+			"a": {{Name: "a1", Location: ts.URL, Interval: "1h"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := r.(*HTTP)
+	defer h.ic.Close()
+
+	tests := []struct {
+		url   string
+		auth  string
+		code  int
+		query string
+		sent  string
+	}{
+		{"/api/v2/write?org=o&bucket=metrics&precision=s", "Token user:secret", 204, "db=telegraf&precision=s&rp=weekly", "Basic dXNlcjpzZWNyZXQ="},
+		{"/api/v2/write?bucket=db/autogen&precision=us", "", 204, "db=db&precision=u&rp=autogen", ""},
+		{"/api/v2/write?bucket=db", "Token abc", 204, "db=db", "Token abc"},
+		{"/api/v2/write?org=o", "", 400, "", ""},
+		{"/api/v2/write?bucket=db&precision=n", "", 400, "", ""},
+	}
+	for _, tt := range tests {
+		lock.Lock()
+		queries, auths, bodies = nil, nil, nil
+		lock.Unlock()
+
+		req := httptest.NewRequest("POST", tt.url, strings.NewReader("cpu value=1 1500000000\n"))
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d %s", tt.url, tt.code, w.Code, w.Body)
+			continue
+		}
+
+		lock.Lock()
+		if tt.code == 204 && (len(queries) != 1 || queries[0] != tt.query || auths[0] != tt.sent || bodies[0] != "cpu value=1 1500000000\n") {
+			t.Errorf("%s: unexpected backend write %q %q %q", tt.url, queries, auths, bodies)
+		}
+		lock.Unlock()
+
+		if tt.code != 204 {
+			var e struct{ Code, Message string }
+			if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || e.Code != "invalid" || e.Message == "" {
+				t.Errorf("%s: unexpected error body %s", tt.url, w.Body)
+			}
+		}
+	}
+}
@@ -0,0 +1,514 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWALSegmentSizeMB = 64
+	DefaultWALMaxSizeMB     = 1024
+
+	walSegmentExt  = ".wal"
+	walOffsetFile  = "offset"
+	walHeaderSize  = 8
+	walMaxRecordMB = 256
+
+	// acks within a segment persist the read offset at most this often
+	walOffsetInterval = time.Second
+)
+
+var (
+	ErrWALClosed  = errors.New("wal closed")
+	ErrWALCorrupt = errors.New("wal record corrupt")
+)
+
+type walRecord struct {
+	query string
+	auth  string
+	buf   []byte
+	size  int64
+}
+
+// diskQueue is an append-only segment log used by retryBuffer to persist
+// failed writes. Records are read back in order, and a segment is removed
+// once every record in it has been acknowledged.
+//
+// Record layout: len(uint32) crc32(uint32) | len(query) query len(auth) auth data
+type diskQueue struct {
+	cond *sync.Cond
+
+	dir         string
+	segmentSize int64
+	maxSize     int64
+	fsync       bool
+
+	// periodic syncing, done stops syncLoop
+	ticker *time.Ticker
+	done   chan struct{}
+
+	segments []uint64
+
+	w     *os.File
+	wSize int64
+
+	r       *os.File
+	rReader *bufio.Reader
+	rSeg    uint64
+	rOff    int64
+	pending *walRecord
+
+	// last time the read offset was persisted
+	offsetSaved time.Time
+
+	size   int64
+	closed bool
+}
+
+// openDiskQueue opens or creates the segment log in dir. fsync is one of
+// "always" (default), "never" or a duration for periodic syncing.
+func openDiskQueue(dir string, segmentSize, maxSize int64, fsync string) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &diskQueue{
+		cond:        sync.NewCond(new(sync.Mutex)),
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+		offsetSaved: time.Now(),
+	}
+
+	switch fsync {
+	case "", "always":
+		q.fsync = true
+	case "never":
+	default:
+		d, err := time.ParseDuration(fsync)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing wal fsync '%v'", err)
+		}
+		q.ticker = time.NewTicker(d)
+	}
+
+	if err := q.load(); err != nil {
+		if q.ticker != nil {
+			q.ticker.Stop()
+		}
+		return nil, err
+	}
+
+	if q.ticker != nil {
+		q.done = make(chan struct{})
+		go q.syncLoop()
+	}
+	return q, nil
+}
+
+func (q *diskQueue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, walSegmentExt))
+}
+
+// load scans the directory for existing segments, restores the read offset
+// and truncates a partially written tail record left by a crash.
+func (q *diskQueue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), walSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), walSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, id)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	if len(q.segments) == 0 {
+		q.segments = []uint64{1}
+	}
+
+	last := q.segments[len(q.segments)-1]
+	valid, err := q.validEnd(last)
+	if err != nil {
+		return err
+	}
+
+	q.w, err = os.OpenFile(q.segmentPath(last), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err = q.w.Truncate(valid); err != nil {
+		return err
+	}
+	if _, err = q.w.Seek(valid, io.SeekStart); err != nil {
+		return err
+	}
+	q.wSize = valid
+
+	q.rSeg = q.segments[0]
+	if p, err := ioutil.ReadFile(filepath.Join(q.dir, walOffsetFile)); err == nil {
+		var seg uint64
+		var off int64
+		if _, err := fmt.Sscanf(string(p), "%d %d", &seg, &off); err == nil && seg == q.rSeg {
+			q.rOff = off
+		}
+	}
+
+	for _, id := range q.segments {
+		if id == last {
+			q.size += q.wSize
+			continue
+		}
+		fi, err := os.Stat(q.segmentPath(id))
+		if err != nil {
+			return err
+		}
+		q.size += fi.Size()
+	}
+	q.size -= q.rOff
+	if q.size < 0 {
+		q.size = 0
+	}
+
+	return nil
+}
+
+// validEnd returns the offset just past the last intact record of a segment.
+func (q *diskQueue) validEnd(id uint64) (int64, error) {
+	f, err := os.Open(q.segmentPath(id))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	var off int64
+	for {
+		rec, err := readWALRecord(rd)
+		if err != nil {
+			return off, nil
+		}
+		off += rec.size
+	}
+}
+
+func (q *diskQueue) syncLoop() {
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-q.ticker.C:
+		}
+
+		q.cond.L.Lock()
+		if !q.closed {
+			q.w.Sync()
+		}
+		q.cond.L.Unlock()
+	}
+}
+
+func encodeWALRecord(query, auth string, buf []byte) []byte {
+	n := 8 + len(query) + len(auth) + len(buf)
+	p := make([]byte, walHeaderSize+n)
+	body := p[walHeaderSize:]
+
+	binary.BigEndian.PutUint32(body[0:], uint32(len(query)))
+	copy(body[4:], query)
+	off := 4 + len(query)
+	binary.BigEndian.PutUint32(body[off:], uint32(len(auth)))
+	copy(body[off+4:], auth)
+	copy(body[off+4+len(auth):], buf)
+
+	binary.BigEndian.PutUint32(p[0:], uint32(n))
+	binary.BigEndian.PutUint32(p[4:], crc32.ChecksumIEEE(body))
+	return p
+}
+
+func readWALRecord(rd io.Reader) (*walRecord, error) {
+	var hdr [walHeaderSize]byte
+	if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[0:])
+	if n < 8 || n > walMaxRecordMB*MB {
+		return nil, ErrWALCorrupt
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(rd, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(hdr[4:]) {
+		return nil, ErrWALCorrupt
+	}
+
+	qlen := binary.BigEndian.Uint32(body[0:])
+	if 4+qlen+4 > n {
+		return nil, ErrWALCorrupt
+	}
+	off := 4 + qlen
+	alen := binary.BigEndian.Uint32(body[off:])
+	if off+4+alen > n {
+		return nil, ErrWALCorrupt
+	}
+
+	return &walRecord{
+		query: string(body[4:off]),
+		auth:  string(body[off+4 : off+4+alen]),
+		buf:   body[off+4+alen:],
+		size:  int64(walHeaderSize + n),
+	}, nil
+}
+
+// append persists a batch, honouring the fsync policy before returning.
+func (q *diskQueue) append(buf []byte, query, auth string) error {
+	p := encodeWALRecord(query, auth, buf)
+
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	if q.closed {
+		return ErrWALClosed
+	}
+	if q.size+int64(len(p)) > q.maxSize {
+		return ErrBufferFull
+	}
+
+	if q.wSize > 0 && q.wSize+int64(len(p)) > q.segmentSize {
+		if err := q.roll(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := q.w.Write(p); err != nil {
+		return err
+	}
+	if q.fsync {
+		if err := q.w.Sync(); err != nil {
+			return err
+		}
+	}
+
+	q.wSize += int64(len(p))
+	q.size += int64(len(p))
+	q.cond.Signal()
+	return nil
+}
+
+// roll closes the current write segment and starts a new one.
+func (q *diskQueue) roll() error {
+	if err := q.w.Sync(); err != nil {
+		return err
+	}
+	if err := q.w.Close(); err != nil {
+		return err
+	}
+
+	id := q.segments[len(q.segments)-1] + 1
+	w, err := os.OpenFile(q.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	q.w = w
+	q.wSize = 0
+	q.segments = append(q.segments, id)
+	return nil
+}
+
+// next blocks until a record is available and returns it without removing
+// it from the queue. The same record is returned until ack is called.
+func (q *diskQueue) next() (*walRecord, error) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	for {
+		for q.size == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			return nil, ErrWALClosed
+		}
+		if q.pending != nil {
+			return q.pending, nil
+		}
+
+		if q.r == nil {
+			r, err := os.Open(q.segmentPath(q.rSeg))
+			if err != nil {
+				return nil, err
+			}
+			if _, err = r.Seek(q.rOff, io.SeekStart); err != nil {
+				r.Close()
+				return nil, err
+			}
+			q.r = r
+			q.rReader = bufio.NewReader(r)
+		}
+
+		rec, err := readWALRecord(q.rReader)
+		if err == nil {
+			q.pending = rec
+			return rec, nil
+		}
+
+		if q.rSeg == q.segments[len(q.segments)-1] {
+			// appends are done under the lock, so an unreadable tail means
+			// the accounting is off; skip to the write position.
+			log.Printf("wal %s: skipping unreadable tail of segment %d: %s", q.dir, q.rSeg, err)
+			q.r.Close()
+			q.r = nil
+			q.rOff = q.wSize
+			q.size = 0
+			q.saveOffset()
+			continue
+		}
+
+		if err != io.EOF {
+			log.Printf("wal %s: dropping rest of segment %d: %s", q.dir, q.rSeg, err)
+		}
+		q.advanceSegment()
+	}
+}
+
+// advanceSegment removes the fully read segment and moves to the next one.
+func (q *diskQueue) advanceSegment() {
+	if q.r != nil {
+		q.r.Close()
+		q.r = nil
+	}
+
+	path := q.segmentPath(q.rSeg)
+	if fi, err := os.Stat(path); err == nil {
+		q.size -= fi.Size() - q.rOff
+	}
+	os.Remove(path)
+
+	q.segments = q.segments[1:]
+	q.rSeg = q.segments[0]
+	q.rOff = 0
+	q.saveOffset()
+}
+
+// ack removes the record returned by next and reports whether the queue is empty.
+func (q *diskQueue) ack() bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	if q.pending == nil {
+		return q.size == 0
+	}
+
+	q.rOff += q.pending.size
+	q.size -= q.pending.size
+	q.pending = nil
+
+	if q.rSeg != q.segments[len(q.segments)-1] {
+		if fi, err := os.Stat(q.segmentPath(q.rSeg)); err == nil && q.rOff >= fi.Size() {
+			q.advanceSegment()
+			return q.size == 0
+		}
+	}
+
+	// the offset only moves forward, so a stale one after a crash just
+	// replays the records acknowledged since it was saved.
+	if time.Since(q.offsetSaved) >= walOffsetInterval {
+		q.saveOffset()
+	}
+
+	return q.size == 0
+}
+
+// saveOffset replaces the offset file through a temporary file, so a crash
+// leaves either the old or the new offset and never a torn one. The file is
+// synced unless the fsync policy is "never".
+func (q *diskQueue) saveOffset() {
+	q.offsetSaved = time.Now()
+	p := []byte(fmt.Sprintf("%d %d", q.rSeg, q.rOff))
+	sync := q.fsync || q.ticker != nil
+	if err := replaceFile(filepath.Join(q.dir, walOffsetFile), p, sync); err != nil {
+		log.Printf("wal %s: save offset error: %s", q.dir, err)
+	}
+}
+
+func replaceFile(path string, p []byte, sync bool) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(p); err == nil && sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (q *diskQueue) empty() bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.size == 0
+}
+
+// bytes returns the size of the records not acknowledged yet.
+func (q *diskQueue) bytes() int64 {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.size
+}
+
+func (q *diskQueue) close() error {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.cond.Broadcast()
+
+	if q.ticker != nil {
+		q.ticker.Stop()
+		close(q.done)
+	}
+	if q.r != nil {
+		q.r.Close()
+	}
+	q.saveOffset()
+	q.w.Sync()
+	return q.w.Close()
+}
@@ -0,0 +1,214 @@
+package relay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestDiskQueueReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// tiny segments so every record rolls into its own file
+	q, err := openDiskQueue(dir, 16, MB, "never")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []string{"cpu value=1", "cpu value=2", "mem value=3"}
+	for _, l := range lines {
+		if err := q.append([]byte(l), "db=test", "auth"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec, err := q.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rec.buf) != lines[0] || rec.query != "db=test" || rec.auth != "auth" {
+		t.Fatalf("unexpected record: %+v", rec)
+	}
+	if q.ack() {
+		t.Fatal("queue should not be empty")
+	}
+	q.close()
+
+	// the offset is replaced through a temporary file
+	if p, err := ioutil.ReadFile(filepath.Join(dir, walOffsetFile)); err != nil || string(p) != "2 0" {
+		t.Fatalf("unexpected offset %q: %v", p, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, walOffsetFile+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("temporary offset file left: %v", err)
+	}
+
+	q, err = openDiskQueue(dir, 16, MB, "never")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+
+	for _, l := range lines[1:] {
+		rec, err := q.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rec.buf) != l {
+			t.Fatalf("replay order wrong: %s != %s", rec.buf, l)
+		}
+		q.ack()
+	}
+
+	if !q.empty() {
+		t.Fatal("queue should be empty")
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+walSegmentExt))
+	if len(segments) != 1 {
+		t.Fatalf("acknowledged segments not removed: %v", segments)
+	}
+}
+
+func TestDiskQueueFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := openDiskQueue(dir, MB, 64, "always")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+
+	if err := q.append(make([]byte, 32), "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.append(make([]byte, 32), "", ""); err != ErrBufferFull {
+		t.Fatalf("expected %s, got %v", ErrBufferFull, err)
+	}
+}
+
+func TestDiskQueueTruncatesTornWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := openDiskQueue(dir, MB, MB, "never")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.append([]byte("cpu value=1"), "", "")
+	q.close()
+
+	f, err := os.OpenFile(q.segmentPath(1), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeWALRecord("", "", []byte("cpu value=2"))[:10])
+	f.Close()
+
+	q, err = openDiskQueue(dir, MB, MB, "never")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+
+	rec, err := q.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rec.buf) != "cpu value=1" {
+		t.Fatalf("unexpected record: %s", rec.buf)
+	}
+	if !q.ack() {
+		t.Fatal("torn record should have been discarded")
+	}
+}
+
+func TestDiskQueueSyncLoopStops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	before := runtime.NumGoroutine()
+	q, err := openDiskQueue(dir, MB, MB, "1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.close()
+
+	// the periodic sync goroutine exits with the queue
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines left running after close, %d before open", n, before)
+	}
+}
+
+func TestDiskQueueOffsetSavedLazily(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := openDiskQueue(dir, MB, MB, "always")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []string{"cpu value=1", "cpu value=2", "mem value=3"}
+	for _, l := range lines {
+		if err := q.append([]byte(l), "db=test", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range lines[:2] {
+		if _, err := q.next(); err != nil {
+			t.Fatal(err)
+		}
+		q.ack()
+	}
+
+	// acks within a segment don't rewrite the offset every time
+	offset := filepath.Join(dir, walOffsetFile)
+	if _, err := os.Stat(offset); !os.IsNotExist(err) {
+		t.Fatalf("offset saved on every ack: %v", err)
+	}
+
+	// a crash before the offset is saved replays the acknowledged records
+	crashed, err := openDiskQueue(dir, MB, MB, "always")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := crashed.next(); err != nil || string(rec.buf) != lines[0] {
+		t.Fatalf("unexpected replay %v: %v", rec, err)
+	}
+	crashed.r.Close()
+	crashed.w.Close()
+
+	// close persists the offset
+	q.close()
+	q, err = openDiskQueue(dir, MB, MB, "always")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+	if rec, err := q.next(); err != nil || string(rec.buf) != lines[2] {
+		t.Fatalf("unexpected record %v: %v", rec, err)
+	}
+}